@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/filesystem"
@@ -18,8 +20,36 @@ var embedFS embed.FS
 
 func main() {
 	port := flag.Int("port", 3000, "Port to listen on")
+	root := flag.String("root", ".", "Workspace root directory; all file operations are confined to it")
+	pollInterval := flag.Duration("poll-interval", 2*time.Second, "File watcher polling interval when inotify is unavailable")
+	exclude := flag.String("exclude", ".git", "Comma-separated patterns (gitignore syntax) hidden from directory listings")
+	maxFileSize := flag.Int64("max-file-size", 10<<20, "Files larger than this many bytes open read-only in pages (0 for no limit)")
+	stateDir := flag.String("state-dir", server.DefaultStateDir(), "Directory for editor state such as swap files; must be outside the workspace")
+	indexRescan := flag.Duration("index-rescan", 5*time.Minute, "How often the quick-open file index is rebuilt from scratch (0 relies on the watcher alone)")
+	swapInterval := flag.Duration("swap-interval", 5*time.Second, "How often unsaved buffers are written to swap files (0 disables them)")
 	flag.Parse()
 
+	var excludes []string
+	for _, pattern := range strings.Split(*exclude, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			excludes = append(excludes, pattern)
+		}
+	}
+
+	workspace, err := server.NewWorkspace(*root, excludes)
+	if err != nil {
+		log.Fatalf("Invalid workspace root %s: %v", *root, err)
+	}
+	log.Printf("Workspace root: %s", workspace.Root())
+
+	statePath, err := server.PrepareStateDir(*stateDir)
+	if err != nil {
+		log.Fatalf("Invalid state directory %s: %v", *stateDir, err)
+	}
+	if workspace.Contains(statePath) {
+		log.Fatalf("State directory %s must be outside the workspace", statePath)
+	}
+
 	app := fiber.New(fiber.Config{
 		DisableStartupMessage: false,
 	})
@@ -28,10 +58,46 @@ func main() {
 	lspManager := server.NewMultiLSPManager()
 	defer lspManager.ShutdownAll()
 
+	// Buffers shared by all connections
+	documentStore := server.NewDocumentStore(lspManager, *maxFileSize)
+
+	// Index the workspace's files for quick open
+	fileIndex := server.NewFileIndex(workspace, *indexRescan)
+	defer fileIndex.Close()
+
+	// Watch the workspace for changes made outside the editor
+	watcher := server.NewWatcher(workspace, *pollInterval)
+	defer watcher.Close()
+	go server.ForwardFileEvents(watcher, documentStore, fileIndex, lspManager)
+	go server.ForwardLSPNotifications(lspManager, documentStore)
+
+	// Snapshot files on save and before reloads
+	localHistory, err := server.NewLocalHistory(statePath)
+	if err != nil {
+		log.Fatalf("Failed to create local history directory: %v", err)
+	}
+	documentStore.SetLocalHistory(localHistory)
+
+	// Journal unsaved buffers so they survive a crash
+	var swapStore *server.SwapStore
+	if *swapInterval > 0 {
+		swapStore, err = server.NewSwapStore(statePath)
+		if err != nil {
+			log.Fatalf("Failed to create swap directory: %v", err)
+		}
+		swapWriter := server.NewSwapWriter(documentStore, swapStore, *swapInterval)
+		defer swapWriter.Close()
+	}
+
 	// WebSocket upgrade middleware
 	app.Use("/ws", func(c *fiber.Ctx) error {
 		if websocket.IsWebSocketUpgrade(c) {
 			c.Locals("lspManager", lspManager)
+			c.Locals("workspace", workspace)
+			c.Locals("documentStore", documentStore)
+			c.Locals("swapStore", swapStore)
+			c.Locals("localHistory", localHistory)
+			c.Locals("fileIndex", fileIndex)
 			return c.Next()
 		}
 		return fiber.ErrUpgradeRequired
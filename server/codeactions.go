@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// codeActionOnSaveTimeout bounds each codeAction and codeAction/resolve
+// request made while saving; a slower server is skipped
+const codeActionOnSaveTimeout = 2 * time.Second
+
+// codeActionTriggerAutomatic marks code action requests the user did not
+// explicitly ask for
+const codeActionTriggerAutomatic = 2
+
+// codeAction is an LSP CodeAction. A bare Command may come back in its
+// place; its command field is then a string rather than an object.
+type codeAction struct {
+	Title    string          `json:"title"`
+	Kind     string          `json:"kind,omitempty"`
+	Edit     *WorkspaceEdit  `json:"edit,omitempty"`
+	Command  json.RawMessage `json:"command,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+	Disabled *struct {
+		Reason string `json:"reason"`
+	} `json:"disabled,omitempty"`
+}
+
+// isCommand reports whether the action is a bare Command
+func (a codeAction) isCommand() bool {
+	return len(a.Command) > 0 && a.Command[0] == '"'
+}
+
+// hasCommand reports whether the action runs a command after its edit
+func (a codeAction) hasCommand() bool {
+	return len(a.Command) > 0 && string(a.Command) != "null"
+}
+
+// matchesKind reports whether the action's kind is kind or one below it,
+// e.g. "source.fixAll.ruff" for "source.fixAll"
+func (a codeAction) matchesKind(kind string) bool {
+	return a.Kind == kind || strings.HasPrefix(a.Kind, kind+".")
+}
+
+// lspResponse unpacks a JSON-RPC response into result
+func lspResponse(response json.RawMessage, result interface{}) error {
+	var msg struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(response, &msg); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	if msg.Error != nil {
+		return errors.New(msg.Error.Message)
+	}
+	if len(msg.Result) == 0 || string(msg.Result) == "null" {
+		return nil
+	}
+	return json.Unmarshal(msg.Result, result)
+}
+
+// runCodeActionsOnSave applies the code actions of each kind, in order, to
+// an open document. Their workspace edits may reach other files too: open
+// buffers are edited and left dirty, closed files are rewritten. Actions
+// computed against text an earlier action has since changed are dropped,
+// as are bare commands, which the editor cannot run. It returns the number
+// of files the edits touched.
+func (s *session) runCodeActionsOnSave(uri string, kinds []string, resolve bool) int {
+	language := detectLanguageForLSP(uriToPath(uri))
+	touched := 0
+
+	for _, kind := range kinds {
+		snapshot, open := s.store.Snapshot(uri)
+		if !open {
+			return touched
+		}
+		checksum := ContentChecksum(snapshot.Content)
+		text := NewRope(snapshot.Content)
+
+		response, err := s.lspManager.RouteRequestTimeout("textDocument/codeAction", map[string]interface{}{
+			"textDocument": map[string]interface{}{
+				"uri": uri,
+			},
+			"range": Range{End: text.PositionAt(len(snapshot.Content))},
+			"context": map[string]interface{}{
+				"diagnostics": []interface{}{},
+				"only":        []string{kind},
+				"triggerKind": codeActionTriggerAutomatic,
+			},
+		}, codeActionOnSaveTimeout)
+		var actions []codeAction
+		if err == nil {
+			err = lspResponse(response, &actions)
+		}
+		if err != nil {
+			log.Printf("Warning: Skipping %s on save of %s: %v", kind, uri, err)
+			continue
+		}
+
+		for _, action := range actions {
+			if action.isCommand() || action.Disabled != nil || !action.matchesKind(kind) {
+				continue
+			}
+			if current, open := s.store.Snapshot(uri); !open || ContentChecksum(current.Content) != checksum {
+				log.Printf("Warning: Skipping code action %q on save of %s: the document changed", action.Title, uri)
+				break
+			}
+
+			if action.Edit == nil && resolve {
+				response, err := s.lspManager.SendRequestTimeout(language, "codeAction/resolve", action, codeActionOnSaveTimeout)
+				if err == nil {
+					err = lspResponse(response, &action)
+				}
+				if err != nil {
+					log.Printf("Warning: Failed to resolve code action %q: %v", action.Title, err)
+					continue
+				}
+			}
+			if action.hasCommand() {
+				log.Printf("Warning: Not running the command of code action %q on save", action.Title)
+			}
+			if action.Edit == nil {
+				continue
+			}
+
+			n, err := ApplyWorkspaceEdit(*action.Edit, s.store, s.workspace)
+			touched += n
+			if err != nil {
+				log.Printf("Warning: Failed to apply code action %q: %v", action.Title, err)
+			}
+		}
+	}
+	return touched
+}
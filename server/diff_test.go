@@ -0,0 +1,219 @@
+package server
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// applyDiffOps rebuilds both sides of an edit script
+func applyDiffOps(ops []diffOp) (a, b []string) {
+	for _, op := range ops {
+		if op.kind != '+' {
+			a = append(a, op.text)
+		}
+		if op.kind != '-' {
+			b = append(b, op.text)
+		}
+	}
+	return a, b
+}
+
+func equalLines(a, b []string) bool {
+	return len(a) == len(b) && (len(a) == 0 || reflect.DeepEqual(a, b))
+}
+
+func countEdits(ops []diffOp) int {
+	edits := 0
+	for _, op := range ops {
+		if op.kind != ' ' {
+			edits++
+		}
+	}
+	return edits
+}
+
+func TestDiffLinesScript(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  string
+		edits int // length of a shortest edit script
+	}{
+		{"equal", "a\nb\nc", "a\nb\nc", 0},
+		{"both empty", "", "", 0},
+		{"from empty", "", "a\nb", 2},
+		{"to empty", "a\nb", "", 2},
+		{"one changed", "a\nb\nc", "a\nx\nc", 2},
+		{"insert at start", "b\nc", "a\nb\nc", 1},
+		{"delete at end", "a\nb\nc", "a\nb", 1},
+		{"myers paper", "a\nb\nc\na\nb\nb\na", "c\nb\na\nb\na\nc", 5},
+		{"swapped blocks", "1\n2\n3\n4\n5\n6", "4\n5\n6\n1\n2\n3", 6},
+		{"repeated lines", "x\nx\nx\nx", "x\nx", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := splitLines(tt.a), splitLines(tt.b)
+			ops := diffLines(a, b)
+			gotA, gotB := applyDiffOps(ops)
+			if !equalLines(gotA, a) || !equalLines(gotB, b) {
+				t.Fatalf("script %v does not turn %q into %q", ops, tt.a, tt.b)
+			}
+			if edits := countEdits(ops); edits != tt.edits {
+				t.Errorf("script has %d edits; want %d", edits, tt.edits)
+			}
+		})
+	}
+}
+
+// TestDiffLinesRandom checks scripts between random texts over a small
+// alphabet, where lines repeat a lot
+func TestDiffLinesRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, rng.Intn(30))
+		for i := range lines {
+			lines[i] = string(rune('a' + rng.Intn(4)))
+		}
+		return lines
+	}
+	for i := 0; i < 500; i++ {
+		a, b := randomLines(), randomLines()
+		ops := diffLines(a, b)
+		gotA, gotB := applyDiffOps(ops)
+		if !equalLines(gotA, a) || !equalLines(gotB, b) {
+			t.Fatalf("script %v does not turn %v into %v", ops, a, b)
+		}
+		if edits, want := countEdits(ops), len(a)+len(b)-2*longestCommon(a, b); edits != want {
+			t.Fatalf("script for %v and %v has %d edits; want %d", a, b, edits, want)
+		}
+	}
+}
+
+// longestCommon is the length of the longest common subsequence of a and
+// b; a shortest edit script keeps exactly those lines
+func longestCommon(a, b []string) int {
+	prev := make([]int, len(b)+1)
+	for i := range a {
+		cur := make([]int, len(b)+1)
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				cur[j+1] = prev[j] + 1
+			case prev[j+1] > cur[j]:
+				cur[j+1] = prev[j+1]
+			default:
+				cur[j+1] = cur[j]
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func TestDiffLinesTooFarApart(t *testing.T) {
+	var a, b []string
+	for i := 0; i <= maxDiffEdits; i++ {
+		a = append(a, "old")
+		b = append(b, "new")
+	}
+	ops := diffLines(a, b)
+	gotA, gotB := applyDiffOps(ops)
+	if !equalLines(gotA, a) || !equalLines(gotB, b) {
+		t.Fatal("the coarse script does not turn a into b")
+	}
+}
+
+func TestDiffHunks(t *testing.T) {
+	numbered := func(from, to int, replace map[int]string) string {
+		var sb strings.Builder
+		for i := from; i <= to; i++ {
+			if line, ok := replace[i]; ok {
+				if line != "" {
+					sb.WriteString(line + "\n")
+				}
+				continue
+			}
+			sb.WriteString(string(rune('0'+i/10)) + string(rune('0'+i%10)) + "\n")
+		}
+		return sb.String()
+	}
+
+	tests := []struct {
+		name    string
+		a, b    string
+		context int
+		want    []DiffHunk
+	}{
+		{
+			name: "no change",
+			a:    "a\nb\n", b: "a\nb\n", context: 3,
+			want: nil,
+		},
+		{
+			name: "change in the middle",
+			a:    numbered(1, 20, nil), b: numbered(1, 20, map[int]string{10: "X"}), context: 2,
+			want: []DiffHunk{{OldStart: 8, OldLines: 5, NewStart: 8, NewLines: 5,
+				Lines: []string{" 08", " 09", "-10", "+X", " 11", " 12"}}},
+		},
+		{
+			name: "changes close together share a hunk",
+			a:    numbered(1, 20, nil), b: numbered(1, 20, map[int]string{5: "X", 9: "Y"}), context: 2,
+			want: []DiffHunk{{OldStart: 3, OldLines: 9, NewStart: 3, NewLines: 9,
+				Lines: []string{" 03", " 04", "-05", "+X", " 06", " 07", " 08", "-09", "+Y", " 10", " 11"}}},
+		},
+		{
+			name: "changes far apart get their own hunks",
+			a:    numbered(1, 20, nil), b: numbered(1, 20, map[int]string{3: "X", 15: "Y"}), context: 1,
+			want: []DiffHunk{
+				{OldStart: 2, OldLines: 3, NewStart: 2, NewLines: 3, Lines: []string{" 02", "-03", "+X", " 04"}},
+				{OldStart: 14, OldLines: 3, NewStart: 14, NewLines: 3, Lines: []string{" 14", "-15", "+Y", " 16"}},
+			},
+		},
+		{
+			name: "line added at the start of a file",
+			a:    "a\nb\n", b: "new\na\nb\n", context: 3,
+			want: []DiffHunk{{OldStart: 1, OldLines: 2, NewStart: 1, NewLines: 3,
+				Lines: []string{"+new", " a", " b"}}},
+		},
+		{
+			name: "file emptied",
+			a:    "a\nb\n", b: "", context: 3,
+			want: []DiffHunk{{OldStart: 1, OldLines: 2, NewStart: 0, NewLines: 0,
+				Lines: []string{"-a", "-b"}}},
+		},
+		{
+			name: "file created",
+			a:    "", b: "a\n", context: 3,
+			want: []DiffHunk{{OldStart: 0, OldLines: 0, NewStart: 1, NewLines: 1,
+				Lines: []string{"+a"}}},
+		},
+		{
+			name: "lines removed without context",
+			a:    numbered(1, 6, nil), b: numbered(1, 6, map[int]string{3: "", 4: ""}), context: 0,
+			want: []DiffHunk{{OldStart: 3, OldLines: 2, NewStart: 2, NewLines: 0,
+				Lines: []string{"-03", "-04"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DiffLines(tt.a, tt.b, tt.context)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	got := UnifiedDiff("a/f.txt", "b/f.txt", DiffLines("a\nb\nc\n", "a\nB\nc\n", 1))
+	want := "--- a/f.txt\n+++ b/f.txt\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"
+	if got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if got := UnifiedDiff("a", "b", nil); got != "" {
+		t.Errorf("no hunks: got %q", got)
+	}
+}
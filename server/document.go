@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"strings"
+)
+
+// Document is an open text buffer held by the DocumentStore
+type Document struct {
+	URI        string
+	Path       string
+	LanguageID string
+	Version    int
+	Text       *Rope
+	Dirty      bool       // buffer differs from what was last read or saved
+	LSPOpen    bool       // whether textDocument/didOpen has been delivered
+	Disk       DiskStamp  // file state when last read or saved
+	Format     TextFormat // encoding and line endings to save with
+
+	saved       *Rope // text when last read or saved; nil once the file is deleted
+	savedFormat TextFormat
+}
+
+// NewDocument creates a document for a file freshly read from disk
+func NewDocument(path, content string) *Document {
+	return &Document{
+		URI:        pathToURI(path),
+		Path:       path,
+		LanguageID: detectLanguage(path),
+		Version:    1,
+		Text:       NewRope(content),
+		Format:     DefaultTextFormat,
+	}
+}
+
+// markClean records that the buffer matches the file on disk
+func (d *Document) markClean() {
+	d.Dirty = false
+	d.saved = d.Text
+	d.savedFormat = d.Format
+}
+
+// isSaved reports whether the buffer holds what was last read or saved,
+// e.g. after undoing every edit made since
+func (d *Document) isSaved() bool {
+	if d.saved == nil || d.Format != d.savedFormat {
+		return false
+	}
+	return d.Text == d.saved || (d.Text.Len() == d.saved.Len() && d.Text.String() == d.saved.String())
+}
+
+// pathToURI converts an absolute path to a file:// URI
+func pathToURI(path string) string {
+	return "file://" + path
+}
+
+// uriToPath converts a file:// URI back to a path. LSP servers may
+// percent-encode URIs they produce, so the path is unescaped.
+func uriToPath(uri string) string {
+	path := strings.TrimPrefix(uri, "file://")
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		return unescaped
+	}
+	return path
+}
+
+// ContentChecksum fingerprints buffer content so a client can prove its copy
+// matches the server's. FNV-1a over the UTF-8 bytes is cheap to compute in
+// the browser without the async WebCrypto API.
+func ContentChecksum(content string) string {
+	h := fnv.New32a()
+	h.Write([]byte(content))
+	return fmt.Sprintf("fnv1a32:%08x:%d", h.Sum32(), len(content))
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// editorConfigFile is the name of the files EditorConfig reads
+const editorConfigFile = ".editorconfig"
+
+// maxEditorConfigRange caps the numbers a {num1..num2} glob expands to
+const maxEditorConfigRange = 1000
+
+// EditorConfig holds the EditorConfig properties that apply to one file.
+// Unset properties are left empty (or nil), meaning the editor decides.
+type EditorConfig struct {
+	IndentStyle            string `json:"indentStyle,omitempty"` // "tab" or "space"
+	IndentSize             int    `json:"indentSize,omitempty"`
+	TabWidth               int    `json:"tabWidth,omitempty"`
+	EndOfLine              string `json:"endOfLine,omitempty"` // "lf", "crlf" or "cr"
+	Charset                string `json:"charset,omitempty"`   // "utf-8", "utf-8-bom", "utf-16le", "utf-16be" or "latin1"
+	TrimTrailingWhitespace *bool  `json:"trimTrailingWhitespace,omitempty"`
+	InsertFinalNewline     *bool  `json:"insertFinalNewline,omitempty"`
+}
+
+// editorConfigSection is one [glob] section of an .editorconfig file
+type editorConfigSection struct {
+	re    *regexp.Regexp // matched against the path relative to the file's directory
+	props map[string]string
+}
+
+// LoadEditorConfig resolves the EditorConfig properties for path from the
+// .editorconfig files in its directory and every parent, up to the first
+// one declaring root = true. Nearer files take precedence, as do later
+// sections within a file. Unreadable files are skipped.
+func LoadEditorConfig(path string) EditorConfig {
+	type configFile struct {
+		dir      string
+		sections []editorConfigSection
+	}
+
+	var files []configFile
+	for dir := filepath.Dir(path); ; {
+		sections, root, err := parseEditorConfig(filepath.Join(dir, editorConfigFile))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: Ignoring %s: %v", filepath.Join(dir, editorConfigFile), err)
+		}
+		files = append(files, configFile{dir: dir, sections: sections})
+		parent := filepath.Dir(dir)
+		if root || parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	props := make(map[string]string)
+	for i := len(files) - 1; i >= 0; i-- {
+		rel, err := filepath.Rel(files[i].dir, path)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		for _, section := range files[i].sections {
+			if !section.re.MatchString(rel) {
+				continue
+			}
+			for key, value := range section.props {
+				props[key] = value
+			}
+		}
+	}
+	return newEditorConfig(props)
+}
+
+// parseEditorConfig reads the sections of an .editorconfig file and whether
+// its preamble declares root = true
+func parseEditorConfig(path string) ([]editorConfigSection, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	var sections []editorConfigSection
+	root := false
+	inPreamble := true
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			inPreamble = false
+			re, err := regexp.Compile(editorConfigGlobToRegexp(line[1 : len(line)-1]))
+			if err != nil {
+				// A section we cannot match applies to nothing
+				re = regexp.MustCompile(`^\b$`)
+			}
+			sections = append(sections, editorConfigSection{re: re, props: make(map[string]string)})
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.ToLower(strings.TrimSpace(value))
+		if inPreamble {
+			if key == "root" {
+				root = value == "true"
+			}
+			continue
+		}
+		sections[len(sections)-1].props[key] = value
+	}
+	return sections, root, scanner.Err()
+}
+
+// editorConfigGlobToRegexp translates a section glob. Globs without a slash
+// match file names in any directory; others are relative to the directory
+// of the .editorconfig file.
+func editorConfigGlobToRegexp(glob string) string {
+	glob = expandNumericRanges(glob)
+	if !strings.Contains(glob, "/") {
+		glob = "**/" + glob
+	}
+	alternatives := expandBraces(strings.TrimPrefix(glob, "/"))
+	parts := make([]string, len(alternatives))
+	for i, alt := range alternatives {
+		re := globToRegexp(alt)
+		parts[i] = strings.TrimSuffix(strings.TrimPrefix(re, "^"), "$")
+	}
+	return "^(?:" + strings.Join(parts, "|") + ")$"
+}
+
+var numericRangeRE = regexp.MustCompile(`\{(-?\d+)\.\.(-?\d+)\}`)
+
+// expandNumericRanges rewrites {num1..num2} as the {a,b} alternatives of
+// every number in between
+func expandNumericRanges(glob string) string {
+	return numericRangeRE.ReplaceAllStringFunc(glob, func(match string) string {
+		bounds := numericRangeRE.FindStringSubmatch(match)
+		from, _ := strconv.Atoi(bounds[1])
+		to, _ := strconv.Atoi(bounds[2])
+		if from > to {
+			from, to = to, from
+		}
+		if to-from > maxEditorConfigRange {
+			return match
+		}
+		numbers := make([]string, 0, to-from+1)
+		for n := from; n <= to; n++ {
+			numbers = append(numbers, strconv.Itoa(n))
+		}
+		if len(numbers) == 1 {
+			// expandBraces needs a comma to see alternatives
+			return numbers[0]
+		}
+		return "{" + strings.Join(numbers, ",") + "}"
+	})
+}
+
+// newEditorConfig interprets resolved properties, dropping invalid values
+// and those set to "unset"
+func newEditorConfig(props map[string]string) EditorConfig {
+	var c EditorConfig
+	switch props["indent_style"] {
+	case "tab", "space":
+		c.IndentStyle = props["indent_style"]
+	}
+	if n, err := strconv.Atoi(props["tab_width"]); err == nil && n > 0 {
+		c.TabWidth = n
+	}
+	if props["indent_size"] == "tab" {
+		// An indent is one tab, as wide as tab_width or else the default
+		c.IndentSize = c.TabWidth
+		if c.IndentSize == 0 {
+			c.IndentSize = DefaultFormattingOptions.TabSize
+		}
+	} else if n, err := strconv.Atoi(props["indent_size"]); err == nil && n > 0 {
+		c.IndentSize = n
+		if c.TabWidth == 0 {
+			c.TabWidth = n
+		}
+	}
+	switch props["end_of_line"] {
+	case LineEndingLF, LineEndingCRLF, LineEndingCR:
+		c.EndOfLine = props["end_of_line"]
+	}
+	switch props["charset"] {
+	case "utf-8", "utf-8-bom", "utf-16le", "utf-16be", "latin1":
+		c.Charset = props["charset"]
+	}
+	c.TrimTrailingWhitespace = editorConfigBool(props["trim_trailing_whitespace"])
+	c.InsertFinalNewline = editorConfigBool(props["insert_final_newline"])
+	return c
+}
+
+func editorConfigBool(value string) *bool {
+	switch value {
+	case "true":
+		b := true
+		return &b
+	case "false":
+		b := false
+		return &b
+	}
+	return nil
+}
+
+// TextFormat returns format with the configured line ending and charset
+func (c EditorConfig) TextFormat(format TextFormat) TextFormat {
+	if c.EndOfLine != "" {
+		format.LineEnding = c.EndOfLine
+	}
+	switch c.Charset {
+	case "":
+	case "utf-8", "utf-8-bom":
+		format.Encoding = EncodingUTF8
+		format.BOM = c.Charset == "utf-8-bom"
+	case "latin1":
+		format.Encoding = EncodingLatin1
+		format.BOM = false
+	default:
+		if format.Encoding != c.Charset {
+			// UTF-16 files are written with a byte order mark unless the
+			// file already did without one
+			format.Encoding = c.Charset
+			format.BOM = true
+		}
+	}
+	return format
+}
+
+// FormattingOptions returns opts with the configured indentation
+func (c EditorConfig) FormattingOptions(opts FormattingOptions) FormattingOptions {
+	switch c.IndentStyle {
+	case "tab":
+		opts.InsertSpaces = false
+		if c.TabWidth > 0 {
+			opts.TabSize = c.TabWidth
+		}
+	case "space":
+		opts.InsertSpaces = true
+	}
+	if c.IndentStyle != "tab" && c.IndentSize > 0 {
+		opts.TabSize = c.IndentSize
+	}
+	return opts
+}
+
+// NormalizeEdits returns the text edits that trim trailing whitespace and
+// add or remove the final newline, as configured. content has LF line
+// endings, as buffers do.
+func (c EditorConfig) NormalizeEdits(content string) []TextEdit {
+	trim := c.TrimTrailingWhitespace != nil && *c.TrimTrailingWhitespace
+	lines := strings.Split(content, "\n")
+	last := len(lines) - 1
+	position := func(line, byteOffset int) Position {
+		return Position{Line: line, Character: OffsetInUnit(lines[line], byteOffset, OffsetUnitUTF16)}
+	}
+	trimmed := func(line int) int {
+		if !trim {
+			return len(lines[line])
+		}
+		return len(strings.TrimRight(lines[line], " \t"))
+	}
+
+	var edits []TextEdit
+	// Lines from stop on are left to the final newline handling
+	stop := len(lines)
+	var tail *TextEdit
+
+	if c.InsertFinalNewline != nil && !*c.InsertFinalNewline {
+		// Everything after the last line with content goes: trailing
+		// newlines, and with trimming the blank space around them
+		end := last
+		for end > 0 && trimmed(end) == 0 && (trim || lines[end] == "") {
+			end--
+		}
+		if end < last || trimmed(last) < len(lines[last]) {
+			stop = end
+			tail = &TextEdit{Range: Range{Start: position(end, trimmed(end)), End: position(last, len(lines[last]))}}
+		}
+	} else if c.InsertFinalNewline != nil && content != "" && trimmed(last) > 0 {
+		stop = last
+		tail = &TextEdit{Range: Range{Start: position(last, trimmed(last)), End: position(last, len(lines[last]))}, NewText: "\n"}
+	}
+
+	if trim {
+		for i := 0; i < stop; i++ {
+			if cut := trimmed(i); cut < len(lines[i]) {
+				edits = append(edits, TextEdit{Range: Range{Start: position(i, cut), End: position(i, len(lines[i]))}})
+			}
+		}
+	}
+	if tail != nil {
+		edits = append(edits, *tail)
+	}
+	return edits
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Supported encodings
+const (
+	EncodingUTF8    = "utf-8"
+	EncodingUTF16LE = "utf-16le"
+	EncodingUTF16BE = "utf-16be"
+	EncodingLatin1  = "latin1"
+)
+
+// Line ending styles
+const (
+	LineEndingLF   = "lf"
+	LineEndingCRLF = "crlf"
+	LineEndingCR   = "cr"
+)
+
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// TextFormat describes how a text file is stored on disk. Buffers are always
+// UTF-8 with LF line endings; the format is what a save converts back to.
+type TextFormat struct {
+	Encoding   string `json:"encoding"`
+	BOM        bool   `json:"bom"`
+	LineEnding string `json:"lineEnding"`
+}
+
+// DefaultTextFormat is used for new files
+var DefaultTextFormat = TextFormat{Encoding: EncodingUTF8, LineEnding: LineEndingLF}
+
+// Validate checks that the format names a supported encoding and line ending
+func (f TextFormat) Validate() error {
+	switch f.Encoding {
+	case EncodingUTF8, EncodingUTF16LE, EncodingUTF16BE:
+	case EncodingLatin1:
+		if f.BOM {
+			return errors.New("latin1 has no byte order mark")
+		}
+	default:
+		return fmt.Errorf("unsupported encoding: %q", f.Encoding)
+	}
+
+	switch f.LineEnding {
+	case LineEndingLF, LineEndingCRLF, LineEndingCR:
+	default:
+		return fmt.Errorf("unsupported line ending: %q", f.LineEnding)
+	}
+	return nil
+}
+
+// DecodeText detects the encoding and line endings of data and returns it as
+// UTF-8 with LF line endings
+func DecodeText(data []byte) (string, TextFormat) {
+	format := TextFormat{Encoding: detectEncoding(data)}
+	format.BOM = hasBOM(data, format.Encoding)
+
+	text, err := decodeAs(data, format)
+	if err != nil {
+		// A BOM followed by bytes that do not fit it; Latin-1 shows them as they are
+		format = TextFormat{Encoding: EncodingLatin1}
+		text, _ = decodeAs(data, format)
+	}
+	format.LineEnding = detectLineEnding(text)
+	return normalizeLineEndings(text), format
+}
+
+// DecodeTextAs decodes data with a caller-chosen encoding, e.g. when the user
+// reopens a file whose encoding was guessed wrong
+func DecodeTextAs(data []byte, encoding string) (string, TextFormat, error) {
+	format := TextFormat{Encoding: encoding, LineEnding: LineEndingLF}
+	format.BOM = hasBOM(data, encoding)
+	if err := format.Validate(); err != nil {
+		return "", format, err
+	}
+
+	text, err := decodeAs(data, format)
+	if err != nil {
+		return "", format, err
+	}
+	format.LineEnding = detectLineEnding(text)
+	return normalizeLineEndings(text), format, nil
+}
+
+// EncodeText converts an LF buffer back to the bytes format describes. It
+// fails if the encoding cannot represent some character.
+func EncodeText(content string, format TextFormat) ([]byte, error) {
+	if err := format.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch format.LineEnding {
+	case LineEndingCRLF:
+		content = strings.ReplaceAll(content, "\n", "\r\n")
+	case LineEndingCR:
+		content = strings.ReplaceAll(content, "\n", "\r")
+	}
+
+	var buf bytes.Buffer
+	switch format.Encoding {
+	case EncodingUTF8:
+		if format.BOM {
+			buf.Write(bomUTF8)
+		}
+		buf.WriteString(content)
+
+	case EncodingUTF16LE, EncodingUTF16BE:
+		var order binary.ByteOrder = binary.LittleEndian
+		if format.Encoding == EncodingUTF16BE {
+			order = binary.BigEndian
+		}
+		if format.BOM {
+			binary.Write(&buf, order, uint16(0xFEFF))
+		}
+		units := utf16.Encode([]rune(content))
+		unit := make([]byte, 2)
+		for _, u := range units {
+			order.PutUint16(unit, u)
+			buf.Write(unit)
+		}
+
+	case EncodingLatin1:
+		line := 1
+		for _, r := range content {
+			if r > 0xFF {
+				return nil, fmt.Errorf("character %q on line %d cannot be encoded as latin1", r, line)
+			}
+			if r == '\n' || r == '\r' {
+				line++
+			}
+			buf.WriteByte(byte(r))
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// detectEncoding picks an encoding from a BOM, falling back to UTF-8 when
+// the data is valid UTF-8, BOM-less UTF-16 when the zero bytes look like
+// ASCII in UTF-16, and Latin-1 otherwise
+func detectEncoding(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, bomUTF8):
+		return EncodingUTF8
+	case bytes.HasPrefix(data, bomUTF16LE):
+		return EncodingUTF16LE
+	case bytes.HasPrefix(data, bomUTF16BE):
+		return EncodingUTF16BE
+	}
+
+	if utf8.Valid(data) && bytes.IndexByte(data, 0) < 0 {
+		return EncodingUTF8
+	}
+
+	if len(data) >= 2 && len(data)%2 == 0 {
+		evenZeros, oddZeros := 0, 0
+		for i, b := range data {
+			if b != 0 {
+				continue
+			}
+			if i%2 == 0 {
+				evenZeros++
+			} else {
+				oddZeros++
+			}
+		}
+		half := len(data) / 2
+		if oddZeros > half/2 && evenZeros == 0 {
+			return EncodingUTF16LE
+		}
+		if evenZeros > half/2 && oddZeros == 0 {
+			return EncodingUTF16BE
+		}
+	}
+
+	if utf8.Valid(data) {
+		return EncodingUTF8
+	}
+	return EncodingLatin1
+}
+
+func hasBOM(data []byte, encoding string) bool {
+	switch encoding {
+	case EncodingUTF8:
+		return bytes.HasPrefix(data, bomUTF8)
+	case EncodingUTF16LE:
+		return bytes.HasPrefix(data, bomUTF16LE)
+	case EncodingUTF16BE:
+		return bytes.HasPrefix(data, bomUTF16BE)
+	}
+	return false
+}
+
+// decodeAs converts data to UTF-8 without touching line endings
+func decodeAs(data []byte, format TextFormat) (string, error) {
+	switch format.Encoding {
+	case EncodingUTF8:
+		if format.BOM {
+			data = data[len(bomUTF8):]
+		}
+		if !utf8.Valid(data) {
+			return "", errors.New("file is not valid utf-8")
+		}
+		return string(data), nil
+
+	case EncodingUTF16LE, EncodingUTF16BE:
+		if format.BOM {
+			data = data[2:]
+		}
+		if len(data)%2 != 0 {
+			return "", errors.New("file has an odd number of bytes for utf-16")
+		}
+		var order binary.ByteOrder = binary.LittleEndian
+		if format.Encoding == EncodingUTF16BE {
+			order = binary.BigEndian
+		}
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = order.Uint16(data[2*i:])
+		}
+		return string(utf16.Decode(units)), nil
+
+	case EncodingLatin1:
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes), nil
+	}
+	return "", fmt.Errorf("unsupported encoding: %q", format.Encoding)
+}
+
+// detectLineEnding returns the most common line ending style, LF if the text
+// has no line breaks
+func detectLineEnding(text string) string {
+	lf, crlf, cr := 0, 0, 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\n':
+			lf++
+		case '\r':
+			if i+1 < len(text) && text[i+1] == '\n' {
+				crlf++
+				i++
+			} else {
+				cr++
+			}
+		}
+	}
+
+	switch {
+	case crlf > lf && crlf >= cr:
+		return LineEndingCRLF
+	case cr > lf && cr > crlf:
+		return LineEndingCR
+	}
+	return LineEndingLF
+}
+
+// normalizeLineEndings turns every line break into LF, whatever the file's
+// main style, so the buffer splits into lines the way the browser's editor
+// splits it. A save writes every LF in the file's style.
+func normalizeLineEndings(text string) string {
+	if !strings.Contains(text, "\r") {
+		return text
+	}
+	return strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\r", "\n")
+}
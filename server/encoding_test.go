@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecodeTextEncoding(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+		bom  bool
+		text string
+	}{
+		{"empty", nil, EncodingUTF8, false, ""},
+		{"ascii", []byte("plain"), EncodingUTF8, false, "plain"},
+		{"utf-8", []byte("héllo 😀"), EncodingUTF8, false, "héllo 😀"},
+		{"utf-8 bom", []byte("\xef\xbb\xbfhé"), EncodingUTF8, true, "hé"},
+		{"utf-16le bom", []byte{0xFF, 0xFE, 'h', 0, 0xE9, 0}, EncodingUTF16LE, true, "hé"},
+		{"utf-16be bom", []byte{0xFE, 0xFF, 0, 'h', 0, 0xE9}, EncodingUTF16BE, true, "hé"},
+		{"utf-16le without bom", []byte{'a', 0, 'b', 0, '\n', 0}, EncodingUTF16LE, false, "ab\n"},
+		{"utf-16be without bom", []byte{0, 'a', 0, 'b', 0, '\n'}, EncodingUTF16BE, false, "ab\n"},
+		{"utf-16le surrogate pair", []byte{0xFF, 0xFE, 0x3D, 0xD8, 0x00, 0xDE}, EncodingUTF16LE, true, "😀"},
+		{"latin1", []byte{'c', 'a', 'f', 0xE9}, EncodingLatin1, false, "café"},
+		{"nul bytes in utf-8", []byte("a\x00b"), EncodingUTF8, false, "a\x00b"},
+		{"bom with an odd utf-16 tail", []byte{0xFF, 0xFE, 'a'}, EncodingLatin1, false, "ÿþa"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, format := DecodeText(tt.data)
+			if format.Encoding != tt.want || format.BOM != tt.bom || text != tt.text {
+				t.Errorf("got %q as %s (bom %v); want %q as %s (bom %v)", text, format.Encoding, format.BOM, tt.text, tt.want, tt.bom)
+			}
+		})
+	}
+}
+
+func TestEncodeTextRoundTrip(t *testing.T) {
+	const content = "first line\nsecond é 😀\n"
+	formats := []TextFormat{
+		{Encoding: EncodingUTF8, LineEnding: LineEndingLF},
+		{Encoding: EncodingUTF8, BOM: true, LineEnding: LineEndingCRLF},
+		{Encoding: EncodingUTF16LE, BOM: true, LineEnding: LineEndingCRLF},
+		{Encoding: EncodingUTF16BE, BOM: true, LineEnding: LineEndingCR},
+	}
+	for _, format := range formats {
+		data, err := EncodeText(content, format)
+		if err != nil {
+			t.Fatalf("%+v: %v", format, err)
+		}
+		text, got := DecodeText(data)
+		if text != content || got != format {
+			t.Errorf("%+v: decoded %q as %+v", format, text, got)
+		}
+	}
+
+	latin1 := TextFormat{Encoding: EncodingLatin1, LineEnding: LineEndingLF}
+	if data, err := EncodeText("café", latin1); err != nil || !bytes.Equal(data, []byte{'c', 'a', 'f', 0xE9}) {
+		t.Errorf("latin1: got %q, %v", data, err)
+	}
+	if _, err := EncodeText("ok\n😀", latin1); err == nil {
+		t.Error("latin1: want an error for a character it cannot represent")
+	}
+	if _, err := EncodeText("x", TextFormat{Encoding: "ebcdic", LineEnding: LineEndingLF}); err == nil {
+		t.Error("want an error for an unsupported encoding")
+	}
+}
+
+func TestDecodeTextAs(t *testing.T) {
+	data := []byte{'c', 'a', 'f', 0xC3, 0xA9}
+	tests := []struct {
+		encoding string
+		want     string
+		wantErr  bool
+	}{
+		{EncodingUTF8, "café", false},
+		{EncodingLatin1, "cafÃ©", false},
+		{EncodingUTF16LE, "", true},
+		{"ebcdic", "", true},
+	}
+	for _, tt := range tests {
+		text, format, err := DecodeTextAs(data, tt.encoding)
+		if (err != nil) != tt.wantErr || (err == nil && (text != tt.want || format.Encoding != tt.encoding)) {
+			t.Errorf("%s: got %q, %+v, %v; want %q", tt.encoding, text, format, err, tt.want)
+		}
+	}
+}
+
+func TestDecodeTextLineEndings(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		want       string
+		lineEnding string
+	}{
+		{"lf", "a\nb\n", "a\nb\n", LineEndingLF},
+		{"crlf", "a\r\nb\r\n", "a\nb\n", LineEndingCRLF},
+		{"cr", "a\rb\r", "a\nb\n", LineEndingCR},
+		{"no line break", "abc", "abc", LineEndingLF},
+		{"crlf with a stray cr", "a\r\nb\rc\r\n", "a\nb\nc\n", LineEndingCRLF},
+		{"crlf with a stray lf", "a\r\nb\nc\r\n", "a\nb\nc\n", LineEndingCRLF},
+		{"lf with a stray cr", "a\nb\rc\n", "a\nb\nc\n", LineEndingLF},
+		{"cr with a stray crlf", "a\rb\r\nc\r", "a\nb\nc\n", LineEndingCR},
+		{"cr before crlf", "a\r\r\nb", "a\n\nb", LineEndingCRLF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, format := DecodeText([]byte(tt.data))
+			if got != tt.want || format.LineEnding != tt.lineEnding {
+				t.Errorf("got %q, %s; want %q, %s", got, format.LineEnding, tt.want, tt.lineEnding)
+			}
+		})
+	}
+}
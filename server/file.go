@@ -1,50 +1,405 @@
 package server
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
-// ReadFile reads the entire content of a file
-func ReadFile(path string) (string, error) {
-	// Clean the path to prevent directory traversal
+// FileEntry describes a file or directory for list_dir and stat responses
+type FileEntry struct {
+	Name          string    `json:"name"`
+	Path          string    `json:"path"`
+	Type          string    `json:"type"` // "file", "dir", "symlink" or "other"
+	Size          int64     `json:"size"`
+	ModTime       time.Time `json:"mtime"`
+	SymlinkTarget string    `json:"symlinkTarget,omitempty"`
+	TargetType    string    `json:"targetType,omitempty"` // type of the symlink target, empty if broken
+	Ignored       bool      `json:"ignored,omitempty"`
+}
+
+// ErrDiskConflict is returned when a file changed on disk after it was read
+// and writing it would clobber that change
+var ErrDiskConflict = errors.New("file changed on disk since it was read")
+
+// DiskStamp identifies the on-disk state of a file, so a save can tell
+// whether someone else changed it since it was read
+type DiskStamp struct {
+	ModTime time.Time `json:"mtime"`
+	Size    int64     `json:"size"`
+	Hash    string    `json:"hash"` // hex SHA-256 of the content
+	Missing bool      `json:"missing,omitempty"`
+}
+
+// Same reports whether two stamps describe the same content. Only the hash
+// counts, so touching a file without changing it is not a conflict.
+func (d DiskStamp) Same(other DiskStamp) bool {
+	return d.Missing == other.Missing && d.Hash == other.Hash
+}
+
+// ReadDiskStamp reads a file and returns its stamp along with its content.
+// A missing file yields a stamp with Missing set and no error.
+func ReadDiskStamp(path string) (DiskStamp, string, error) {
 	cleanPath := filepath.Clean(path)
 
-	// Check if file exists
-	if _, err := os.Stat(cleanPath); os.IsNotExist(err) {
-		return "", errors.New("file does not exist")
+	info, err := os.Stat(cleanPath)
+	if os.IsNotExist(err) {
+		return DiskStamp{Missing: true}, "", nil
+	}
+	if err != nil {
+		return DiskStamp{}, "", err
 	}
 
 	data, err := os.ReadFile(cleanPath)
 	if err != nil {
-		return "", err
+		return DiskStamp{}, "", err
+	}
+
+	return newDiskStamp(info, data), string(data), nil
+}
+
+// ReadDiskText is ReadDiskStamp for text files: the content is decoded to a
+// UTF-8 buffer with LF line endings, and the format it was stored in is
+// returned alongside
+func ReadDiskText(path string) (DiskStamp, string, TextFormat, error) {
+	stamp, raw, err := ReadDiskStamp(path)
+	if err != nil || stamp.Missing {
+		return stamp, "", DefaultTextFormat, err
+	}
+	content, format := DecodeText([]byte(raw))
+	return stamp, content, format, nil
+}
+
+// StampWritten returns the stamp of a file that was just written with content
+func StampWritten(path, content string) (DiskStamp, error) {
+	info, err := os.Stat(filepath.Clean(path))
+	if err != nil {
+		return DiskStamp{}, err
 	}
+	return newDiskStamp(info, []byte(content)), nil
+}
 
-	return string(data), nil
+func newDiskStamp(info os.FileInfo, data []byte) DiskStamp {
+	sum := sha256.Sum256(data)
+	return DiskStamp{
+		ModTime: info.ModTime(),
+		Size:    info.Size(),
+		Hash:    hex.EncodeToString(sum[:]),
+	}
 }
 
-// WriteFile writes content to a file
+// WriteFile writes content to a file atomically: the data goes to a temporary
+// file in the same directory, is synced, and then renamed over the target.
+// Mode, owner and extended attributes of an existing file are preserved, and a
+// symlink is written through rather than replaced.
+// The path should already be resolved through Workspace.Resolve.
 func WriteFile(path, content string) error {
 	// Clean the path
 	cleanPath := filepath.Clean(path)
 
+	target, err := resolveWriteTarget(cleanPath)
+	if err != nil {
+		return err
+	}
+
 	// Create directory if it doesn't exist
-	dir := filepath.Dir(cleanPath)
+	dir := filepath.Dir(target)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
 	}
 
-	return os.WriteFile(cleanPath, []byte(content), 0644)
+	meta, err := readFileMetadata(target)
+	if err != nil {
+		return err
+	}
+
+	// Renaming would split a hard link, so those are rewritten in place
+	if meta != nil && meta.nlink > 1 {
+		return writeInPlace(target, content)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(target)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err := tmp.WriteString(content); err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0644)
+	if meta != nil {
+		mode = meta.mode
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		return err
+	}
+	if meta != nil {
+		if err := meta.apply(tmp); err != nil {
+			return err
+		}
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, target); err != nil {
+		return err
+	}
+	committed = true
+
+	// Persist the rename itself
+	return syncDir(dir)
 }
 
-// ApplyDelta applies a text delta to content at a specific position
-func ApplyDelta(content string, fromPos, toPos int, insert string) (string, error) {
-	if fromPos < 0 || toPos > len(content) || fromPos > toPos {
-		return "", errors.New("invalid delta positions")
+// resolveWriteTarget follows symlinks so saving through a link updates the
+// file it points to. A dangling link resolves to the path it names.
+func resolveWriteTarget(path string) (string, error) {
+	for i := 0; i < 40; i++ {
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return path, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return path, nil
+		}
+
+		link, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(path), link)
+		}
+		path = filepath.Clean(link)
 	}
+	return "", errors.New("too many levels of symbolic links")
+}
 
-	// Apply the delta: remove [fromPos:toPos] and insert new text
-	newContent := content[:fromPos] + insert + content[toPos:]
-	return newContent, nil
+// writeInPlace truncates and rewrites a file, then syncs it
+func writeInPlace(path, content string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// CreateFile creates a file with content. It fails if the path exists
+// unless overwrite is set.
+func CreateFile(path, content string, overwrite bool) error {
+	cleanPath := filepath.Clean(path)
+
+	if err := os.MkdirAll(filepath.Dir(cleanPath), 0755); err != nil {
+		return err
+	}
+	if overwrite {
+		return WriteFile(cleanPath, content)
+	}
+
+	f, err := os.OpenFile(cleanPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// CreateDir creates a directory and any missing parents. It fails if the
+// directory itself already exists.
+func CreateDir(path string) error {
+	cleanPath := filepath.Clean(path)
+
+	if err := os.MkdirAll(filepath.Dir(cleanPath), 0755); err != nil {
+		return err
+	}
+	return os.Mkdir(cleanPath, 0755)
+}
+
+// RenamePath moves a file, symlink or directory. An existing target is only
+// replaced when overwrite is set.
+func RenamePath(from, to string, overwrite bool) error {
+	cleanFrom := filepath.Clean(from)
+	cleanTo := filepath.Clean(to)
+
+	if _, err := os.Lstat(cleanTo); err == nil && !overwrite {
+		return errors.New("target already exists")
+	}
+	if err := os.MkdirAll(filepath.Dir(cleanTo), 0755); err != nil {
+		return err
+	}
+	return os.Rename(cleanFrom, cleanTo)
+}
+
+// DeletePath removes a file or symlink, or a directory. Non-empty directories
+// are only removed when recursive is set.
+func DeletePath(path string, recursive bool) error {
+	cleanPath := filepath.Clean(path)
+
+	if _, err := os.Lstat(cleanPath); err != nil {
+		return err
+	}
+	if recursive {
+		return os.RemoveAll(cleanPath)
+	}
+	return os.Remove(cleanPath)
+}
+
+// StatPath describes a single path without following a final symlink
+func StatPath(path string) (*FileEntry, error) {
+	cleanPath := filepath.Clean(path)
+
+	info, err := os.Lstat(cleanPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newFileEntry(cleanPath, info), nil
+}
+
+// ListDir lists a directory, sorted with directories first and then by name.
+// Entries hidden by ignore are skipped unless includeIgnored is set, in which
+// case they are returned with Ignored marked.
+func ListDir(path string, ignore *IgnoreMatcher, includeIgnored bool) ([]FileEntry, error) {
+	cleanPath := filepath.Clean(path)
+
+	dirEntries, err := os.ReadDir(cleanPath)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]FileEntry, 0, len(dirEntries))
+	for _, de := range dirEntries {
+		info, err := de.Info()
+		if err != nil {
+			// Entry vanished between ReadDir and Info
+			continue
+		}
+
+		entry := newFileEntry(filepath.Join(cleanPath, de.Name()), info)
+		if ignore != nil && ignore.Ignored(entry.Path, entry.isDir()) {
+			if !includeIgnored {
+				continue
+			}
+			entry.Ignored = true
+		}
+		entries = append(entries, *entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].isDir() != entries[j].isDir() {
+			return entries[i].isDir()
+		}
+		return strings.ToLower(entries[i].Name) < strings.ToLower(entries[j].Name)
+	})
+
+	return entries, nil
+}
+
+func newFileEntry(path string, info os.FileInfo) *FileEntry {
+	entry := &FileEntry{
+		Name:    info.Name(),
+		Path:    path,
+		Type:    fileType(info.Mode()),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		entry.SymlinkTarget, _ = os.Readlink(path)
+		if targetInfo, err := os.Stat(path); err == nil {
+			entry.TargetType = fileType(targetInfo.Mode())
+		}
+	}
+
+	return entry
+}
+
+// isDir reports whether the entry is a directory or a symlink to one
+func (e *FileEntry) isDir() bool {
+	return e.Type == "dir" || e.TargetType == "dir"
+}
+
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "dir"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode.IsRegular():
+		return "file"
+	default:
+		return "other"
+	}
+}
+
+// resolveDelta converts delta positions counted in unit to byte offsets
+func resolveDelta(text *Rope, fromPos, toPos int, unit string) (int, int, error) {
+	if fromPos > toPos {
+		return 0, 0, errors.New("invalid delta positions")
+	}
+	from, err := text.ByteOffset(fromPos, unit)
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := text.ByteOffset(toPos, unit)
+	if err != nil {
+		return 0, 0, err
+	}
+	return from, to, nil
+}
+
+// resolveDeltaBatch converts a batch of changes, whose positions all refer to
+// text, to byte edits ordered for applyByteEdits. One bad change fails the
+// whole batch.
+func resolveDeltaBatch(text *Rope, changes []ContentChange, unit string) ([]byteEdit, error) {
+	resolved := make([]byteEdit, len(changes))
+	for i, change := range changes {
+		from, to, err := resolveDelta(text, change.FromPos, change.ToPos, unit)
+		if err != nil {
+			return nil, fmt.Errorf("change %d: %w", i, err)
+		}
+		resolved[i] = byteEdit{from: from, to: to, text: change.Insert}
+	}
+	return orderByteEdits(resolved)
 }
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"log"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// fileMetadata is what a save must carry over from the file it replaces
+type fileMetadata struct {
+	mode   os.FileMode
+	uid    int
+	gid    int
+	nlink  uint64
+	xattrs map[string][]byte
+}
+
+// readFileMetadata returns nil if the file does not exist yet
+func readFileMetadata(path string) (*fileMetadata, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &fileMetadata{
+		mode:   info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky),
+		uid:    -1,
+		gid:    -1,
+		nlink:  1,
+		xattrs: make(map[string][]byte),
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		meta.uid = int(st.Uid)
+		meta.gid = int(st.Gid)
+		meta.nlink = uint64(st.Nlink)
+	}
+
+	for _, name := range listXattrs(path) {
+		if value, ok := getXattr(path, name); ok {
+			meta.xattrs[name] = value
+		}
+	}
+
+	return meta, nil
+}
+
+// apply copies owner and extended attributes onto the replacement file.
+// Both are best effort: an unprivileged process cannot give a file away or
+// set every attribute namespace.
+func (m *fileMetadata) apply(f *os.File) error {
+	if m.uid >= 0 && (m.uid != os.Getuid() || m.gid != os.Getgid()) {
+		if err := f.Chown(m.uid, m.gid); err != nil {
+			log.Printf("Warning: cannot preserve owner of %s: %v", f.Name(), err)
+		}
+	}
+
+	for name, value := range m.xattrs {
+		if err := syscall.Setxattr(f.Name(), name, value, 0); err != nil {
+			log.Printf("Warning: cannot preserve xattr %s on %s: %v", name, f.Name(), err)
+		}
+	}
+	return nil
+}
+
+func listXattrs(path string) []string {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size <= 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func getXattr(path, name string) ([]byte, bool) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, false
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Getxattr(path, name, buf)
+	if err != nil {
+		return nil, false
+	}
+	return buf[:size], true
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+
+package server
+
+import "os"
+
+// fileMetadata is what a save must carry over from the file it replaces
+type fileMetadata struct {
+	mode  os.FileMode
+	nlink uint64
+}
+
+// readFileMetadata returns nil if the file does not exist yet. Only the mode
+// is preserved on this platform.
+func readFileMetadata(path string) (*fileMetadata, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileMetadata{
+		mode:  info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky),
+		nlink: 1,
+	}, nil
+}
+
+func (m *fileMetadata) apply(f *os.File) error {
+	return nil
+}
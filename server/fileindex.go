@@ -0,0 +1,510 @@
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultFindLimit and maxFindLimit bound the results of find_files
+	defaultFindLimit = 50
+	maxFindLimit     = 500
+)
+
+// Fuzzy match scoring, modelled on fzf: every matched character scores,
+// gaps cost, and characters at the start of a path segment or word earn a
+// bonus, doubled for the first character of the query
+const (
+	fuzzyScoreMatch        = 16
+	fuzzyScoreGapStart     = -3
+	fuzzyScoreGapExtension = -1
+	fuzzyBonusSegment      = 10 // after a slash, or at the start of the path
+	fuzzyBonusBoundary     = 8  // after _ - . or a space
+	fuzzyBonusCamel        = 7  // lower-to-upper or letter-to-digit transition
+	fuzzyBonusConsecutive  = -(fuzzyScoreGapStart + fuzzyScoreGapExtension)
+	fuzzyBonusFirstFactor  = 2
+)
+
+// FileIndex keeps the list of files in the workspace for quick open. It is
+// built in the background, kept current from watcher events, and rebuilt
+// periodically in case an event was missed.
+type FileIndex struct {
+	workspace *Workspace
+
+	mu         sync.RWMutex
+	paths      []string       // relative to the root, slash-separated
+	lower      []string       // paths lower-cased, for case-insensitive matching
+	slots      map[string]int // path -> index in paths
+	ready      bool
+	rebuilding bool        // whether a walk for rebuild is under way
+	missed     []FileEvent // events during that walk, replayed on its result
+
+	// updating serializes applying events, so an event replayed after a
+	// rebuild cannot overtake a newer one for the same path
+	updating sync.Mutex
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// FileMatch is one find_files result. Positions are the UTF-16 offsets in
+// RelPath of the characters that matched the query.
+type FileMatch struct {
+	Path      string `json:"path"`
+	RelPath   string `json:"relPath"`
+	Score     int    `json:"score"`
+	Positions []int  `json:"positions"`
+}
+
+// NewFileIndex starts indexing the workspace, rescanning it every
+// rescanInterval (0 disables rescans)
+func NewFileIndex(workspace *Workspace, rescanInterval time.Duration) *FileIndex {
+	ix := &FileIndex{
+		workspace: workspace,
+		slots:     make(map[string]int),
+		stop:      make(chan struct{}),
+	}
+	go ix.run(rescanInterval)
+	return ix
+}
+
+// Close stops the periodic rescans
+func (ix *FileIndex) Close() {
+	ix.closeOnce.Do(func() {
+		close(ix.stop)
+	})
+}
+
+func (ix *FileIndex) run(rescanInterval time.Duration) {
+	ix.rebuild()
+	if rescanInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(rescanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ix.rebuild()
+		case <-ix.stop:
+			return
+		}
+	}
+}
+
+// rebuild walks the whole workspace and replaces the index. Events that
+// arrive during the walk may or may not be reflected in it, so they are
+// applied again to the new index.
+func (ix *FileIndex) rebuild() {
+	started := time.Now()
+	ix.mu.Lock()
+	ix.rebuilding = true
+	ix.mu.Unlock()
+
+	paths := ix.walk(ix.workspace.Root())
+	ix.replace(paths, started)
+}
+
+// replace swaps in the result of a rebuild's walk, then replays the events
+// that arrived during it
+func (ix *FileIndex) replace(paths []string, started time.Time) {
+	ix.mu.Lock()
+	ix.paths = ix.paths[:0]
+	ix.lower = ix.lower[:0]
+	ix.slots = make(map[string]int, len(paths))
+	for _, rel := range paths {
+		ix.add(rel)
+	}
+	if !ix.ready {
+		log.Printf("Indexed %d files in %s", len(paths), time.Since(started).Round(time.Millisecond))
+	}
+	ix.ready = true
+	missed := ix.missed
+	ix.rebuilding, ix.missed = false, nil
+	ix.mu.Unlock()
+
+	ix.updating.Lock()
+	defer ix.updating.Unlock()
+	for _, ev := range missed {
+		ix.apply(ev.Path)
+	}
+}
+
+// walk lists the files below dir that are not ignored, relative to the root
+func (ix *FileIndex) walk(dir string) []string {
+	root := ix.workspace.Root()
+	ignore := ix.workspace.Ignore()
+
+	var paths []string
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return nil
+		}
+		if d.IsDir() {
+			if ignore.Ignored(path, true) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() && !ignore.Ignored(path, false) {
+			paths = append(paths, ix.relPath(path))
+		}
+		return nil
+	})
+	return paths
+}
+
+func (ix *FileIndex) relPath(path string) string {
+	return filepath.ToSlash(strings.TrimPrefix(path, ix.workspace.Root()+string(filepath.Separator)))
+}
+
+// Update applies a batch of watcher events
+func (ix *FileIndex) Update(events []FileEvent) {
+	ix.mu.Lock()
+	if ix.rebuilding {
+		ix.missed = append(ix.missed, events...)
+	}
+	ix.mu.Unlock()
+
+	ix.updating.Lock()
+	defer ix.updating.Unlock()
+	for _, ev := range events {
+		ix.apply(ev.Path)
+	}
+}
+
+// apply brings the index in line with what is on disk at path now, whatever
+// the event said happened there (must be called with updating held)
+func (ix *FileIndex) apply(path string) {
+	if !ix.workspace.Contains(path) || path == ix.workspace.Root() {
+		return
+	}
+	rel := ix.relPath(path)
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		ix.mu.Lock()
+		ix.removeTree(rel)
+		ix.mu.Unlock()
+		return
+	}
+	var added []string
+	switch {
+	case info.IsDir():
+		// A directory moved into the workspace brings its files along
+		if !ix.workspace.Ignore().Ignored(path, true) {
+			added = ix.walk(path)
+		}
+	case info.Mode().IsRegular():
+		if !ix.workspace.Ignore().Ignored(path, false) {
+			added = []string{rel}
+		}
+	}
+
+	ix.mu.Lock()
+	for _, p := range added {
+		ix.add(p)
+	}
+	ix.mu.Unlock()
+}
+
+// add inserts a path unless it is already indexed (must be called with lock held)
+func (ix *FileIndex) add(rel string) {
+	if _, exists := ix.slots[rel]; exists {
+		return
+	}
+	ix.slots[rel] = len(ix.paths)
+	ix.paths = append(ix.paths, rel)
+	ix.lower = append(ix.lower, asciiLower(rel))
+}
+
+// removeTree drops a file, or everything below a directory
+// (must be called with lock held)
+func (ix *FileIndex) removeTree(rel string) {
+	if _, exists := ix.slots[rel]; exists {
+		ix.remove(rel)
+		return
+	}
+	prefix := rel + "/"
+	for i := 0; i < len(ix.paths); {
+		if strings.HasPrefix(ix.paths[i], prefix) {
+			// remove moves the last path into slot i, so look at it again
+			ix.remove(ix.paths[i])
+			continue
+		}
+		i++
+	}
+}
+
+// remove deletes one indexed path (must be called with lock held)
+func (ix *FileIndex) remove(rel string) {
+	i := ix.slots[rel]
+	last := len(ix.paths) - 1
+	if i != last {
+		ix.paths[i] = ix.paths[last]
+		ix.lower[i] = ix.lower[last]
+		ix.slots[ix.paths[i]] = i
+	}
+	ix.paths = ix.paths[:last]
+	ix.lower = ix.lower[:last]
+	delete(ix.slots, rel)
+}
+
+// Find returns the files best matching a fuzzy query, the number of files
+// that matched at all, and whether the initial scan has finished.
+// Whitespace separates terms that must all match; a term containing an
+// upper-case letter is matched case-sensitively.
+func (ix *FileIndex) Find(query string, limit int) ([]FileMatch, int, bool) {
+	if limit <= 0 {
+		limit = defaultFindLimit
+	} else if limit > maxFindLimit {
+		limit = maxFindLimit
+	}
+	terms := strings.Fields(query)
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	type candidate struct {
+		slot  int
+		score int
+	}
+	var candidates []candidate
+	for i, path := range ix.paths {
+		total := 0
+		matched := true
+		for _, term := range terms {
+			score, ok := fuzzyMatchTerm(path, ix.lower[i], term, nil)
+			if !ok {
+				matched = false
+				break
+			}
+			total += score
+		}
+		if matched {
+			candidates = append(candidates, candidate{i, total})
+		}
+	}
+
+	// Best score first; among equals the shorter, then alphabetical path
+	sort.Slice(candidates, func(a, b int) bool {
+		ca, cb := candidates[a], candidates[b]
+		if ca.score != cb.score {
+			return ca.score > cb.score
+		}
+		pa, pb := ix.paths[ca.slot], ix.paths[cb.slot]
+		if len(pa) != len(pb) {
+			return len(pa) < len(pb)
+		}
+		return pa < pb
+	})
+	total := len(candidates)
+	if total > limit {
+		candidates = candidates[:limit]
+	}
+
+	root := ix.workspace.Root()
+	matches := make([]FileMatch, len(candidates))
+	for i, c := range candidates {
+		rel := ix.paths[c.slot]
+		var positions []int
+		for _, term := range terms {
+			fuzzyMatchTerm(rel, ix.lower[c.slot], term, &positions)
+		}
+		sort.Ints(positions)
+		// Terms may match the same characters
+		unique := make([]int, 0, len(positions))
+		for j, pos := range positions {
+			if j == 0 || pos != positions[j-1] {
+				unique = append(unique, OffsetInUnit(rel, pos, OffsetUnitUTF16))
+			}
+		}
+		matches[i] = FileMatch{
+			Path:      filepath.Join(root, filepath.FromSlash(rel)),
+			RelPath:   rel,
+			Score:     c.score,
+			Positions: unique,
+		}
+	}
+	return matches, total, ix.ready
+}
+
+// fuzzyMatchTerm scores one query term against a path, with smart case.
+// If positions is not nil, the byte offsets of the matched characters are
+// appended to it.
+func fuzzyMatchTerm(path, lower, term string, positions *[]int) (int, bool) {
+	text := lower
+	if term != asciiLower(term) {
+		text = path
+	}
+
+	// Try the whole path and the file name alone, since a match within the
+	// name usually beats one spread over the directories
+	best, bestStart, bestEnd, ok := fuzzyBestRegion(path, text, term, 0)
+	if !ok {
+		return 0, false
+	}
+	if base := strings.LastIndexByte(text, '/') + 1; base > bestStart {
+		if score, start, end, found := fuzzyBestRegion(path, text, term, base); found && score > best {
+			best, bestStart, bestEnd = score, start, end
+		}
+	}
+
+	if positions != nil {
+		fuzzyScore(path, text, term, bestStart, bestEnd, positions)
+	}
+	return best, true
+}
+
+// fuzzyBestRegion finds the first occurrence of term's characters in order
+// at or after from, narrowed to the shortest span ending there, as fzf's v1
+// algorithm does, and scores it
+func fuzzyBestRegion(path, text, term string, from int) (int, int, int, bool) {
+	ti, end := 0, -1
+	for i := from; i < len(text); i++ {
+		if text[i] == term[ti] {
+			ti++
+			if ti == len(term) {
+				end = i + 1
+				break
+			}
+		}
+	}
+	if end < 0 {
+		return 0, 0, 0, false
+	}
+
+	ti, start := len(term)-1, from
+	for i := end - 1; i >= from; i-- {
+		if text[i] == term[ti] {
+			ti--
+			if ti < 0 {
+				start = i
+				break
+			}
+		}
+	}
+	return fuzzyScore(path, text, term, start, end, nil), start, end, true
+}
+
+// fuzzyScore scores matching term greedily within text[start:end]
+func fuzzyScore(path, text, term string, start, end int, positions *[]int) int {
+	score, consecutive, firstBonus := 0, 0, 0
+	inGap := false
+	ti := 0
+
+	for i := start; i < end && ti < len(term); i++ {
+		if text[i] != term[ti] {
+			if inGap {
+				score += fuzzyScoreGapExtension
+			} else {
+				score += fuzzyScoreGapStart
+			}
+			inGap = true
+			consecutive = 0
+			firstBonus = 0
+			continue
+		}
+
+		score += fuzzyScoreMatch
+		bonus := fuzzyBonus(path, i)
+		if consecutive == 0 {
+			firstBonus = bonus
+		} else {
+			// A run keeps the bonus of its first character
+			if bonus >= fuzzyBonusBoundary && bonus > firstBonus {
+				firstBonus = bonus
+			}
+			bonus = maxInt(bonus, firstBonus, fuzzyBonusConsecutive)
+		}
+		if ti == 0 {
+			bonus *= fuzzyBonusFirstFactor
+		}
+		score += bonus
+
+		if positions != nil {
+			*positions = append(*positions, i)
+		}
+		inGap = false
+		consecutive++
+		ti++
+	}
+	return score
+}
+
+// fuzzyBonus rewards a match at the start of a segment or word
+func fuzzyBonus(path string, i int) int {
+	if i == 0 {
+		return fuzzyBonusSegment
+	}
+	prev, cur := path[i-1], path[i]
+	switch {
+	case prev == '/':
+		return fuzzyBonusSegment
+	case prev == '_' || prev == '-' || prev == '.' || prev == ' ':
+		return fuzzyBonusBoundary
+	case prev >= 'a' && prev <= 'z' && cur >= 'A' && cur <= 'Z':
+		return fuzzyBonusCamel
+	case !(prev >= '0' && prev <= '9') && cur >= '0' && cur <= '9':
+		return fuzzyBonusCamel
+	}
+	return 0
+}
+
+func maxInt(first int, rest ...int) int {
+	for _, v := range rest {
+		if v > first {
+			first = v
+		}
+	}
+	return first
+}
+
+// asciiLower lower-cases ASCII letters only, so byte offsets stay the same
+func asciiLower(s string) string {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= 'A' && c <= 'Z' {
+			b := []byte(s)
+			for j := i; j < len(b); j++ {
+				if b[j] >= 'A' && b[j] <= 'Z' {
+					b[j] += 'a' - 'A'
+				}
+			}
+			return string(b)
+		}
+	}
+	return s
+}
+
+type FindFilesPayload struct {
+	Query string `json:"query"`
+	Limit int    `json:"limit"`
+}
+
+func (s *session) handleFindFiles(raw json.RawMessage) {
+	var payload FindFilesPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid find_files payload")
+		return
+	}
+	if s.fileIndex == nil {
+		s.sendError("File index is disabled")
+		return
+	}
+
+	matches, total, ready := s.fileIndex.Find(payload.Query, payload.Limit)
+	s.send("find_files_result", map[string]interface{}{
+		"query":    payload.Query,
+		"results":  matches,
+		"total":    total,
+		"indexing": !ready,
+	})
+}
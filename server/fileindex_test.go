@@ -0,0 +1,128 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newTestFileIndex indexes a workspace holding the given files, without
+// rescans
+func newTestFileIndex(t *testing.T, files ...string) (*FileIndex, string) {
+	t.Helper()
+	root := t.TempDir()
+	for _, rel := range files {
+		writeTestFile(t, filepath.Join(root, filepath.FromSlash(rel)))
+	}
+	workspace, err := NewWorkspace(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix := &FileIndex{workspace: workspace, slots: make(map[string]int)}
+	ix.rebuild()
+	return ix, root
+}
+
+func writeTestFile(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func indexedPaths(ix *FileIndex) []string {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	paths := append([]string(nil), ix.paths...)
+	sort.Strings(paths)
+	return paths
+}
+
+func TestFileIndexUpdate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, root string) []FileEvent
+		want   []string
+	}{
+		{
+			name: "created file",
+			change: func(t *testing.T, root string) []FileEvent {
+				writeTestFile(t, filepath.Join(root, "c.txt"))
+				return []FileEvent{{Path: filepath.Join(root, "c.txt"), Type: FileCreated}}
+			},
+			want: []string{"a.txt", "c.txt", "dir/b.txt"},
+		},
+		{
+			name: "deleted directory",
+			change: func(t *testing.T, root string) []FileEvent {
+				os.RemoveAll(filepath.Join(root, "dir"))
+				return []FileEvent{{Path: filepath.Join(root, "dir"), Type: FileDeleted}}
+			},
+			want: []string{"a.txt"},
+		},
+		{
+			name: "directory moved in",
+			change: func(t *testing.T, root string) []FileEvent {
+				writeTestFile(t, filepath.Join(root, "moved", "x", "y.txt"))
+				return []FileEvent{{Path: filepath.Join(root, "moved"), Type: FileCreated}}
+			},
+			want: []string{"a.txt", "dir/b.txt", "moved/x/y.txt"},
+		},
+		{
+			name: "deleted then recreated before the batch",
+			change: func(t *testing.T, root string) []FileEvent {
+				return []FileEvent{{Path: filepath.Join(root, "a.txt"), Type: FileDeleted}}
+			},
+			want: []string{"a.txt", "dir/b.txt"},
+		},
+		{
+			name: "created then deleted before the batch",
+			change: func(t *testing.T, root string) []FileEvent {
+				return []FileEvent{{Path: filepath.Join(root, "gone.txt"), Type: FileCreated}}
+			},
+			want: []string{"a.txt", "dir/b.txt"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ix, root := newTestFileIndex(t, "a.txt", "dir/b.txt")
+			ix.Update(tt.change(t, root))
+			if got := indexedPaths(ix); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestFileIndexReplaysEventsDuringRebuild hands a rebuild a walk that ran
+// before a file was deleted and another was created
+func TestFileIndexReplaysEventsDuringRebuild(t *testing.T) {
+	ix, root := newTestFileIndex(t, "a.txt", "b.txt")
+	ix.mu.Lock()
+	ix.rebuilding = true
+	ix.mu.Unlock()
+	stale := ix.walk(root)
+
+	os.Remove(filepath.Join(root, "a.txt"))
+	writeTestFile(t, filepath.Join(root, "c.txt"))
+	ix.Update([]FileEvent{
+		{Path: filepath.Join(root, "a.txt"), Type: FileDeleted},
+		{Path: filepath.Join(root, "c.txt"), Type: FileCreated},
+	})
+	ix.replace(stale, time.Now())
+
+	want := []string{"b.txt", "c.txt"}
+	if got := indexedPaths(ix); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+	if ix.rebuilding || ix.missed != nil {
+		t.Error("the rebuild left its state behind")
+	}
+}
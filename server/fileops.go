@@ -0,0 +1,209 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+)
+
+type CreateFilePayload struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+type CreateDirPayload struct {
+	Path string `json:"path"`
+}
+
+type RenamePathPayload struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+type DeletePathPayload struct {
+	Path      string `json:"path"`
+	Recursive bool   `json:"recursive"`
+}
+
+var errWorkspaceRoot = errors.New("cannot modify the workspace root")
+
+// errTargetOpen refuses a rename onto a path with open documents, whose
+// buffers would lose their file
+var errTargetOpen = errors.New("the target is open in the editor")
+
+// runFileOperation wraps a filesystem change with the LSP protocol: servers
+// are asked for edits first (will*), those edits are applied, the change is
+// made, and servers are told it happened (did*). It returns how many files
+// the servers' edits touched.
+func (s *session) runFileOperation(kind FileOperationKind, ops []FileOperation, do func() error) (int, error) {
+	touched := 0
+	for _, edit := range s.lspManager.WillFileOperation(kind, ops) {
+		n, err := ApplyWorkspaceEdit(edit, s.store, s.workspace)
+		touched += n
+		if err != nil {
+			// The servers' edits are advisory; the operation itself still runs
+			log.Printf("Warning: Failed to apply edits for %s: %v", kind, err)
+		}
+	}
+
+	if err := do(); err != nil {
+		return touched, err
+	}
+
+	s.lspManager.DidFileOperation(kind, ops)
+	return touched, nil
+}
+
+func (s *session) handleCreateFile(raw json.RawMessage) {
+	var payload CreateFilePayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid create_file payload")
+		return
+	}
+
+	path, err := s.workspace.Resolve(payload.Path)
+	if err != nil {
+		s.sendError("Failed to create file: " + err.Error())
+		return
+	}
+
+	ops := []FileOperation{{Path: path}}
+	touched, err := s.runFileOperation(FileOpCreate, ops, func() error {
+		return CreateFile(path, payload.Content, false)
+	})
+	if err != nil {
+		s.sendError("Failed to create file: " + err.Error())
+		return
+	}
+
+	s.send("file_created", map[string]interface{}{
+		"path":        path,
+		"editedFiles": touched,
+	})
+}
+
+func (s *session) handleCreateDir(raw json.RawMessage) {
+	var payload CreateDirPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid create_dir payload")
+		return
+	}
+
+	path, err := s.workspace.Resolve(payload.Path)
+	if err != nil {
+		s.sendError("Failed to create directory: " + err.Error())
+		return
+	}
+
+	ops := []FileOperation{{Path: path, IsDir: true}}
+	touched, err := s.runFileOperation(FileOpCreate, ops, func() error {
+		return CreateDir(path)
+	})
+	if err != nil {
+		s.sendError("Failed to create directory: " + err.Error())
+		return
+	}
+
+	s.send("dir_created", map[string]interface{}{
+		"path":        path,
+		"editedFiles": touched,
+	})
+}
+
+func (s *session) handleRenamePath(raw json.RawMessage) {
+	var payload RenamePathPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid rename_path payload")
+		return
+	}
+
+	// Renaming a symlink moves the link, not its target
+	from, err := s.workspace.ResolveLink(payload.From)
+	if err != nil {
+		s.sendError("Failed to rename: " + err.Error())
+		return
+	}
+	to, err := s.workspace.ResolveLink(payload.To)
+	if err != nil {
+		s.sendError("Failed to rename: " + err.Error())
+		return
+	}
+	if from == s.workspace.Root() || to == s.workspace.Root() {
+		s.sendError("Failed to rename: " + errWorkspaceRoot.Error())
+		return
+	}
+	if s.store.HasOpen(to) {
+		s.sendError("Failed to rename: " + errTargetOpen.Error())
+		return
+	}
+
+	info, err := os.Lstat(from)
+	if err != nil {
+		s.sendError("Failed to rename: " + err.Error())
+		return
+	}
+
+	ops := []FileOperation{{Path: from, NewPath: to, IsDir: info.IsDir()}}
+	touched, err := s.runFileOperation(FileOpRename, ops, func() error {
+		if err := RenamePath(from, to, payload.Overwrite); err != nil {
+			return err
+		}
+		s.store.Rename(from, to)
+		return nil
+	})
+	if err != nil {
+		s.sendError("Failed to rename: " + err.Error())
+		return
+	}
+
+	s.send("path_renamed", map[string]interface{}{
+		"from":        from,
+		"to":          to,
+		"editedFiles": touched,
+	})
+}
+
+func (s *session) handleDeletePath(raw json.RawMessage) {
+	var payload DeletePathPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid delete_path payload")
+		return
+	}
+
+	// Deleting a symlink removes the link, not its target
+	path, err := s.workspace.ResolveLink(payload.Path)
+	if err != nil {
+		s.sendError("Failed to delete: " + err.Error())
+		return
+	}
+	if path == s.workspace.Root() {
+		s.sendError("Failed to delete: " + errWorkspaceRoot.Error())
+		return
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		s.sendError("Failed to delete: " + err.Error())
+		return
+	}
+
+	ops := []FileOperation{{Path: path, IsDir: info.IsDir()}}
+	touched, err := s.runFileOperation(FileOpDelete, ops, func() error {
+		if err := DeletePath(path, payload.Recursive); err != nil {
+			return err
+		}
+		s.store.MarkDeleted(path)
+		return nil
+	})
+	if err != nil {
+		s.sendError("Failed to delete: " + err.Error())
+		return
+	}
+
+	s.send("path_deleted", map[string]interface{}{
+		"path":        path,
+		"editedFiles": touched,
+	})
+}
@@ -0,0 +1,50 @@
+package server
+
+import "time"
+
+// formatOnSaveTimeout bounds how long a formatting request may delay a save;
+// a slower server is skipped and the file saved unformatted
+const formatOnSaveTimeout = 2 * time.Second
+
+// FormattingOptions are the LSP options sent with textDocument/formatting
+type FormattingOptions struct {
+	TabSize      int  `json:"tabSize"`
+	InsertSpaces bool `json:"insertSpaces"`
+}
+
+// DefaultFormattingOptions are used for languages configured without any
+var DefaultFormattingOptions = FormattingOptions{TabSize: 4, InsertSpaces: true}
+
+// formatBuffer asks the LSP to format an open document and applies the
+// edits to the buffer, which broadcasts them to every subscriber as a
+// document change. It returns the document after formatting; the edits are
+// dropped if the buffer changed while the server was working.
+func (s *session) formatBuffer(snapshot DocumentSnapshot, opts FormattingOptions) (DocumentSnapshot, error) {
+	response, err := s.lspManager.RouteRequestTimeout("textDocument/formatting", map[string]interface{}{
+		"textDocument": map[string]interface{}{
+			"uri": snapshot.URI,
+		},
+		"options": opts,
+	}, formatOnSaveTimeout)
+	if err != nil {
+		return snapshot, err
+	}
+
+	var edits []TextEdit
+	if err := lspResponse(response, &edits); err != nil {
+		return snapshot, err
+	}
+	if len(edits) == 0 {
+		return snapshot, nil
+	}
+
+	formatted, err := s.store.ApplyBufferEdits([]BufferEdits{{
+		URI:      snapshot.URI,
+		Checksum: ContentChecksum(snapshot.Content),
+		Edits:    edits,
+	}})
+	if err != nil {
+		return snapshot, err
+	}
+	return formatted[0], nil
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"simpletor/server/git"
+)
+
+// gitTimeout bounds every git command run for a request
+const gitTimeout = 30 * time.Second
+
+type GitPathPayload struct {
+	Path string `json:"path"`
+}
+
+type GitPathsPayload struct {
+	Paths []string `json:"paths"`
+}
+
+type GitCommitPayload struct {
+	Message string `json:"message"`
+	Amend   bool   `json:"amend"`
+}
+
+// Kinds of gutter hunk
+const (
+	gitHunkAdded    = "added"
+	gitHunkModified = "modified"
+	gitHunkDeleted  = "deleted"
+)
+
+// GitHunk marks changed lines of the current text against HEAD for the
+// gutter. Lines are zero-based and inclusive; a deleted hunk has no lines
+// of its own and sits at the line the removed ones preceded.
+type GitHunk struct {
+	Kind      string `json:"kind"`
+	StartLine int    `json:"startLine"`
+	EndLine   int    `json:"endLine"`
+}
+
+// openRepo finds the repository holding the workspace. It is looked up per
+// request, since the workspace may become a repository while the editor runs.
+func (s *session) openRepo(ctx context.Context) (*git.Repo, bool) {
+	repo, err := git.Open(ctx, s.workspace.Root())
+	if err != nil {
+		if errors.Is(err, git.ErrNotRepository) {
+			s.sendError("Git: the workspace is not in a git repository")
+		} else {
+			s.sendError("Git: " + err.Error())
+		}
+		return nil, false
+	}
+	return repo, true
+}
+
+// sendGitStatus sends the status of the files inside the workspace
+func (s *session) sendGitStatus(ctx context.Context, repo *git.Repo) {
+	status, err := repo.Status(ctx)
+	if err != nil {
+		s.sendError("Git: " + err.Error())
+		return
+	}
+
+	files := make([]git.FileStatus, 0, len(status.Files))
+	for _, f := range status.Files {
+		if s.workspace.Contains(f.Path) {
+			files = append(files, f)
+		}
+	}
+	s.send("git_status_result", map[string]interface{}{
+		"root":   repo.Root(),
+		"branch": status.Branch,
+		"head":   status.Head,
+		"files":  files,
+	})
+}
+
+func (s *session) handleGitStatus(raw json.RawMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+
+	repo, ok := s.openRepo(ctx)
+	if !ok {
+		return
+	}
+	s.sendGitStatus(ctx, repo)
+}
+
+// handleGitDiff compares a file as it is now, the open buffer or else the
+// file on disk, with its content at HEAD
+func (s *session) handleGitDiff(raw json.RawMessage) {
+	var payload GitPathPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid git_diff payload")
+		return
+	}
+	path, err := s.workspace.Resolve(payload.Path)
+	if err != nil {
+		s.sendError("Invalid path: " + err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	repo, ok := s.openRepo(ctx)
+	if !ok {
+		return
+	}
+
+	data, tracked, err := repo.Show(ctx, "HEAD", path)
+	if err != nil {
+		s.sendError("Git: " + err.Error())
+		return
+	}
+	head := ""
+	if tracked {
+		head, _ = DecodeText(data)
+	}
+
+	uri := pathToURI(path)
+	current := ""
+	if snapshot, open := s.store.Snapshot(uri); open {
+		current = snapshot.Content
+	} else if _, diskContent, _, err := ReadDiskText(path); err == nil {
+		current = diskContent
+	}
+
+	hunks := []GitHunk{}
+	for _, h := range DiffLines(head, current, 0) {
+		switch {
+		case h.NewLines == 0:
+			// NewStart is the line before the deletion; as a zero-based
+			// index that is the line following it
+			hunks = append(hunks, GitHunk{Kind: gitHunkDeleted, StartLine: h.NewStart, EndLine: h.NewStart})
+		case h.OldLines == 0:
+			hunks = append(hunks, GitHunk{Kind: gitHunkAdded, StartLine: h.NewStart - 1, EndLine: h.NewStart + h.NewLines - 2})
+		default:
+			hunks = append(hunks, GitHunk{Kind: gitHunkModified, StartLine: h.NewStart - 1, EndLine: h.NewStart + h.NewLines - 2})
+		}
+	}
+
+	s.send("git_diff_result", map[string]interface{}{
+		"path":    path,
+		"uri":     uri,
+		"tracked": tracked,
+		"hunks":   hunks,
+	})
+}
+
+// handleGitBlame blames the open buffer if there is one, so lines edited
+// since the last save show as uncommitted and line numbers match the editor
+func (s *session) handleGitBlame(raw json.RawMessage) {
+	var payload GitPathPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid git_blame payload")
+		return
+	}
+	path, err := s.workspace.Resolve(payload.Path)
+	if err != nil {
+		s.sendError("Invalid path: " + err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	repo, ok := s.openRepo(ctx)
+	if !ok {
+		return
+	}
+
+	var contents []byte
+	uri := pathToURI(path)
+	if snapshot, open := s.store.Snapshot(uri); open {
+		if contents, err = EncodeText(snapshot.Content, snapshot.Format); err != nil {
+			s.sendError("Git: " + err.Error())
+			return
+		}
+	}
+
+	blame, err := repo.Blame(ctx, path, contents)
+	if err != nil {
+		s.sendError("Git: " + err.Error())
+		return
+	}
+	s.send("git_blame_result", map[string]interface{}{
+		"path":    path,
+		"uri":     uri,
+		"lines":   blame.Lines,
+		"commits": blame.Commits,
+	})
+}
+
+// handleGitStage stages files as they are on disk. Unsaved edits are not
+// included, so the paths of dirty buffers are reported back.
+func (s *session) handleGitStage(raw json.RawMessage) {
+	s.gitUpdateIndex(raw, "git_stage", func(ctx context.Context, repo *git.Repo, paths []string) error {
+		return repo.Stage(ctx, paths)
+	})
+}
+
+func (s *session) handleGitUnstage(raw json.RawMessage) {
+	s.gitUpdateIndex(raw, "git_unstage", func(ctx context.Context, repo *git.Repo, paths []string) error {
+		return repo.Unstage(ctx, paths)
+	})
+}
+
+// gitUpdateIndex runs a stage or unstage, then sends the new status
+func (s *session) gitUpdateIndex(raw json.RawMessage, msgType string, update func(context.Context, *git.Repo, []string) error) {
+	var payload GitPathsPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid " + msgType + " payload")
+		return
+	}
+
+	paths := make([]string, 0, len(payload.Paths))
+	unsaved := []string{}
+	for _, requested := range payload.Paths {
+		path, err := s.workspace.Resolve(requested)
+		if err != nil {
+			s.sendError("Invalid path: " + err.Error())
+			return
+		}
+		paths = append(paths, path)
+		if snapshot, open := s.store.Snapshot(pathToURI(path)); open && snapshot.Dirty {
+			unsaved = append(unsaved, path)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	repo, ok := s.openRepo(ctx)
+	if !ok {
+		return
+	}
+	if err := update(ctx, repo, paths); err != nil {
+		s.sendError("Git: " + err.Error())
+		return
+	}
+
+	s.send(msgType+"_result", map[string]interface{}{
+		"paths":   paths,
+		"unsaved": unsaved,
+	})
+	s.sendGitStatus(ctx, repo)
+}
+
+func (s *session) handleGitCommit(raw json.RawMessage) {
+	var payload GitCommitPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid git_commit payload")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	repo, ok := s.openRepo(ctx)
+	if !ok {
+		return
+	}
+
+	hash, err := repo.Commit(ctx, payload.Message, payload.Amend)
+	if err != nil {
+		s.send("git_commit_result", map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+	s.send("git_commit_result", map[string]interface{}{
+		"hash": hash,
+	})
+	s.sendGitStatus(ctx, repo)
+}
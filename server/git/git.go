@@ -0,0 +1,401 @@
+// Package git runs the local git binary for the editor's version control
+// features: status, file contents at HEAD, blame, staging and commits.
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotRepository is returned by Open for a directory outside any work tree
+var ErrNotRepository = errors.New("not a git repository")
+
+// Error reports a git command that failed
+type Error struct {
+	Args   []string
+	Stderr string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	msg := strings.TrimSpace(e.Stderr)
+	if msg == "" {
+		msg = e.Err.Error()
+	}
+	return fmt.Sprintf("git %s: %s", e.Args[0], msg)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Repo is a git work tree
+type Repo struct {
+	root string
+}
+
+// Open finds the work tree containing dir
+func Open(ctx context.Context, dir string) (*Repo, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, err
+	}
+	out, err := (&Repo{root: dir}).run(ctx, nil, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, ErrNotRepository
+	}
+	root := strings.TrimSpace(string(out))
+	// Compare real paths with the caller's, which have symlinks resolved
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	return &Repo{root: root}, nil
+}
+
+// Root returns the absolute top-level directory of the work tree
+func (r *Repo) Root() string {
+	return r.root
+}
+
+// run executes git in the work tree, feeding it stdin if not nil
+func (r *Repo) run(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = r.root
+	// Never wait on a credential prompt or an editor, and keep output
+	// parseable. Paths are passed as they are, so a file named "*.go" or
+	// ":(glob)x" never matches other files.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_EDITOR=true", "LC_ALL=C", "GIT_LITERAL_PATHSPECS=1")
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, &Error{Args: args, Stderr: stderr.String(), Err: err}
+	}
+	return out, nil
+}
+
+// rel converts an absolute path to one relative to the work tree
+func (r *Repo) rel(path string) (string, error) {
+	rel, err := filepath.Rel(r.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the repository %s", path, r.root)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// Status summaries of a file, derived from its index and work tree states
+const (
+	StatusModified   = "modified"
+	StatusAdded      = "added"
+	StatusDeleted    = "deleted"
+	StatusRenamed    = "renamed"
+	StatusCopied     = "copied"
+	StatusUntracked  = "untracked"
+	StatusConflicted = "conflicted"
+)
+
+// FileStatus is the state of one changed file. Index and WorkTree are the
+// porcelain status letters ('.' for unchanged).
+type FileStatus struct {
+	Path     string `json:"path"`
+	OrigPath string `json:"origPath,omitempty"` // source of a rename or copy
+	Index    string `json:"index"`
+	WorkTree string `json:"workTree"`
+	Status   string `json:"status"`
+	Staged   bool   `json:"staged"` // whether the index differs from HEAD
+}
+
+// Status lists the branch and every file that differs from HEAD or is
+// untracked. Paths are absolute.
+type Status struct {
+	Branch string       `json:"branch"` // empty when HEAD is detached
+	Head   string       `json:"head"`   // commit hash; empty before the first commit
+	Files  []FileStatus `json:"files"`
+}
+
+// Status runs git status
+func (r *Repo) Status(ctx context.Context) (*Status, error) {
+	out, err := r.run(ctx, nil, "status", "--porcelain=v2", "-z", "--branch", "--untracked-files=all")
+	if err != nil {
+		return nil, err
+	}
+	return parseStatus(r.root, out)
+}
+
+// parseStatus reads git status --porcelain=v2 -z --branch output, making
+// paths absolute under root
+func parseStatus(root string, out []byte) (*Status, error) {
+	status := &Status{}
+	abs := func(rel string) string {
+		return filepath.Join(root, filepath.FromSlash(rel))
+	}
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i < len(fields); i++ {
+		line := fields[i]
+		if line == "" {
+			continue
+		}
+
+		switch line[0] {
+		case '#':
+			if head, ok := strings.CutPrefix(line, "# branch.head "); ok && head != "(detached)" {
+				status.Branch = head
+			} else if oid, ok := strings.CutPrefix(line, "# branch.oid "); ok && oid != "(initial)" {
+				status.Head = oid
+			}
+
+		case '1', '2', 'u':
+			// Ordinary, renamed/copied and unmerged entries differ only in
+			// how many fields precede the path
+			n := map[byte]int{'1': 8, '2': 9, 'u': 10}[line[0]]
+			parts := strings.SplitN(line, " ", n+1)
+			if len(parts) != n+1 || len(parts[1]) != 2 {
+				return nil, fmt.Errorf("malformed status entry: %q", line)
+			}
+			fs := FileStatus{
+				Path:     abs(parts[n]),
+				Index:    parts[1][:1],
+				WorkTree: parts[1][1:],
+			}
+			if line[0] == '2' {
+				// -z puts the original path in the next field
+				if i+1 >= len(fields) || fields[i+1] == "" {
+					return nil, fmt.Errorf("status entry without its original path: %q", line)
+				}
+				i++
+				fs.OrigPath = abs(fields[i])
+			}
+			fs.Staged = fs.Index != "."
+			fs.Status = summarize(line[0], fs.Index, fs.WorkTree)
+			status.Files = append(status.Files, fs)
+
+		case '?':
+			if len(line) < 3 {
+				return nil, fmt.Errorf("malformed status entry: %q", line)
+			}
+			status.Files = append(status.Files, FileStatus{
+				Path:     abs(line[2:]),
+				Index:    "?",
+				WorkTree: "?",
+				Status:   StatusUntracked,
+			})
+		}
+	}
+	return status, nil
+}
+
+func summarize(kind byte, index, workTree string) string {
+	if kind == 'u' {
+		return StatusConflicted
+	}
+	for _, c := range []string{index, workTree} {
+		switch c {
+		case "R":
+			return StatusRenamed
+		case "C":
+			return StatusCopied
+		case "A":
+			return StatusAdded
+		case "D":
+			return StatusDeleted
+		}
+	}
+	return StatusModified
+}
+
+// Show returns the content of a file at a revision, such as "HEAD". It
+// reports false if the file does not exist there.
+func (r *Repo) Show(ctx context.Context, rev, path string) ([]byte, bool, error) {
+	rel, err := r.rel(path)
+	if err != nil {
+		return nil, false, err
+	}
+	spec := rev + ":" + rel
+	// Tell a missing file (or an unborn HEAD) apart from a failing git
+	if _, err := r.run(ctx, nil, "cat-file", "-e", spec); err != nil {
+		return nil, false, nil
+	}
+	out, err := r.run(ctx, nil, "show", spec)
+	if err != nil {
+		return nil, false, err
+	}
+	return out, true, nil
+}
+
+// BlameCommit describes a commit that lines are attributed to
+type BlameCommit struct {
+	Author      string    `json:"author"`
+	AuthorMail  string    `json:"authorMail"`
+	AuthorTime  time.Time `json:"authorTime"`
+	Summary     string    `json:"summary"`
+	Uncommitted bool      `json:"uncommitted"`
+}
+
+// Blame attributes every line of a file to a commit
+type Blame struct {
+	Lines   []string                `json:"lines"` // commit hash per line
+	Commits map[string]*BlameCommit `json:"commits"`
+}
+
+// Blame runs git blame on a file. If contents is not nil it is blamed
+// instead of the file on disk, so unsaved edits show as uncommitted.
+func (r *Repo) Blame(ctx context.Context, path string, contents []byte) (*Blame, error) {
+	rel, err := r.rel(path)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"blame", "--porcelain"}
+	if contents != nil {
+		args = append(args, "--contents", "-")
+	}
+	out, err := r.run(ctx, contents, append(args, "--", rel)...)
+	if err != nil {
+		return nil, err
+	}
+	return parseBlame(out)
+}
+
+// parseBlame reads git blame --porcelain output: a header per line naming
+// its commit and line number, commit details the first time a commit
+// appears, then the line itself after a tab
+func parseBlame(out []byte) (*Blame, error) {
+	blame := &Blame{Commits: make(map[string]*BlameCommit)}
+	var current *BlameCommit
+	var hash string
+	line := 0
+
+	for _, text := range strings.Split(string(out), "\n") {
+		if text == "" {
+			continue
+		}
+		if text[0] == '\t' {
+			if current == nil {
+				return nil, fmt.Errorf("blame line before any header: %q", text)
+			}
+			for len(blame.Lines) < line {
+				blame.Lines = append(blame.Lines, "")
+			}
+			blame.Lines[line-1] = hash
+			continue
+		}
+
+		key, value, _ := strings.Cut(text, " ")
+		// Hashes are 40 hex digits, or 64 in SHA-256 repositories
+		if (len(key) == 40 || len(key) == 64) && isHex(key) {
+			fields := strings.Fields(value)
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("malformed blame header: %q", text)
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("malformed blame header: %q", text)
+			}
+			hash, line = key, n
+			current = blame.Commits[hash]
+			if current == nil {
+				current = &BlameCommit{Uncommitted: strings.Trim(hash, "0") == ""}
+				blame.Commits[hash] = current
+			}
+			continue
+		}
+
+		if current == nil {
+			return nil, fmt.Errorf("blame commit details before any header: %q", text)
+		}
+		switch key {
+		case "author":
+			current.Author = value
+		case "author-mail":
+			current.AuthorMail = strings.Trim(value, "<>")
+		case "author-time":
+			if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+				current.AuthorTime = time.Unix(secs, 0)
+			}
+		case "summary":
+			current.Summary = value
+		}
+	}
+	return blame, nil
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Stage adds the current content of files to the index
+func (r *Repo) Stage(ctx context.Context, paths []string) error {
+	rels, err := r.rels(paths)
+	if err != nil {
+		return err
+	}
+	// -A also stages deletions
+	_, err = r.run(ctx, nil, append([]string{"add", "-A", "--"}, rels...)...)
+	return err
+}
+
+// Unstage resets files in the index to HEAD, keeping the work tree
+func (r *Repo) Unstage(ctx context.Context, paths []string) error {
+	rels, err := r.rels(paths)
+	if err != nil {
+		return err
+	}
+	if _, err := r.run(ctx, nil, "rev-parse", "--verify", "-q", "HEAD"); err != nil {
+		// Before the first commit there is nothing to reset to
+		_, err = r.run(ctx, nil, append([]string{"rm", "--cached", "-r", "-q", "--"}, rels...)...)
+		return err
+	}
+	_, err = r.run(ctx, nil, append([]string{"restore", "--staged", "--"}, rels...)...)
+	return err
+}
+
+// Commit records the index as a new commit and returns its hash. With amend
+// the previous commit is replaced instead.
+func (r *Repo) Commit(ctx context.Context, message string, amend bool) (string, error) {
+	if strings.TrimSpace(message) == "" {
+		return "", errors.New("empty commit message")
+	}
+	args := []string{"commit", "-q", "-F", "-"}
+	if amend {
+		args = append(args, "--amend")
+	}
+	if _, err := r.run(ctx, []byte(message), args...); err != nil {
+		return "", err
+	}
+	out, err := r.run(ctx, nil, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (r *Repo) rels(paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no paths given")
+	}
+	rels := make([]string, len(paths))
+	for i, path := range paths {
+		rel, err := r.rel(path)
+		if err != nil {
+			return nil, err
+		}
+		rels[i] = rel
+	}
+	return rels, nil
+}
@@ -0,0 +1,220 @@
+package git
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	sha1Hash   = "453f5f71fe76370cb4d7797415082c313b42fe05"
+	sha256Hash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	zeroHash   = "0000000000000000000000000000000000000000"
+)
+
+// porcelain joins status entries the way -z separates them
+func porcelain(fields ...string) []byte {
+	return []byte(strings.Join(fields, "\x00") + "\x00")
+}
+
+func TestParseStatus(t *testing.T) {
+	root := filepath.FromSlash("/repo")
+	abs := func(rel string) string { return filepath.Join(root, filepath.FromSlash(rel)) }
+	const modes = "100644 100644 100644 "
+
+	tests := []struct {
+		name    string
+		out     []byte
+		want    *Status
+		wantErr bool
+	}{
+		{
+			name: "branch and changes",
+			out: porcelain(
+				"# branch.oid "+sha1Hash,
+				"# branch.head main",
+				"1 .M N... "+modes+sha1Hash+" "+sha1Hash+" a.txt",
+				"1 A. N... 000000 100644 100644 "+zeroHash+" "+sha1Hash+" dir/new file.txt",
+				"1 .D N... 100644 100644 000000 "+sha1Hash+" "+sha1Hash+" gone.txt",
+				"? untracked.txt",
+			),
+			want: &Status{Branch: "main", Head: sha1Hash, Files: []FileStatus{
+				{Path: abs("a.txt"), Index: ".", WorkTree: "M", Status: StatusModified},
+				{Path: abs("dir/new file.txt"), Index: "A", WorkTree: ".", Status: StatusAdded, Staged: true},
+				{Path: abs("gone.txt"), Index: ".", WorkTree: "D", Status: StatusDeleted},
+				{Path: abs("untracked.txt"), Index: "?", WorkTree: "?", Status: StatusUntracked},
+			}},
+		},
+		{
+			name: "rename",
+			out: porcelain(
+				"# branch.oid "+sha1Hash,
+				"# branch.head main",
+				"2 R. N... "+modes+sha1Hash+" "+sha1Hash+" R100 new name.txt",
+				"old name.txt",
+				"? after.txt",
+			),
+			want: &Status{Branch: "main", Head: sha1Hash, Files: []FileStatus{
+				{Path: abs("new name.txt"), OrigPath: abs("old name.txt"), Index: "R", WorkTree: ".", Status: StatusRenamed, Staged: true},
+				{Path: abs("after.txt"), Index: "?", WorkTree: "?", Status: StatusUntracked},
+			}},
+		},
+		{
+			name: "sha-256 repository",
+			out: porcelain(
+				"# branch.oid "+sha256Hash,
+				"# branch.head main",
+				"1 M. N... "+modes+sha256Hash+" "+sha256Hash+" a.txt",
+			),
+			want: &Status{Branch: "main", Head: sha256Hash, Files: []FileStatus{
+				{Path: abs("a.txt"), Index: "M", WorkTree: ".", Status: StatusModified, Staged: true},
+			}},
+		},
+		{
+			name: "conflict",
+			out: porcelain(
+				"# branch.oid "+sha1Hash,
+				"# branch.head main",
+				"u UU N... 100644 100644 100644 100644 "+sha1Hash+" "+sha1Hash+" "+sha1Hash+" both.txt",
+			),
+			want: &Status{Branch: "main", Head: sha1Hash, Files: []FileStatus{
+				{Path: abs("both.txt"), Index: "U", WorkTree: "U", Status: StatusConflicted, Staged: true},
+			}},
+		},
+		{
+			name: "detached before the first commit",
+			out:  porcelain("# branch.oid (initial)", "# branch.head (detached)"),
+			want: &Status{},
+		},
+		{
+			name:    "rename without its original path",
+			out:     []byte("2 R. N... " + modes + sha1Hash + " " + sha1Hash + " R100 new.txt"),
+			wantErr: true,
+		},
+		{
+			name:    "truncated entry",
+			out:     porcelain("1 .M N... 100644"),
+			wantErr: true,
+		},
+		{
+			name:    "bad states",
+			out:     porcelain("1 M N... " + modes + sha1Hash + " " + sha1Hash + " a.txt"),
+			wantErr: true,
+		},
+		{
+			name:    "untracked without a path",
+			out:     porcelain("?"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStatus(root, tt.out)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v; want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBlame(t *testing.T) {
+	committed := strings.Join([]string{
+		sha1Hash + " 1 1 2",
+		"author A U Thor",
+		"author-mail <author@example.com>",
+		"author-time 1700000000",
+		"author-tz +0000",
+		"summary Initial commit",
+		"filename a.txt",
+		"\tone",
+		sha1Hash + " 2 2",
+		"\ttwo",
+	}, "\n") + "\n"
+	uncommitted := strings.Join([]string{
+		zeroHash + " 3 3 1",
+		"author Not Committed Yet",
+		"author-mail <not.committed.yet>",
+		"author-time 1700000100",
+		"summary Version of a.txt from standard input",
+		"filename a.txt",
+		"\tthree",
+	}, "\n") + "\n"
+
+	tests := []struct {
+		name    string
+		out     string
+		want    *Blame
+		wantErr bool
+	}{
+		{
+			name: "committed and uncommitted lines",
+			out:  committed + uncommitted,
+			want: &Blame{
+				Lines: []string{sha1Hash, sha1Hash, zeroHash},
+				Commits: map[string]*BlameCommit{
+					sha1Hash: {
+						Author:     "A U Thor",
+						AuthorMail: "author@example.com",
+						AuthorTime: time.Unix(1700000000, 0),
+						Summary:    "Initial commit",
+					},
+					zeroHash: {
+						Author:      "Not Committed Yet",
+						AuthorMail:  "not.committed.yet",
+						AuthorTime:  time.Unix(1700000100, 0),
+						Summary:     "Version of a.txt from standard input",
+						Uncommitted: true,
+					},
+				},
+			},
+		},
+		{
+			name: "sha-256 repository",
+			out:  sha256Hash + " 1 1 1\nauthor A U Thor\nsummary Initial commit\n\tone\n",
+			want: &Blame{
+				Lines:   []string{sha256Hash},
+				Commits: map[string]*BlameCommit{sha256Hash: {Author: "A U Thor", Summary: "Initial commit"}},
+			},
+		},
+		{
+			name: "empty file",
+			out:  "",
+			want: &Blame{Commits: map[string]*BlameCommit{}},
+		},
+		{name: "line before any header", out: "\tone\n", wantErr: true},
+		{name: "details before any header", out: "author A U Thor\n", wantErr: true},
+		{name: "header without a line number", out: sha1Hash + " 1\n\tone\n", wantErr: true},
+		{name: "line number zero", out: sha1Hash + " 1 0 1\n\tone\n", wantErr: true},
+		{name: "line number not a number", out: sha1Hash + " 1 x 1\n\tone\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseBlame([]byte(tt.out))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v; want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
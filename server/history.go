@@ -0,0 +1,359 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ErrNothingToUndo is returned by Undo when the history is empty
+var ErrNothingToUndo = errors.New("nothing to undo")
+
+// ErrNothingToRedo is returned by Redo when nothing was undone
+var ErrNothingToRedo = errors.New("nothing to redo")
+
+const (
+	// historyGroupDelay is how close together single-range edits from one
+	// connection must be to undo as one step, as in CodeMirror
+	historyGroupDelay = 500 * time.Millisecond
+	// maxHistoryGroups bounds each document's undo stack
+	maxHistoryGroups = 200
+	// maxClosedHistoryBytes bounds the text held by the histories of
+	// documents nobody has open; the least recently closed go first
+	maxClosedHistoryBytes = 32 << 20
+)
+
+// historyStep is one applied transaction: byte edits against the text before
+// it, and the edits that revert it against the text after it, both ordered
+// for applyByteEdits
+type historyStep struct {
+	edits   []byteEdit
+	inverse []byteEdit
+}
+
+// historyGroup is what one undo reverts. Ropes are immutable, so the text on
+// either side is kept at no cost.
+type historyGroup struct {
+	before, after *Rope
+	steps         []historyStep
+	origin        DocumentSubscriber
+	groupable     bool
+	at            time.Time
+}
+
+// History is the linear undo/redo stack of one document, shared by every
+// connection. It outlives the document's buffer so a reconnecting client
+// finds it again.
+type History struct {
+	undo []*historyGroup
+	redo []*historyGroup
+	tip  *Rope // text after the last recorded change
+}
+
+// record adds a transaction that turned before into after. Single-range
+// edits from the same connection in quick succession join the previous
+// group, so undo reverts a run of typing rather than one keystroke.
+func (h *History) record(before, after *Rope, edits []byteEdit, origin DocumentSubscriber, groupable bool) {
+	now := time.Now()
+	step := historyStep{edits: edits, inverse: inverseEdits(before, edits)}
+	h.redo = nil
+	h.tip = after
+
+	if n := len(h.undo); n > 0 && groupable {
+		last := h.undo[n-1]
+		if last.groupable && last.origin == origin && last.after == before && now.Sub(last.at) < historyGroupDelay {
+			last.steps = append(last.steps, step)
+			last.after = after
+			last.at = now
+			return
+		}
+	}
+
+	h.undo = append(h.undo, &historyGroup{
+		before:    before,
+		after:     after,
+		steps:     []historyStep{step},
+		origin:    origin,
+		groupable: groupable,
+		at:        now,
+	})
+	if len(h.undo) > maxHistoryGroups {
+		h.undo = h.undo[len(h.undo)-maxHistoryGroups:]
+	}
+}
+
+// popUndo removes the latest group and returns the edits that turn current
+// back into its before text
+func (h *History) popUndo(current *Rope) (*historyGroup, []byteEdit, error) {
+	if len(h.undo) == 0 {
+		return nil, nil, ErrNothingToUndo
+	}
+	group := h.undo[len(h.undo)-1]
+	if group.after != current {
+		// Every change is recorded, so this only happens if the buffer was
+		// replaced behind the history's back; its entries no longer apply
+		h.reset(current)
+		return nil, nil, ErrNothingToUndo
+	}
+	h.undo = h.undo[:len(h.undo)-1]
+	h.redo = append(h.redo, group)
+	h.tip = group.before
+
+	if len(group.steps) == 1 {
+		return group, group.steps[0].inverse, nil
+	}
+	return group, diffRopes(group.after, group.before), nil
+}
+
+// popRedo reapplies the most recently undone group
+func (h *History) popRedo(current *Rope) (*historyGroup, []byteEdit, error) {
+	if len(h.redo) == 0 {
+		return nil, nil, ErrNothingToRedo
+	}
+	group := h.redo[len(h.redo)-1]
+	if group.before != current {
+		h.reset(current)
+		return nil, nil, ErrNothingToRedo
+	}
+	h.redo = h.redo[:len(h.redo)-1]
+	// A redone group never absorbs later typing
+	group.groupable = false
+	h.undo = append(h.undo, group)
+	h.tip = group.after
+
+	if len(group.steps) == 1 {
+		return group, group.steps[0].edits, nil
+	}
+	return group, diffRopes(group.before, group.after), nil
+}
+
+// reset drops all entries, keeping text as the starting point
+func (h *History) reset(text *Rope) {
+	h.undo = nil
+	h.redo = nil
+	h.tip = text
+}
+
+func (h *History) canUndo() bool { return len(h.undo) > 0 }
+func (h *History) canRedo() bool { return len(h.redo) > 0 }
+
+// size estimates the bytes of text a history keeps alive: its tip and the
+// text of every edit. Ropes on either side of a group mostly share nodes
+// with the tip, so they are not counted again.
+func (h *History) size() int {
+	n := 0
+	if h.tip != nil {
+		n = h.tip.Len()
+	}
+	for _, groups := range [][]*historyGroup{h.undo, h.redo} {
+		for _, group := range groups {
+			for _, step := range group.steps {
+				for _, edit := range step.edits {
+					n += len(edit.text)
+				}
+				for _, edit := range step.inverse {
+					n += len(edit.text)
+				}
+			}
+		}
+	}
+	return n
+}
+
+// inverseEdits returns the edits that revert edits (ordered for
+// applyByteEdits against base) on the text they produce
+func inverseEdits(base *Rope, edits []byteEdit) []byteEdit {
+	inverse := make([]byteEdit, len(edits))
+	shift := 0
+	// Walk from the start of the document, where earlier edits shift the
+	// positions of later ones in the result
+	for i := len(edits) - 1; i >= 0; i-- {
+		edit := edits[i]
+		from := edit.from + shift
+		inverse[i] = byteEdit{
+			from: from,
+			to:   from + len(edit.text),
+			text: base.Slice(edit.from, edit.to),
+		}
+		shift += len(edit.text) - (edit.to - edit.from)
+	}
+	return inverse
+}
+
+// diffRopes returns a single edit turning a into b, covering everything
+// between their common prefix and suffix
+func diffRopes(a, b *Rope) []byteEdit {
+	sa, sb := a.String(), b.String()
+	if sa == sb {
+		return nil
+	}
+
+	prefix := 0
+	for prefix < len(sa) && prefix < len(sb) && sa[prefix] == sb[prefix] {
+		prefix++
+	}
+	for prefix > 0 && prefix < len(sa) && !utf8.RuneStart(sa[prefix]) {
+		prefix--
+	}
+
+	suffix := 0
+	for suffix < len(sa)-prefix && suffix < len(sb)-prefix && sa[len(sa)-1-suffix] == sb[len(sb)-1-suffix] {
+		suffix++
+	}
+	for suffix > 0 && !utf8.RuneStart(sa[len(sa)-suffix]) {
+		suffix--
+	}
+
+	return []byteEdit{{from: prefix, to: len(sa) - suffix, text: sb[prefix : len(sb)-suffix]}}
+}
+
+// history returns the history of a document, creating it if needed
+// (must be called with lock held)
+func (st *DocumentStore) history(uri string) *History {
+	h, exists := st.histories[uri]
+	if !exists {
+		h = &History{}
+		st.histories[uri] = h
+	}
+	return h
+}
+
+// retireHistory keeps the history of a document that was just closed for a
+// reconnecting client, evicting the least recently closed histories once
+// they hold more than maxClosedHistoryBytes (must be called with lock held)
+func (st *DocumentStore) retireHistory(uri string) {
+	st.reviveHistory(uri)
+	st.closed = append(st.closed, uri)
+
+	total := 0
+	for _, closed := range st.closed {
+		total += st.history(closed).size()
+	}
+	for total > maxClosedHistoryBytes && len(st.closed) > 0 {
+		total -= st.history(st.closed[0]).size()
+		delete(st.histories, st.closed[0])
+		st.closed = st.closed[1:]
+	}
+}
+
+// reviveHistory takes a document's history off the closed list when it is
+// opened again (must be called with lock held)
+func (st *DocumentStore) reviveHistory(uri string) {
+	for i, closed := range st.closed {
+		if closed == uri {
+			st.closed = append(st.closed[:i], st.closed[i+1:]...)
+			return
+		}
+	}
+}
+
+// forgetHistories drops the histories of closed documents at or below a
+// deleted path (must be called with lock held)
+func (st *DocumentStore) forgetHistories(path string) {
+	prefix := path + string(filepath.Separator)
+	kept := st.closed[:0]
+	for _, uri := range st.closed {
+		if p := uriToPath(uri); p == path || strings.HasPrefix(p, prefix) {
+			delete(st.histories, uri)
+			continue
+		}
+		kept = append(kept, uri)
+	}
+	st.closed = kept
+}
+
+// Undo reverts the latest change to a document. The edits are broadcast to
+// every subscriber except origin and returned for origin to apply.
+func (st *DocumentStore) Undo(uri string, origin DocumentSubscriber) (DocumentChange, error) {
+	return st.stepHistory(uri, origin, (*History).popUndo)
+}
+
+// Redo reapplies the latest change reverted by Undo
+func (st *DocumentStore) Redo(uri string, origin DocumentSubscriber) (DocumentChange, error) {
+	return st.stepHistory(uri, origin, (*History).popRedo)
+}
+
+func (st *DocumentStore) stepHistory(uri string, origin DocumentSubscriber, pop func(*History, *Rope) (*historyGroup, []byteEdit, error)) (DocumentChange, error) {
+	st.mu.Lock()
+	defer st.unlock()
+
+	entry, exists := st.entries[uri]
+	if !exists {
+		return DocumentChange{}, ErrDocumentNotOpen
+	}
+	doc := entry.doc
+
+	group, edits, err := pop(st.history(uri), doc.Text)
+	if err != nil {
+		return DocumentChange{}, err
+	}
+
+	base := doc.Text
+	// Land exactly on the recorded text, so the next undo finds it
+	if base == group.after {
+		doc.Text = group.before
+	} else {
+		doc.Text = group.after
+	}
+	doc.Version++
+	// Undoing back to the saved text makes the buffer clean again
+	doc.Dirty = !doc.isSaved()
+
+	st.notifyChange(doc, base, edits)
+	change := newDocumentChange(doc, base, edits)
+	st.broadcast(entry, change, origin)
+	return change, nil
+}
+
+// HistoryState reports whether a document has anything to undo or redo
+func (st *DocumentStore) HistoryState(uri string) (canUndo, canRedo bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	h, exists := st.histories[uri]
+	if !exists {
+		return false, false
+	}
+	return h.canUndo(), h.canRedo()
+}
+
+type HistoryPayload struct {
+	URI string `json:"uri"`
+}
+
+func (s *session) handleUndo(raw json.RawMessage) {
+	s.handleHistoryStep(raw, "undo", s.store.Undo)
+}
+
+func (s *session) handleRedo(raw json.RawMessage) {
+	s.handleHistoryStep(raw, "redo", s.store.Redo)
+}
+
+func (s *session) handleHistoryStep(raw json.RawMessage, action string, step func(string, DocumentSubscriber) (DocumentChange, error)) {
+	var payload HistoryPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid " + action + " payload")
+		return
+	}
+
+	change, err := step(payload.URI, s)
+	canUndo, canRedo := s.store.HistoryState(payload.URI)
+	if err != nil && err != ErrNothingToUndo && err != ErrNothingToRedo {
+		s.sendError("Failed to " + action + ": " + err.Error())
+		return
+	}
+
+	result := map[string]interface{}{
+		"uri":     payload.URI,
+		"applied": err == nil,
+		"canUndo": canUndo,
+		"canRedo": canRedo,
+	}
+	if err == nil {
+		result["change"] = change
+	}
+	s.send(action+"_result", result)
+}
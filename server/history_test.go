@@ -0,0 +1,190 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// historyEdit applies edits to text and records them, as the store does
+func historyEdit(t *testing.T, h *History, text *Rope, origin DocumentSubscriber, groupable bool, edits ...byteEdit) *Rope {
+	t.Helper()
+	ordered, err := orderByteEdits(edits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := applyByteEdits(text, ordered)
+	h.record(text, after, ordered, origin, groupable)
+	return after
+}
+
+func TestInverseEdits(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		edits []byteEdit
+	}{
+		{"insert", "hello", []byteEdit{{5, 5, " world"}}},
+		{"delete", "hello world", []byteEdit{{5, 11, ""}}},
+		{"replace with longer text", "a-b", []byteEdit{{1, 2, " plus "}}},
+		{"several ranges", "one two three", []byteEdit{{0, 3, "1"}, {4, 7, "2222"}, {8, 13, ""}}},
+		{"inserts at one position", "x", []byteEdit{{0, 0, "a"}, {0, 0, "b"}}},
+		{"multibyte", "é😀ü", []byteEdit{{0, 2, "e"}, {6, 8, "üü"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := NewRope(tt.text)
+			edits, err := orderByteEdits(tt.edits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			after := applyByteEdits(before, edits)
+			if got := applyByteEdits(after, inverseEdits(before, edits)).String(); got != tt.text {
+				t.Errorf("inverse gave %q; want %q", got, tt.text)
+			}
+		})
+	}
+}
+
+func TestDiffRopes(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []byteEdit
+	}{
+		{"equal", "same", "same", nil},
+		{"middle", "abcdef", "abXYef", []byteEdit{{2, 4, "XY"}}},
+		{"append", "abc", "abcd", []byteEdit{{3, 3, "d"}}},
+		{"emptied", "abc", "", []byteEdit{{0, 3, ""}}},
+		// é and è share their first byte; the edit must not split it
+		{"shared lead byte", "aé", "aè", []byteEdit{{1, 3, "è"}}},
+		{"shared trail byte", "😀x", "😁x", []byteEdit{{0, 4, "😁"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffRopes(NewRope(tt.a), NewRope(tt.b))
+			if len(got) != len(tt.want) || (len(got) == 1 && got[0] != tt.want[0]) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+			if result := applyByteEdits(NewRope(tt.a), got).String(); result != tt.b {
+				t.Errorf("edits give %q; want %q", result, tt.b)
+			}
+		})
+	}
+}
+
+func TestHistoryGrouping(t *testing.T) {
+	alice, bob := &recordingSubscriber{}, &recordingSubscriber{}
+	type step struct {
+		origin    DocumentSubscriber
+		groupable bool
+		pause     bool // wait out the grouping delay first
+	}
+	tests := []struct {
+		name   string
+		steps  []step
+		groups int
+	}{
+		{"typing run", []step{{alice, true, false}, {alice, true, false}, {alice, true, false}}, 1},
+		{"pause in typing", []step{{alice, true, false}, {alice, true, true}}, 2},
+		{"another connection", []step{{alice, true, false}, {bob, true, false}}, 2},
+		{"multi-range transaction", []step{{alice, true, false}, {alice, false, false}, {alice, true, false}}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &History{}
+			text := NewRope("")
+			for i, s := range tt.steps {
+				if s.pause {
+					h.undo[len(h.undo)-1].at = time.Now().Add(-historyGroupDelay)
+				}
+				text = historyEdit(t, h, text, s.origin, s.groupable, byteEdit{i, i, "x"})
+			}
+			if len(h.undo) != tt.groups {
+				t.Errorf("got %d groups; want %d", len(h.undo), tt.groups)
+			}
+		})
+	}
+}
+
+func TestHistoryUndoRedo(t *testing.T) {
+	origin := &recordingSubscriber{}
+	h := &History{}
+	v0 := NewRope("one two")
+	v1 := historyEdit(t, h, v0, origin, true, byteEdit{7, 7, " three"})
+	v2 := historyEdit(t, h, v1, origin, false, byteEdit{0, 3, "1"}, byteEdit{4, 7, "2"})
+	// Typing after a multi-range edit starts its own group, and joins
+	// the next keystroke
+	v3 := historyEdit(t, h, v2, origin, true, byteEdit{v2.Len(), v2.Len(), "!"})
+	v4 := historyEdit(t, h, v3, origin, true, byteEdit{v3.Len(), v3.Len(), "!"})
+
+	undo := func(current *Rope, want *Rope) *Rope {
+		t.Helper()
+		_, edits, err := h.popUndo(current)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := applyByteEdits(current, edits)
+		if got.String() != want.String() {
+			t.Fatalf("undo gave %q; want %q", got.String(), want.String())
+		}
+		return want
+	}
+	redo := func(current *Rope, want *Rope) *Rope {
+		t.Helper()
+		_, edits, err := h.popRedo(current)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := applyByteEdits(current, edits)
+		if got.String() != want.String() {
+			t.Fatalf("redo gave %q; want %q", got.String(), want.String())
+		}
+		return want
+	}
+
+	current := undo(v4, v2) // both exclamation marks at once
+	current = undo(current, v1)
+	current = redo(current, v2)
+	current = redo(current, v4)
+	if _, _, err := h.popRedo(current); !errors.Is(err, ErrNothingToRedo) {
+		t.Errorf("redo past the end: got %v", err)
+	}
+
+	current = undo(current, v2)
+	current = undo(current, v1)
+	current = undo(current, v0)
+	if _, _, err := h.popUndo(current); !errors.Is(err, ErrNothingToUndo) {
+		t.Errorf("undo past the start: got %v", err)
+	}
+
+	// A new edit drops what was undone
+	current = redo(current, v1)
+	historyEdit(t, h, current, origin, true, byteEdit{0, 0, ">"})
+	if h.canRedo() {
+		t.Error("redo survived a new edit")
+	}
+
+	// A buffer replaced behind the history's back clears it
+	if _, _, err := h.popUndo(NewRope("elsewhere")); !errors.Is(err, ErrNothingToUndo) || h.canUndo() {
+		t.Errorf("undo on other text: got %v, canUndo %v", err, h.canUndo())
+	}
+}
+
+func TestHistoryBounded(t *testing.T) {
+	h := &History{}
+	text := NewRope("")
+	for i := 0; i < maxHistoryGroups+10; i++ {
+		text = historyEdit(t, h, text, nil, false, byteEdit{i, i, "x"})
+	}
+	if len(h.undo) != maxHistoryGroups {
+		t.Errorf("got %d groups; want %d", len(h.undo), maxHistoryGroups)
+	}
+	// The tip, and one inserted byte per group; the inverses delete
+	if got, want := h.size(), text.Len()+maxHistoryGroups; got != want {
+		t.Errorf("size = %d; want %d", got, want)
+	}
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ignoreRule is a single pattern from a .gitignore file or the exclude list
+type ignoreRule struct {
+	re       *regexp.Regexp
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// IgnoreMatcher decides which workspace paths are hidden from listings,
+// combining .gitignore files with a configurable exclude list. Parsed
+// .gitignore files are cached per directory until Invalidate is called.
+type IgnoreMatcher struct {
+	root     string
+	excludes []ignoreRule
+	mu       sync.Mutex
+	files    map[string][]ignoreRule // directory -> rules, nil without a .gitignore
+}
+
+// NewIgnoreMatcher creates a matcher for the given root. Exclude patterns use
+// .gitignore syntax and apply at every level of the tree.
+func NewIgnoreMatcher(root string, excludes []string) *IgnoreMatcher {
+	m := &IgnoreMatcher{
+		root:  root,
+		files: make(map[string][]ignoreRule),
+	}
+	for _, pattern := range excludes {
+		if rule, ok := parseIgnoreRule(pattern); ok {
+			m.excludes = append(m.excludes, rule)
+		}
+	}
+	return m
+}
+
+// Ignored reports whether an absolute path inside the root should be hidden.
+// Everything below an ignored directory is ignored as well.
+func (m *IgnoreMatcher) Ignored(path string, isDir bool) bool {
+	rel, err := filepath.Rel(m.root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+
+	for i := 1; i < len(parts); i++ {
+		if m.ignoredEntry(parts[:i], true) {
+			return true
+		}
+	}
+	return m.ignoredEntry(parts, isDir)
+}
+
+// ignoredEntry checks a single path (given as components relative to the root)
+// without looking at its ancestors
+func (m *IgnoreMatcher) ignoredEntry(parts []string, isDir bool) bool {
+	ignored := false
+	if matchRules(m.excludes, strings.Join(parts, "/"), isDir, &ignored) {
+		return ignored
+	}
+
+	// Apply .gitignore files from the root down to the parent directory;
+	// deeper files override shallower ones
+	dir := m.root
+	for i := 0; i < len(parts); i++ {
+		matchRules(m.rulesFor(dir), strings.Join(parts[i:], "/"), isDir, &ignored)
+		dir = filepath.Join(dir, parts[i])
+	}
+	return ignored
+}
+
+// matchRules applies rules in order; the last matching rule wins.
+// It returns true if any rule matched.
+func matchRules(rules []ignoreRule, rel string, isDir bool, ignored *bool) bool {
+	matched := false
+	base := rel
+	if i := strings.LastIndex(rel, "/"); i >= 0 {
+		base = rel[i+1:]
+	}
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		target := base
+		if rule.anchored {
+			target = rel
+		}
+		if rule.re.MatchString(target) {
+			*ignored = !rule.negate
+			matched = true
+		}
+	}
+	return matched
+}
+
+// rulesFor returns the parsed .gitignore rules of a directory, reading the
+// file the first time the directory is asked about
+func (m *IgnoreMatcher) rulesFor(dir string) []ignoreRule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if rules, ok := m.files[dir]; ok {
+		return rules
+	}
+
+	var rules []ignoreRule
+	if f, err := os.Open(filepath.Join(dir, ".gitignore")); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if rule, ok := parseIgnoreRule(scanner.Text()); ok {
+				rules = append(rules, rule)
+			}
+		}
+		f.Close()
+	}
+	m.files[dir] = rules
+	return rules
+}
+
+// Invalidate drops the cached rules a file event may have made stale: those
+// of the directory of a changed .gitignore, and those of a created or
+// deleted path and every directory below it, which may have moved
+func (m *IgnoreMatcher) Invalidate(ev FileEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if filepath.Base(ev.Path) == ".gitignore" {
+		delete(m.files, filepath.Dir(ev.Path))
+		return
+	}
+	if ev.Type == FileChanged {
+		return
+	}
+	prefix := ev.Path + string(filepath.Separator)
+	for dir := range m.files {
+		if dir == ev.Path || strings.HasPrefix(dir, prefix) {
+			delete(m.files, dir)
+		}
+	}
+}
+
+// parseIgnoreRule parses one line of .gitignore syntax
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// A slash anywhere but the end anchors the pattern to the .gitignore directory
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+
+	re, err := regexp.Compile(globToRegexp(line))
+	if err != nil {
+		return ignoreRule{}, false
+	}
+	rule.re = re
+	return rule, true
+}
+
+// globToRegexp translates a gitignore glob (with ** support) to an anchored regexp
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					// "**/" matches zero or more directories
+					i++
+					sb.WriteString("(?:.*/)?")
+				} else {
+					sb.WriteString(".*")
+				}
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	root := t.TempDir()
+	gitignores := map[string]string{
+		".gitignore":            "*.log\n!keep.log\n/build\ncache/\ndocs/*.tmp\n**/gen/**\n# comment\n\\#literal\n",
+		"sub/.gitignore":        "!*.log\nlocal.txt\n/only-here\n",
+		"sub/deeper/.gitignore": "*.log\n",
+	}
+	for rel, content := range gitignores {
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := NewIgnoreMatcher(root, []string{"node_modules/", "*.swp"})
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		// Plain patterns match at any depth
+		{"app.log", false, true},
+		{"a/b/app.log", false, true},
+		{"app.txt", false, false},
+
+		// Negation re-includes a file the rule before ignored
+		{"keep.log", false, false},
+		{"a/keep.log", false, false},
+
+		// A leading slash anchors to the .gitignore's directory
+		{"build", true, true},
+		{"build/out.bin", false, true},
+		{"a/build", true, false},
+
+		// A trailing slash matches directories only
+		{"cache", true, true},
+		{"cache", false, false},
+		{"a/cache/x.txt", false, true},
+
+		// A slash in the middle anchors too
+		{"docs/a.tmp", false, true},
+		{"a/docs/a.tmp", false, false},
+		{"docs/sub/a.tmp", false, false},
+
+		// ** spans directories
+		{"gen/x.go", false, true},
+		{"a/b/gen/x.go", false, true},
+		{"generated/x.go", false, false},
+
+		// Comments and escapes
+		{"# comment", false, false},
+		{"#literal", false, true},
+
+		// Nested .gitignore files override their parents, for their subtree only
+		{"sub/app.log", false, false},
+		{"sub/local.txt", false, true},
+		{"local.txt", false, false},
+		{"sub/deeper/local.txt", false, true},
+		{"sub/only-here", false, true},
+		{"sub/deeper/only-here", false, false},
+		{"sub/deeper/app.log", false, true},
+
+		// The exclude list applies everywhere and wins over .gitignore
+		{"node_modules", true, true},
+		{"a/node_modules/pkg/index.js", false, true},
+		{"sub/x.swp", false, true},
+
+		// Names starting with two dots are still inside the root
+		{"..hidden.log", false, true},
+		{"..cache", true, false},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(root, filepath.FromSlash(tt.path))
+		if got := m.Ignored(path, tt.isDir); got != tt.want {
+			t.Errorf("Ignored(%q, dir %v) = %v; want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+
+	for _, outside := range []string{root, filepath.Dir(root), filepath.Join(filepath.Dir(root), "x.log")} {
+		if m.Ignored(outside, false) {
+			t.Errorf("Ignored(%q) = true for a path outside the root", outside)
+		}
+	}
+}
+
+func TestIgnoreMatcherInvalidate(t *testing.T) {
+	root := t.TempDir()
+	gitignore := filepath.Join(root, "sub", ".gitignore")
+	if err := os.MkdirAll(filepath.Dir(gitignore), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	m := NewIgnoreMatcher(root, nil)
+	file := filepath.Join(root, "sub", "a.txt")
+	if m.Ignored(file, false) {
+		t.Fatal("ignored before any .gitignore exists")
+	}
+
+	if err := os.WriteFile(gitignore, []byte("a.txt\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if m.Ignored(file, false) {
+		t.Fatal("the cached rules were reread without an event")
+	}
+	m.Invalidate(FileEvent{Path: gitignore, Type: FileCreated})
+	if !m.Ignored(file, false) {
+		t.Error("not ignored after the .gitignore was created")
+	}
+
+	if err := os.Rename(filepath.Join(root, "sub"), filepath.Join(root, "moved")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	m.Invalidate(FileEvent{Path: filepath.Join(root, "sub"), Type: FileCreated})
+	if m.Ignored(file, false) {
+		t.Error("still ignored after the directory was replaced")
+	}
+}
@@ -0,0 +1,337 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrBinaryFile is returned when opening a file that does not look like text
+var ErrBinaryFile = errors.New("file appears to be binary")
+
+// FileTooLargeError is returned when opening a file above the size limit
+type FileTooLargeError struct {
+	Size  int64
+	Limit int64
+}
+
+func (e *FileTooLargeError) Error() string {
+	return fmt.Sprintf("file is %d bytes, above the %d byte limit for editing", e.Size, e.Limit)
+}
+
+// Read-only views for files that cannot be edited
+const (
+	previewModeHex   = "hex"
+	previewModePaged = "paged"
+)
+
+const (
+	// sniffLength is how much of a file is inspected to tell text from binary
+	sniffLength = 8192
+	// maxRangeLength caps a single read_range response
+	maxRangeLength = 1 << 20
+	// hexRowWidth is the number of bytes per hex dump line
+	hexRowWidth = 16
+)
+
+type ReadRangePayload struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	Length int    `json:"length"`
+	Mode   string `json:"mode"` // "hex" or "paged"
+}
+
+// CheckEditable reports why a file cannot be opened as an editable buffer:
+// ErrBinaryFile, or a *FileTooLargeError when limit is positive and exceeded
+func CheckEditable(path string, limit int64) error {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return errors.New("path is a directory")
+	}
+
+	sample := make([]byte, sniffLength)
+	n, err := io.ReadFull(f, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if looksBinary(sample[:n]) {
+		return ErrBinaryFile
+	}
+
+	if limit > 0 && info.Size() > limit {
+		return &FileTooLargeError{Size: info.Size(), Limit: limit}
+	}
+	return nil
+}
+
+// looksBinary guesses from the start of a file whether it is binary. NUL
+// bytes give it away unless the text is UTF-16; otherwise a file made
+// mostly of control characters is treated as binary.
+func looksBinary(sample []byte) bool {
+	if len(sample) == 0 {
+		return false
+	}
+
+	// A cut-off UTF-16 sample would fail the even-length check
+	even := sample[:len(sample)&^1]
+	if bytes.IndexByte(sample, 0) >= 0 {
+		encoding := detectEncoding(even)
+		return encoding != EncodingUTF16LE && encoding != EncodingUTF16BE
+	}
+
+	control := 0
+	for _, b := range sample {
+		if b < 0x20 && b != '\n' && b != '\r' && b != '\t' && b != '\f' && b != '\b' && b != 0x1B {
+			control++
+		}
+	}
+	return control*10 > len(sample)
+}
+
+// ReadRange reads up to length bytes of a file starting at offset, and
+// returns them with the file's total size
+func ReadRange(path string, offset int64, length int) ([]byte, int64, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset < 0 || offset > info.Size() {
+		return nil, info.Size(), errors.New("offset is outside the file")
+	}
+
+	data := make([]byte, length)
+	n, err := f.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		return nil, info.Size(), err
+	}
+	return data[:n], info.Size(), nil
+}
+
+// trimPartialRune drops a UTF-8 sequence cut off at the end of data, so a
+// page ends on a character boundary
+func trimPartialRune(data []byte) []byte {
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		b := data[len(data)-i]
+		if b < 0x80 {
+			return data
+		}
+		if utf8.RuneStart(b) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				return data[:len(data)-i]
+			}
+			return data
+		}
+	}
+	return data
+}
+
+// pagedFormat detects the encoding of a file shown in pages from its start,
+// as DecodeText would from the whole file
+func pagedFormat(path string) (TextFormat, error) {
+	sample, size, err := ReadRange(path, 0, sniffLength)
+	if err != nil {
+		return TextFormat{}, err
+	}
+	encoding := detectEncoding(sample)
+	if int64(len(sample)) < size {
+		// The sample may end inside a character
+		encoding = detectEncoding(sample[:len(sample)&^1])
+		if encoding == EncodingLatin1 && utf8.Valid(trimPartialRune(sample)) {
+			encoding = EncodingUTF8
+		}
+	}
+	return TextFormat{
+		Encoding:   encoding,
+		BOM:        hasBOM(sample, encoding),
+		LineEnding: LineEndingLF,
+	}, nil
+}
+
+// decodePage decodes a page of a file read at offset, cut to whole
+// characters: bytes at its start that finish a character begun before the
+// offset are skipped, and a character cut off at its end is left for the
+// next page. It returns the text and the offsets of the bytes it covers.
+func decodePage(data []byte, offset, size int64, format TextFormat) (string, int64, int64) {
+	start, end := 0, len(data)
+	last := offset+int64(len(data)) >= size
+
+	switch format.Encoding {
+	case EncodingUTF8:
+		for start < len(data) && start < utf8.UTFMax-1 && !utf8.RuneStart(data[start]) {
+			start++
+		}
+		if !last {
+			if trimmed := trimPartialRune(data[start:]); len(trimmed) > 0 {
+				end = start + len(trimmed)
+			}
+		}
+
+	case EncodingUTF16LE, EncodingUTF16BE:
+		var order binary.ByteOrder = binary.LittleEndian
+		if format.Encoding == EncodingUTF16BE {
+			order = binary.BigEndian
+		}
+		start = int(offset % 2)
+		end = start + (len(data)-start)&^1
+		if end-start >= 2 {
+			if u := order.Uint16(data[start:]); u >= 0xDC00 && u < 0xE000 {
+				// The second half of a pair whose first half is on the last page
+				start += 2
+			}
+		}
+		if !last && end-start >= 4 {
+			if u := order.Uint16(data[end-2:]); u >= 0xD800 && u < 0xDC00 {
+				// The first half of a pair whose second half is on the next page
+				end -= 2
+			}
+		}
+	}
+
+	// A page too short to hold one whole character is sent as is, so the
+	// reader still moves forward
+	if end <= start {
+		start, end = 0, len(data)
+	}
+	page := format
+	page.BOM = format.BOM && offset+int64(start) == 0
+	text, err := decodeAs(data[start:end], page)
+	if err != nil {
+		text = string(data[start:end])
+	}
+	return text, offset + int64(start), offset + int64(end)
+}
+
+// formatHexDump renders data as hex dump lines, numbering them from offset
+func formatHexDump(data []byte, offset int64) string {
+	var sb strings.Builder
+	for row := 0; row < len(data); row += hexRowWidth {
+		end := row + hexRowWidth
+		if end > len(data) {
+			end = len(data)
+		}
+		line := data[row:end]
+
+		fmt.Fprintf(&sb, "%08x  ", offset+int64(row))
+		for i := 0; i < hexRowWidth; i++ {
+			if i < len(line) {
+				fmt.Fprintf(&sb, "%02x ", line[i])
+			} else {
+				sb.WriteString("   ")
+			}
+			if i == hexRowWidth/2-1 {
+				sb.WriteByte(' ')
+			}
+		}
+		sb.WriteString(" |")
+		for _, b := range line {
+			if b >= 0x20 && b < 0x7F {
+				sb.WriteByte(b)
+			} else {
+				sb.WriteByte('.')
+			}
+		}
+		sb.WriteString("|\n")
+	}
+	return sb.String()
+}
+
+// sendPreview tells the client a file can only be viewed read-only, in
+// pages fetched with read_range
+func (s *session) sendPreview(path, mode, reason string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		s.sendError("Failed to read file: " + err.Error())
+		return
+	}
+	s.send("file_preview", map[string]interface{}{
+		"path":      path,
+		"mode":      mode,
+		"reason":    reason,
+		"size":      info.Size(),
+		"pageSize":  maxRangeLength,
+		"rowLength": hexRowWidth,
+	})
+}
+
+func (s *session) handleReadRange(raw json.RawMessage) {
+	var payload ReadRangePayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid read_range payload")
+		return
+	}
+
+	path, err := s.workspace.Resolve(payload.Path)
+	if err != nil {
+		s.sendError("Failed to read file: " + err.Error())
+		return
+	}
+
+	length := payload.Length
+	if length <= 0 || length > maxRangeLength {
+		length = maxRangeLength
+	}
+	offset := payload.Offset
+	if payload.Mode == previewModeHex {
+		// Keep rows aligned so each page continues the dump seamlessly
+		offset -= offset % hexRowWidth
+		length -= length % hexRowWidth
+		if length == 0 {
+			length = hexRowWidth
+		}
+	}
+
+	data, size, err := ReadRange(path, offset, length)
+	if err != nil {
+		s.sendError("Failed to read file: " + err.Error())
+		return
+	}
+
+	var text string
+	next := offset + int64(len(data))
+	switch payload.Mode {
+	case previewModeHex:
+		text = formatHexDump(data, offset)
+	case "", previewModePaged:
+		format, err := pagedFormat(path)
+		if err != nil {
+			s.sendError("Failed to read file: " + err.Error())
+			return
+		}
+		text, offset, next = decodePage(data, offset, size, format)
+	default:
+		s.sendError("Unknown read_range mode: " + payload.Mode)
+		return
+	}
+
+	s.send("range_data", map[string]interface{}{
+		"path":       path,
+		"mode":       payload.Mode,
+		"offset":     offset,
+		"nextOffset": next,
+		"size":       size,
+		"data":       text,
+		"eof":        next >= size,
+	})
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecodePage(t *testing.T) {
+	utf16le := func(s string, bom bool) []byte {
+		data, err := EncodeText(s, TextFormat{Encoding: EncodingUTF16LE, BOM: bom, LineEnding: LineEndingLF})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	utf8Format := TextFormat{Encoding: EncodingUTF8, LineEnding: LineEndingLF}
+	utf16Format := TextFormat{Encoding: EncodingUTF16LE, LineEnding: LineEndingLF}
+	bomFormat := utf16Format
+	bomFormat.BOM = true
+
+	tests := []struct {
+		name       string
+		file       []byte
+		format     TextFormat
+		offset     int64
+		length     int
+		want       string
+		start, end int64
+	}{
+		{"utf8 whole", []byte("héllo"), utf8Format, 0, 6, "héllo", 0, 6},
+		{"utf8 cut inside a character", []byte("héllo"), utf8Format, 0, 2, "h", 0, 1},
+		{"utf8 from inside a character", []byte("héllo"), utf8Format, 2, 4, "llo", 3, 6},
+		{"utf8 emoji cut at the end of the file", []byte("a😀"[:3]), utf8Format, 0, 3, "a\xf0\x9f", 0, 3},
+		{"utf8 page shorter than a character", []byte("😀b"), utf8Format, 0, 2, "\xf0\x9f", 0, 2},
+		{"utf16 bom skipped", utf16le("ab", true), bomFormat, 0, 6, "ab", 0, 6},
+		{"utf16 odd offset", utf16le("abc", false), utf16Format, 1, 5, "bc", 2, 6},
+		{"utf16 odd length", utf16le("abc", false), utf16Format, 0, 5, "ab", 0, 4},
+		{"utf16 pair cut at the end", utf16le("a😀b", false), utf16Format, 0, 4, "a", 0, 2},
+		{"utf16 from the second half of a pair", utf16le("a😀b", false), utf16Format, 4, 4, "b", 6, 8},
+		{"latin1", []byte{'a', 0xE9, 'b'}, TextFormat{Encoding: EncodingLatin1, LineEnding: LineEndingLF}, 1, 2, "éb", 1, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			end := int(tt.offset) + tt.length
+			if end > len(tt.file) {
+				end = len(tt.file)
+			}
+			data := tt.file[tt.offset:end]
+			text, start, next := decodePage(data, tt.offset, int64(len(tt.file)), tt.format)
+			if text != tt.want || start != tt.start || next != tt.end {
+				t.Errorf("got %q [%d, %d); want %q [%d, %d)", text, start, next, tt.want, tt.start, tt.end)
+			}
+		})
+	}
+}
+
+// TestPagedReadMatchesDecodeText pages through files in every encoding with
+// pages that cut characters, as the client does, and compares the result
+// with decoding the whole file
+func TestPagedReadMatchesDecodeText(t *testing.T) {
+	content := strings.Repeat("line é 😀 ÿ\n", 500)
+	formats := []TextFormat{
+		{Encoding: EncodingUTF8, LineEnding: LineEndingLF},
+		{Encoding: EncodingUTF8, BOM: true, LineEnding: LineEndingLF},
+		{Encoding: EncodingUTF16LE, BOM: true, LineEnding: LineEndingLF},
+		{Encoding: EncodingUTF16BE, BOM: true, LineEnding: LineEndingLF},
+	}
+
+	for _, format := range formats {
+		data, err := EncodeText(content, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "big.txt")
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		detected, err := pagedFormat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if detected.Encoding != format.Encoding || detected.BOM != format.BOM {
+			t.Fatalf("detected %+v; want %+v", detected, format)
+		}
+
+		for _, pageSize := range []int{7, 1000, 4093} {
+			var sb strings.Builder
+			var offset int64
+			for offset < int64(len(data)) {
+				page, size, err := ReadRange(path, offset, pageSize)
+				if err != nil {
+					t.Fatal(err)
+				}
+				text, start, next := decodePage(page, offset, size, detected)
+				if start != offset {
+					t.Fatalf("%s, pages of %d: page at %d starts at %d", format.Encoding, pageSize, offset, start)
+				}
+				sb.WriteString(text)
+				offset = next
+			}
+			if sb.String() != content {
+				t.Errorf("%s (bom %v), pages of %d: paged text differs from the file", format.Encoding, format.BOM, pageSize)
+			}
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrSnapshotNotFound is returned for a local history entry that does not
+// exist, or was pruned
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// maxSnapshotsPerFile bounds the local history kept for each file; the
+// oldest snapshots are pruned first
+const maxSnapshotsPerFile = 100
+
+// Reasons a snapshot was taken
+const (
+	snapshotSave          = "save"
+	snapshotBeforeReload  = "before-reload"
+	snapshotBeforeRestore = "before-restore"
+	snapshotBeforeReplace = "before-replace"
+)
+
+// Snapshot is one entry of a file's local history. Added and Removed count
+// lines changed since the previous snapshot.
+type Snapshot struct {
+	ID      int        `json:"id"`
+	Time    time.Time  `json:"time"`
+	Reason  string     `json:"reason"`
+	Hash    string     `json:"hash"` // hex SHA-256 of the content
+	Size    int        `json:"size"`
+	Added   int        `json:"added"`
+	Removed int        `json:"removed"`
+	Format  TextFormat `json:"format"`
+}
+
+// snapshotIndex lists the snapshots of one file, oldest first
+type snapshotIndex struct {
+	Path      string     `json:"path"`
+	NextID    int        `json:"nextId"`
+	Snapshots []Snapshot `json:"snapshots"`
+}
+
+// LocalHistory keeps automatic snapshots of files outside the workspace, as
+// a safety net independent of version control. Each file gets a directory
+// named after a hash of its path, holding an index and one blob per distinct
+// content, so identical versions are stored once.
+type LocalHistory struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewLocalHistory stores snapshots below stateDir
+func NewLocalHistory(stateDir string) (*LocalHistory, error) {
+	dir := filepath.Join(stateDir, "history")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &LocalHistory{dir: dir}, nil
+}
+
+func (h *LocalHistory) fileDir(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(h.dir, hex.EncodeToString(sum[:16]))
+}
+
+// Record takes a snapshot of content unless it matches the latest one.
+// A nil LocalHistory records nothing.
+func (h *LocalHistory) Record(path, content string, format TextFormat, reason string) error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	index, err := h.readIndex(path)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256([]byte(content))
+	hash := hex.EncodeToString(sum[:])
+	snapshot := Snapshot{
+		ID:     index.NextID,
+		Time:   time.Now(),
+		Reason: reason,
+		Hash:   hash,
+		Size:   len(content),
+		Format: format,
+	}
+
+	if n := len(index.Snapshots); n > 0 {
+		last := index.Snapshots[n-1]
+		if last.Hash == hash && last.Format == format {
+			return nil
+		}
+		previous, err := h.readBlob(path, last.Hash)
+		if err != nil {
+			return err
+		}
+		snapshot.Added, snapshot.Removed = diffStat(previous, content)
+	} else {
+		snapshot.Added = len(splitLines(content))
+	}
+
+	blob := filepath.Join(h.fileDir(path), hash)
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := WriteFile(blob, content); err != nil {
+			return err
+		}
+	}
+
+	index.NextID++
+	index.Snapshots = append(index.Snapshots, snapshot)
+	var pruned []Snapshot
+	if len(index.Snapshots) > maxSnapshotsPerFile {
+		cut := len(index.Snapshots) - maxSnapshotsPerFile
+		pruned = index.Snapshots[:cut]
+		index.Snapshots = index.Snapshots[cut:]
+	}
+	if err := h.writeIndex(index); err != nil {
+		return err
+	}
+	h.removeUnreferenced(path, index, pruned)
+	return nil
+}
+
+// List returns the snapshots of a file, newest first
+func (h *LocalHistory) List(path string) ([]Snapshot, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	index, err := h.readIndex(path)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]Snapshot, len(index.Snapshots))
+	for i, snapshot := range index.Snapshots {
+		snapshots[len(snapshots)-1-i] = snapshot
+	}
+	return snapshots, nil
+}
+
+// Get returns one snapshot of a file along with its content
+func (h *LocalHistory) Get(path string, id int) (Snapshot, string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	index, err := h.readIndex(path)
+	if err != nil {
+		return Snapshot{}, "", err
+	}
+	for _, snapshot := range index.Snapshots {
+		if snapshot.ID == id {
+			content, err := h.readBlob(path, snapshot.Hash)
+			return snapshot, content, err
+		}
+	}
+	return Snapshot{}, "", ErrSnapshotNotFound
+}
+
+// readIndex loads the index of a file; a file without history has an empty
+// one (must be called with lock held)
+func (h *LocalHistory) readIndex(path string) (*snapshotIndex, error) {
+	data, err := os.ReadFile(filepath.Join(h.fileDir(path), "index.json"))
+	if os.IsNotExist(err) {
+		return &snapshotIndex{Path: path, NextID: 1}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var index snapshotIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("corrupt local history for %s: %w", path, err)
+	}
+	if index.Path != path {
+		return nil, fmt.Errorf("local history for %s belongs to %s", path, index.Path)
+	}
+	return &index, nil
+}
+
+func (h *LocalHistory) writeIndex(index *snapshotIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return WriteFile(filepath.Join(h.fileDir(index.Path), "index.json"), string(data))
+}
+
+func (h *LocalHistory) readBlob(path, hash string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(h.fileDir(path), hash))
+	if os.IsNotExist(err) {
+		return "", ErrSnapshotNotFound
+	}
+	return string(data), err
+}
+
+// removeUnreferenced deletes the blobs of pruned snapshots that no remaining
+// snapshot shares
+func (h *LocalHistory) removeUnreferenced(path string, index *snapshotIndex, pruned []Snapshot) {
+	kept := make(map[string]bool, len(index.Snapshots))
+	for _, snapshot := range index.Snapshots {
+		kept[snapshot.Hash] = true
+	}
+	for _, snapshot := range pruned {
+		if kept[snapshot.Hash] {
+			continue
+		}
+		kept[snapshot.Hash] = true
+		if err := os.Remove(filepath.Join(h.fileDir(path), snapshot.Hash)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to prune local history of %s: %v", path, err)
+		}
+	}
+}
+
+// diffStat counts the lines added and removed between two texts
+func diffStat(oldText, newText string) (added, removed int) {
+	for _, op := range diffLines(splitLines(oldText), splitLines(newText)) {
+		switch op.kind {
+		case '+':
+			added++
+		case '-':
+			removed++
+		}
+	}
+	return added, removed
+}
+
+type LocalHistoryPayload struct {
+	Path string `json:"path"`
+	ID   int    `json:"id"` // for history_get and history_restore
+}
+
+func (s *session) handleHistoryList(raw json.RawMessage) {
+	var payload LocalHistoryPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid history_list payload")
+		return
+	}
+	path, ok := s.resolveHistoryPath(payload.Path)
+	if !ok {
+		return
+	}
+
+	snapshots, err := s.localHistory.List(path)
+	if err != nil {
+		s.sendError("Failed to list local history: " + err.Error())
+		return
+	}
+	s.send("history_list_result", map[string]interface{}{
+		"path":      path,
+		"snapshots": snapshots,
+	})
+}
+
+// handleHistoryGet sends a snapshot's content with a diff from it to the
+// file as it is now: the open buffer, or else the file on disk
+func (s *session) handleHistoryGet(raw json.RawMessage) {
+	var payload LocalHistoryPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid history_get payload")
+		return
+	}
+	path, ok := s.resolveHistoryPath(payload.Path)
+	if !ok {
+		return
+	}
+
+	snapshot, content, err := s.localHistory.Get(path, payload.ID)
+	if err != nil {
+		s.sendError("Failed to read local history: " + err.Error())
+		return
+	}
+
+	current := ""
+	if doc, open := s.store.Snapshot(pathToURI(path)); open {
+		current = doc.Content
+	} else if _, diskContent, _, err := ReadDiskText(path); err == nil {
+		current = diskContent
+	}
+	hunks := DiffLines(content, current, swapContextLines)
+
+	s.send("history_get_result", map[string]interface{}{
+		"path":     path,
+		"snapshot": snapshot,
+		"content":  content,
+		"hunks":    hunks,
+		"diff":     UnifiedDiff(fmt.Sprintf("%s (snapshot %d)", path, snapshot.ID), path, hunks),
+	})
+}
+
+// handleHistoryRestore rolls a file back to a snapshot. An open buffer is
+// replaced and left unsaved, so the restore can be undone; otherwise the
+// file is rewritten on disk after its current content is snapshotted.
+func (s *session) handleHistoryRestore(raw json.RawMessage) {
+	var payload LocalHistoryPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid history_restore payload")
+		return
+	}
+	path, ok := s.resolveHistoryPath(payload.Path)
+	if !ok {
+		return
+	}
+
+	snapshot, content, err := s.localHistory.Get(path, payload.ID)
+	if err != nil {
+		s.sendError("Failed to read local history: " + err.Error())
+		return
+	}
+
+	uri := pathToURI(path)
+	err = s.store.Restore(uri, content, snapshot.Format)
+	inBuffer := err == nil
+	if err == ErrDocumentNotOpen {
+		err = s.restoreOnDisk(path, content, snapshot.Format)
+	}
+	if err != nil {
+		s.sendError("Failed to restore snapshot: " + err.Error())
+		return
+	}
+
+	s.send("history_restore_result", map[string]interface{}{
+		"path":     path,
+		"uri":      uri,
+		"id":       snapshot.ID,
+		"inBuffer": inBuffer,
+	})
+}
+
+// restoreOnDisk writes snapshot content over a file nobody has open
+func (s *session) restoreOnDisk(path, content string, format TextFormat) error {
+	stamp, current, currentFormat, err := ReadDiskText(path)
+	if err != nil {
+		return err
+	}
+	if !stamp.Missing {
+		if err := s.localHistory.Record(path, current, currentFormat, snapshotBeforeRestore); err != nil {
+			return err
+		}
+	}
+
+	data, err := EncodeText(content, format)
+	if err != nil {
+		return err
+	}
+	return WriteFile(path, string(data))
+}
+
+func (s *session) resolveHistoryPath(requested string) (string, bool) {
+	if s.localHistory == nil {
+		s.sendError("Local history is disabled")
+		return "", false
+	}
+	path, err := s.workspace.Resolve(requested)
+	if err != nil {
+		s.sendError("Invalid path: " + err.Error())
+		return "", false
+	}
+	return path, true
+}
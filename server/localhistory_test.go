@@ -0,0 +1,121 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalHistoryRecord(t *testing.T) {
+	h, err := NewLocalHistory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "a.txt")
+	crlf := TextFormat{Encoding: EncodingUTF8, LineEnding: LineEndingCRLF}
+
+	steps := []struct {
+		content string
+		format  TextFormat
+		reason  string
+		kept    bool // whether a snapshot is taken
+		added   int
+		removed int
+	}{
+		{"one\ntwo\n", DefaultTextFormat, snapshotSave, true, 2, 0},
+		{"one\ntwo\n", DefaultTextFormat, snapshotSave, false, 0, 0},
+		{"one\n2\nthree\n", DefaultTextFormat, snapshotSave, true, 2, 1},
+		{"one\n2\nthree\n", crlf, snapshotSave, true, 0, 0},
+		{"one\ntwo\n", DefaultTextFormat, snapshotBeforeReload, true, 1, 2},
+	}
+
+	wantIDs := []int{}
+	for i, step := range steps {
+		before, err := h.List(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Record(path, step.content, step.format, step.reason); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		after, err := h.List(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !step.kept {
+			if len(after) != len(before) {
+				t.Errorf("step %d: a snapshot was taken of unchanged content", i)
+			}
+			continue
+		}
+		if len(after) != len(before)+1 {
+			t.Fatalf("step %d: got %d snapshots; want %d", i, len(after), len(before)+1)
+		}
+		latest := after[0]
+		wantIDs = append(wantIDs, latest.ID)
+		if latest.Reason != step.reason || latest.Format != step.format || latest.Added != step.added || latest.Removed != step.removed {
+			t.Errorf("step %d: got %+v; want reason %s, +%d -%d", i, latest, step.reason, step.added, step.removed)
+		}
+		if _, content, err := h.Get(path, latest.ID); err != nil || content != step.content {
+			t.Errorf("step %d: Get gave %q, %v; want %q", i, content, err, step.content)
+		}
+	}
+
+	list, _ := h.List(path)
+	for i, snapshot := range list {
+		if want := wantIDs[len(wantIDs)-1-i]; snapshot.ID != want {
+			t.Errorf("List()[%d] has ID %d; want %d, newest first", i, snapshot.ID, want)
+		}
+	}
+	if _, _, err := h.Get(path, 999); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("Get of a missing ID: got %v", err)
+	}
+	if err := (*LocalHistory)(nil).Record(path, "x", DefaultTextFormat, snapshotSave); err != nil {
+		t.Errorf("nil history: %v", err)
+	}
+}
+
+func TestLocalHistoryPrunes(t *testing.T) {
+	h, err := NewLocalHistory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "a.txt")
+
+	// The first content comes back at the end, so its blob must survive
+	// the snapshot that first used it being pruned
+	for i := 0; i < maxSnapshotsPerFile+5; i++ {
+		content := fmt.Sprintf("version %d\n", i)
+		if i == maxSnapshotsPerFile+4 {
+			content = "version 0\n"
+		}
+		if err := h.Record(path, content, DefaultTextFormat, snapshotSave); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := h.List(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != maxSnapshotsPerFile {
+		t.Fatalf("got %d snapshots; want %d", len(list), maxSnapshotsPerFile)
+	}
+	if oldest := list[len(list)-1].ID; oldest != 6 {
+		t.Errorf("oldest snapshot has ID %d; want 6", oldest)
+	}
+	if _, content, err := h.Get(path, list[0].ID); err != nil || content != "version 0\n" {
+		t.Errorf("latest snapshot: got %q, %v", content, err)
+	}
+
+	blobs, err := os.ReadDir(h.fileDir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One blob per kept snapshot, plus the index
+	if len(blobs) != maxSnapshotsPerFile+1 {
+		t.Errorf("got %d files; want %d", len(blobs), maxSnapshotsPerFile+1)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"os/exec"
 	"sync"
+	"time"
 )
 
 // LSPManager manages the clangd LSP server process
@@ -22,6 +23,8 @@ type LSPManager struct {
 	messageID        int
 	responseHandlers map[int]chan json.RawMessage
 	notificationChan chan json.RawMessage
+	fileWatchers     map[string][]fileSystemWatcher // registration ID -> watchers
+	capabilities     ServerCapabilities             // from the initialize response
 }
 
 // NewLSPManager creates a new LSP manager
@@ -29,6 +32,7 @@ func NewLSPManager() *LSPManager {
 	return &LSPManager{
 		responseHandlers: make(map[int]chan json.RawMessage),
 		notificationChan: make(chan json.RawMessage, 100),
+		fileWatchers:     make(map[string][]fileSystemWatcher),
 	}
 }
 
@@ -96,6 +100,17 @@ func (lsp *LSPManager) Shutdown() {
 
 // SendRequest sends a JSON-RPC request to clangd
 func (lsp *LSPManager) SendRequest(method string, params interface{}) (json.RawMessage, error) {
+	return lsp.sendRequest(method, params, 0)
+}
+
+// SendRequestTimeout is like SendRequest but gives up, and cancels the
+// request on the server, once timeout has passed
+func (lsp *LSPManager) SendRequestTimeout(method string, params interface{}, timeout time.Duration) (json.RawMessage, error) {
+	return lsp.sendRequest(method, params, timeout)
+}
+
+// sendRequest waits for the response; a zero timeout waits forever
+func (lsp *LSPManager) sendRequest(method string, params interface{}, timeout time.Duration) (json.RawMessage, error) {
 	lsp.mu.Lock()
 	if !lsp.running {
 		lsp.mu.Unlock()
@@ -123,8 +138,22 @@ func (lsp *LSPManager) SendRequest(method string, params interface{}) (json.RawM
 	}
 
 	// Wait for response
-	response := <-responseChan
-	return response, nil
+	if timeout <= 0 {
+		return <-responseChan, nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case response := <-responseChan:
+		return response, nil
+	case <-timer.C:
+		lsp.mu.Lock()
+		delete(lsp.responseHandlers, id)
+		lsp.mu.Unlock()
+		lsp.SendNotification("$/cancelRequest", map[string]interface{}{"id": id})
+		return nil, fmt.Errorf("LSP request %s timed out after %s", method, timeout)
+	}
 }
 
 // SendNotification sends a JSON-RPC notification to clangd
@@ -200,10 +229,11 @@ func (lsp *LSPManager) readMessages() {
 			return
 		}
 
-		// Parse the message
+		// Parse the message; IDs of server-to-client requests may be strings
 		var msg struct {
-			ID     *int            `json:"id"`
+			ID     json.RawMessage `json:"id"`
 			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
 			Result json.RawMessage `json:"result"`
 			Error  json.RawMessage `json:"error"`
 		}
@@ -213,12 +243,19 @@ func (lsp *LSPManager) readMessages() {
 			continue
 		}
 
-		// Handle response or notification
-		if msg.ID != nil {
+		// Handle request from the server, response or notification
+		if len(msg.ID) > 0 && msg.Method != "" {
+			go lsp.handleServerRequest(msg.ID, msg.Method, msg.Params)
+		} else if len(msg.ID) > 0 {
+			var id int
+			if err := json.Unmarshal(msg.ID, &id); err != nil {
+				log.Printf("Unexpected LSP response ID: %s", msg.ID)
+				continue
+			}
 			lsp.mu.Lock()
-			if ch, ok := lsp.responseHandlers[*msg.ID]; ok {
+			if ch, ok := lsp.responseHandlers[id]; ok {
 				ch <- content
-				delete(lsp.responseHandlers, *msg.ID)
+				delete(lsp.responseHandlers, id)
 			}
 			lsp.mu.Unlock()
 		} else if msg.Method != "" {
@@ -232,6 +269,36 @@ func (lsp *LSPManager) readMessages() {
 	}
 }
 
+// handleServerRequest answers a request the server sent to us
+func (lsp *LSPManager) handleServerRequest(id json.RawMessage, method string, params json.RawMessage) {
+	var result interface{}
+
+	switch method {
+	case "client/registerCapability":
+		lsp.registerCapabilities(params)
+	case "client/unregisterCapability":
+		lsp.unregisterCapabilities(params)
+	case "workspace/configuration":
+		// No client-side settings; answer null for every requested item
+		var req struct {
+			Items []json.RawMessage `json:"items"`
+		}
+		json.Unmarshal(params, &req)
+		result = make([]interface{}, len(req.Items))
+	default:
+		// window/workDoneProgress/create and friends just need an acknowledgement
+	}
+
+	response := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"result":  result,
+	}
+	if err := lsp.writeMessage(response); err != nil {
+		log.Printf("Failed to answer LSP request %s: %v", method, err)
+	}
+}
+
 // logStderr logs clangd stderr output
 func (lsp *LSPManager) logStderr() {
 	scanner := bufio.NewScanner(lsp.stderr)
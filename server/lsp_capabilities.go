@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"regexp"
+)
+
+// ServerCapabilities holds the parts of an LSP server's advertised
+// capabilities that the editor acts on
+type ServerCapabilities struct {
+	TextDocumentSync           json.RawMessage `json:"textDocumentSync"`
+	DocumentFormattingProvider json.RawMessage `json:"documentFormattingProvider"`
+	CodeActionProvider         json.RawMessage `json:"codeActionProvider"`
+	Workspace                  struct {
+		FileOperations *FileOperationsCapabilities `json:"fileOperations"`
+	} `json:"workspace"`
+}
+
+// TextDocumentSyncKind values from the LSP specification
+const (
+	TextDocumentSyncNone        = 0
+	TextDocumentSyncFull        = 1
+	TextDocumentSyncIncremental = 2
+)
+
+// SyncKind returns how the server wants document changes sent. The
+// capability is either a bare kind or a TextDocumentSyncOptions object.
+// Servers that leave it out get the full text, which every server accepts.
+func (c ServerCapabilities) SyncKind() int {
+	if len(c.TextDocumentSync) == 0 {
+		return TextDocumentSyncFull
+	}
+
+	var kind int
+	if err := json.Unmarshal(c.TextDocumentSync, &kind); err == nil {
+		return kind
+	}
+
+	var opts struct {
+		Change *int `json:"change"`
+	}
+	if err := json.Unmarshal(c.TextDocumentSync, &opts); err != nil || opts.Change == nil {
+		return TextDocumentSyncFull
+	}
+	return *opts.Change
+}
+
+// FormattingProvider reports whether the server formats whole documents.
+// The capability is either a boolean or a DocumentFormattingOptions object.
+func (c ServerCapabilities) FormattingProvider() bool {
+	var enabled bool
+	if err := json.Unmarshal(c.DocumentFormattingProvider, &enabled); err == nil {
+		return enabled
+	}
+	var opts map[string]interface{}
+	return json.Unmarshal(c.DocumentFormattingProvider, &opts) == nil && opts != nil
+}
+
+// CodeActions reports whether the server offers code actions, and whether
+// it fills in their edits lazily through codeAction/resolve. The capability
+// is either a boolean or a CodeActionOptions object.
+func (c ServerCapabilities) CodeActions() (supported, resolve bool) {
+	var enabled bool
+	if err := json.Unmarshal(c.CodeActionProvider, &enabled); err == nil {
+		return enabled, false
+	}
+	var opts struct {
+		ResolveProvider bool `json:"resolveProvider"`
+	}
+	if err := json.Unmarshal(c.CodeActionProvider, &opts); err != nil {
+		return false, false
+	}
+	return true, opts.ResolveProvider
+}
+
+// FileOperationsCapabilities lists the workspace/*Files requests and
+// notifications a server is interested in
+type FileOperationsCapabilities struct {
+	DidCreate  *FileOperationRegistration `json:"didCreate"`
+	WillCreate *FileOperationRegistration `json:"willCreate"`
+	DidRename  *FileOperationRegistration `json:"didRename"`
+	WillRename *FileOperationRegistration `json:"willRename"`
+	DidDelete  *FileOperationRegistration `json:"didDelete"`
+	WillDelete *FileOperationRegistration `json:"willDelete"`
+}
+
+// FileOperationRegistration filters the files a file operation applies to
+type FileOperationRegistration struct {
+	Filters []struct {
+		Scheme  string `json:"scheme"`
+		Pattern struct {
+			Glob    string `json:"glob"`
+			Matches string `json:"matches"` // "file", "folder" or empty for both
+			Options struct {
+				IgnoreCase bool `json:"ignoreCase"`
+			} `json:"options"`
+		} `json:"pattern"`
+	} `json:"filters"`
+}
+
+// Matches reports whether any filter selects path
+func (r *FileOperationRegistration) Matches(path string, isDir bool) bool {
+	if r == nil {
+		return false
+	}
+
+	for _, filter := range r.Filters {
+		if filter.Scheme != "" && filter.Scheme != "file" {
+			continue
+		}
+		if filter.Pattern.Matches == "file" && isDir {
+			continue
+		}
+		if filter.Pattern.Matches == "folder" && !isDir {
+			continue
+		}
+
+		expr := lspGlobToRegexp(filter.Pattern.Glob, true)
+		if filter.Pattern.Options.IgnoreCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			continue
+		}
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// setCapabilities records the capabilities from an initialize response
+func (lsp *LSPManager) setCapabilities(response json.RawMessage) {
+	var msg struct {
+		Result struct {
+			Capabilities ServerCapabilities `json:"capabilities"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(response, &msg); err != nil {
+		log.Printf("Failed to parse initialize response: %v", err)
+		return
+	}
+
+	lsp.mu.Lock()
+	lsp.capabilities = msg.Result.Capabilities
+	lsp.mu.Unlock()
+}
+
+// TextDocumentSyncKind returns how the server handling path wants document
+// changes sent
+func (m *MultiLSPManager) TextDocumentSyncKind(path string) int {
+	m.mu.RLock()
+	lsp, exists := m.lspServers[detectLanguageForLSP(path)]
+	m.mu.RUnlock()
+
+	if !exists {
+		return TextDocumentSyncFull
+	}
+	return lsp.Capabilities().SyncKind()
+}
+
+// Capabilities returns what the server advertised when it was initialized
+func (lsp *LSPManager) Capabilities() ServerCapabilities {
+	lsp.mu.Lock()
+	defer lsp.mu.Unlock()
+	return lsp.capabilities
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// FileOperationKind names a workspace file operation as used in LSP method names
+type FileOperationKind string
+
+const (
+	FileOpCreate FileOperationKind = "Create"
+	FileOpRename FileOperationKind = "Rename"
+	FileOpDelete FileOperationKind = "Delete"
+)
+
+// FileOperation is one file or folder affected by a create, rename or delete.
+// NewPath is only set for renames.
+type FileOperation struct {
+	Path    string
+	NewPath string
+	IsDir   bool
+}
+
+// fileOperationTimeout bounds how long a will* request may delay the operation
+const fileOperationTimeout = 3 * time.Second
+
+// fileOperationRegistrations returns the will/did filters the server advertised for kind
+func (caps ServerCapabilities) fileOperationRegistrations(kind FileOperationKind) (will, did *FileOperationRegistration) {
+	ops := caps.Workspace.FileOperations
+	if ops == nil {
+		return nil, nil
+	}
+	switch kind {
+	case FileOpCreate:
+		return ops.WillCreate, ops.DidCreate
+	case FileOpRename:
+		return ops.WillRename, ops.DidRename
+	case FileOpDelete:
+		return ops.WillDelete, ops.DidDelete
+	}
+	return nil, nil
+}
+
+// fileOperationParams builds CreateFilesParams/RenameFilesParams/DeleteFilesParams
+// for the operations matched by reg, or nil if none match
+func fileOperationParams(kind FileOperationKind, reg *FileOperationRegistration, ops []FileOperation) map[string]interface{} {
+	var files []interface{}
+	for _, op := range ops {
+		if !reg.Matches(op.Path, op.IsDir) {
+			continue
+		}
+		if kind == FileOpRename {
+			files = append(files, map[string]string{
+				"oldUri": pathToURI(op.Path),
+				"newUri": pathToURI(op.NewPath),
+			})
+		} else {
+			files = append(files, map[string]string{
+				"uri": pathToURI(op.Path),
+			})
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	return map[string]interface{}{"files": files}
+}
+
+// WillFileOperation sends workspace/will<Kind>Files to every server that
+// registered for the affected files and returns the WorkspaceEdits they
+// want applied before the operation happens. Slow servers are skipped.
+func (m *MultiLSPManager) WillFileOperation(kind FileOperationKind, ops []FileOperation) []WorkspaceEdit {
+	method := "workspace/will" + string(kind) + "Files"
+
+	var edits []WorkspaceEdit
+	for language, lsp := range m.snapshotServers() {
+		will, _ := lsp.Capabilities().fileOperationRegistrations(kind)
+		params := fileOperationParams(kind, will, ops)
+		if params == nil {
+			continue
+		}
+
+		response, err := lsp.SendRequestTimeout(method, params, fileOperationTimeout)
+		if err != nil {
+			log.Printf("Warning: %s to %s LSP failed: %v", method, language, err)
+			continue
+		}
+
+		var msg struct {
+			Result *WorkspaceEdit `json:"result"`
+		}
+		if err := json.Unmarshal(response, &msg); err != nil {
+			log.Printf("Warning: invalid %s response from %s LSP: %v", method, language, err)
+			continue
+		}
+		if msg.Result != nil {
+			edits = append(edits, *msg.Result)
+		}
+	}
+	return edits
+}
+
+// DidFileOperation sends workspace/did<Kind>Files to every server that
+// registered for the affected files
+func (m *MultiLSPManager) DidFileOperation(kind FileOperationKind, ops []FileOperation) {
+	method := "workspace/did" + string(kind) + "Files"
+
+	for language, lsp := range m.snapshotServers() {
+		_, did := lsp.Capabilities().fileOperationRegistrations(kind)
+		params := fileOperationParams(kind, did, ops)
+		if params == nil {
+			continue
+		}
+		if err := lsp.SendNotification(method, params); err != nil {
+			log.Printf("Warning: %s to %s LSP failed: %v", method, language, err)
+		}
+	}
+}
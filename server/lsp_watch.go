@@ -0,0 +1,231 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// WatchKind bits from the LSP specification
+const (
+	watchKindCreate = 1
+	watchKindChange = 2
+	watchKindDelete = 4
+)
+
+// fileSystemWatcher is one compiled entry of a workspace/didChangeWatchedFiles registration
+type fileSystemWatcher struct {
+	baseDir string // set for RelativePattern globs
+	re      *regexp.Regexp
+	kind    int
+}
+
+// matches reports whether the watcher wants an event for path
+func (w fileSystemWatcher) matches(ev FileEvent) bool {
+	var bit int
+	switch ev.Type {
+	case FileCreated:
+		bit = watchKindCreate
+	case FileChanged:
+		bit = watchKindChange
+	case FileDeleted:
+		bit = watchKindDelete
+	}
+	if w.kind&bit == 0 {
+		return false
+	}
+
+	target := filepath.ToSlash(ev.Path)
+	if w.baseDir != "" {
+		rel, err := filepath.Rel(w.baseDir, ev.Path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return false
+		}
+		target = filepath.ToSlash(rel)
+	}
+	return w.re.MatchString(target)
+}
+
+// registerCapabilities records dynamic registrations we care about
+func (lsp *LSPManager) registerCapabilities(params json.RawMessage) {
+	var req struct {
+		Registrations []struct {
+			ID              string          `json:"id"`
+			Method          string          `json:"method"`
+			RegisterOptions json.RawMessage `json:"registerOptions"`
+		} `json:"registrations"`
+	}
+	if err := json.Unmarshal(params, &req); err != nil {
+		log.Printf("Invalid client/registerCapability params: %v", err)
+		return
+	}
+
+	for _, reg := range req.Registrations {
+		if reg.Method != "workspace/didChangeWatchedFiles" {
+			continue
+		}
+
+		var opts struct {
+			Watchers []struct {
+				GlobPattern json.RawMessage `json:"globPattern"`
+				Kind        *int            `json:"kind"`
+			} `json:"watchers"`
+		}
+		if err := json.Unmarshal(reg.RegisterOptions, &opts); err != nil {
+			log.Printf("Invalid didChangeWatchedFiles options: %v", err)
+			continue
+		}
+
+		var watchers []fileSystemWatcher
+		for _, w := range opts.Watchers {
+			watcher, ok := compileFileSystemWatcher(w.GlobPattern)
+			if !ok {
+				continue
+			}
+			watcher.kind = watchKindCreate | watchKindChange | watchKindDelete
+			if w.Kind != nil {
+				watcher.kind = *w.Kind
+			}
+			watchers = append(watchers, watcher)
+		}
+
+		lsp.mu.Lock()
+		lsp.fileWatchers[reg.ID] = watchers
+		lsp.mu.Unlock()
+		log.Printf("LSP registered %d file watchers", len(watchers))
+	}
+}
+
+// unregisterCapabilities drops registrations made by registerCapabilities
+func (lsp *LSPManager) unregisterCapabilities(params json.RawMessage) {
+	var req struct {
+		// The field name is misspelled in the LSP specification
+		Unregisterations []struct {
+			ID string `json:"id"`
+		} `json:"unregisterations"`
+	}
+	if err := json.Unmarshal(params, &req); err != nil {
+		return
+	}
+
+	lsp.mu.Lock()
+	defer lsp.mu.Unlock()
+	for _, unreg := range req.Unregisterations {
+		delete(lsp.fileWatchers, unreg.ID)
+	}
+}
+
+// compileFileSystemWatcher parses a GlobPattern, which is either a string or
+// a RelativePattern {baseUri, pattern}
+func compileFileSystemWatcher(raw json.RawMessage) (fileSystemWatcher, bool) {
+	var watcher fileSystemWatcher
+	var pattern string
+
+	if err := json.Unmarshal(raw, &pattern); err != nil {
+		var rel struct {
+			BaseURI json.RawMessage `json:"baseUri"`
+			Pattern string          `json:"pattern"`
+		}
+		if err := json.Unmarshal(raw, &rel); err != nil {
+			return watcher, false
+		}
+		// baseUri is either a URI string or a WorkspaceFolder {uri, name}
+		var base string
+		if err := json.Unmarshal(rel.BaseURI, &base); err != nil {
+			var folder struct {
+				URI string `json:"uri"`
+			}
+			json.Unmarshal(rel.BaseURI, &folder)
+			base = folder.URI
+		}
+		watcher.baseDir = strings.TrimPrefix(base, "file://")
+		pattern = rel.Pattern
+	}
+
+	re, err := regexp.Compile(lspGlobToRegexp(pattern, watcher.baseDir == ""))
+	if err != nil {
+		return watcher, false
+	}
+	watcher.re = re
+	return watcher, true
+}
+
+// lspGlobToRegexp translates an LSP glob, which adds {a,b} alternatives to
+// the gitignore-style syntax, into an anchored regexp. With anywhere set, a
+// relative pattern may match at any depth of an absolute path.
+func lspGlobToRegexp(glob string, anywhere bool) string {
+	alternatives := expandBraces(glob)
+	parts := make([]string, len(alternatives))
+	for i, alt := range alternatives {
+		if anywhere && !strings.HasPrefix(alt, "/") && !strings.HasPrefix(alt, "**") {
+			alt = "**/" + alt
+		}
+		re := globToRegexp(strings.TrimPrefix(alt, "/"))
+		parts[i] = strings.TrimSuffix(strings.TrimPrefix(re, "^"), "$")
+	}
+	return "^/?(?:" + strings.Join(parts, "|") + ")$"
+}
+
+// expandBraces expands the first {a,b} group of a glob recursively
+func expandBraces(glob string) []string {
+	start := strings.IndexByte(glob, '{')
+	if start < 0 {
+		return []string{glob}
+	}
+	end := strings.IndexByte(glob[start:], '}')
+	if end < 0 {
+		return []string{glob}
+	}
+	end += start
+
+	var out []string
+	for _, option := range strings.Split(glob[start+1:end], ",") {
+		out = append(out, expandBraces(glob[:start]+option+glob[end+1:])...)
+	}
+	return out
+}
+
+// fileEventsFor returns the LSP FileEvent objects this server registered for
+func (lsp *LSPManager) fileEventsFor(events []FileEvent) []interface{} {
+	lsp.mu.Lock()
+	defer lsp.mu.Unlock()
+
+	var changes []interface{}
+	for _, ev := range events {
+		for _, watchers := range lsp.fileWatchers {
+			matched := false
+			for _, w := range watchers {
+				if w.matches(ev) {
+					matched = true
+					break
+				}
+			}
+			if matched {
+				changes = append(changes, map[string]interface{}{
+					"uri":  pathToURI(ev.Path),
+					"type": int(ev.Type),
+				})
+				break
+			}
+		}
+	}
+	return changes
+}
+
+// NotifyFileEvents sends workspace/didChangeWatchedFiles to every running
+// server that registered a matching file watcher
+func (m *MultiLSPManager) NotifyFileEvents(events []FileEvent) {
+	for language, lsp := range m.snapshotServers() {
+		changes := lsp.fileEventsFor(events)
+		if len(changes) == 0 {
+			continue
+		}
+		if err := lsp.SendNotification("workspace/didChangeWatchedFiles", map[string]interface{}{
+			"changes": changes,
+		}); err != nil {
+			log.Printf("Warning: Failed to send file events to %s LSP: %v", language, err)
+		}
+	}
+}
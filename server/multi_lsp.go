@@ -6,6 +6,7 @@ import (
 	"log"
 	"strings"
 	"sync"
+	"time"
 )
 
 // MultiLSPManager manages multiple LSP servers (one per language)
@@ -13,6 +14,8 @@ type MultiLSPManager struct {
 	lspServers       map[string]*LSPManager
 	mu               sync.RWMutex
 	notificationChan chan json.RawMessage
+	formatOnSave     map[string]FormattingOptions // languages formatted before saving
+	actionsOnSave    map[string][]string          // code action kinds run before saving, per language
 }
 
 // LSPConfig holds configuration for an LSP server
@@ -28,6 +31,8 @@ func NewMultiLSPManager() *MultiLSPManager {
 	m := &MultiLSPManager{
 		lspServers:       make(map[string]*LSPManager),
 		notificationChan: make(chan json.RawMessage, 100),
+		formatOnSave:     make(map[string]FormattingOptions),
+		actionsOnSave:    make(map[string][]string),
 	}
 	return m
 }
@@ -83,14 +88,50 @@ func (m *MultiLSPManager) InitializeLSP(language, rootDir string) error {
 					},
 				},
 				"publishDiagnostics": map[string]interface{}{},
+				"codeAction": map[string]interface{}{
+					"codeActionLiteralSupport": map[string]interface{}{
+						"codeActionKind": map[string]interface{}{
+							"valueSet": []string{"quickfix", "refactor", "source", "source.organizeImports", "source.fixAll"},
+						},
+					},
+					"dataSupport": true,
+					"resolveSupport": map[string]interface{}{
+						"properties": []string{"edit"},
+					},
+				},
+			},
+			"workspace": map[string]interface{}{
+				"didChangeWatchedFiles": map[string]interface{}{
+					"dynamicRegistration": true,
+				},
+				"fileOperations": map[string]interface{}{
+					"didCreate":  true,
+					"willCreate": true,
+					"didRename":  true,
+					"willRename": true,
+					"didDelete":  true,
+					"willDelete": true,
+				},
+				"workspaceEdit": map[string]interface{}{
+					"documentChanges":    true,
+					"resourceOperations": []string{"create", "rename", "delete"},
+				},
 			},
 		},
 	}
 
-	if _, err := m.SendRequest(language, "initialize", initParams); err != nil {
+	response, err := m.SendRequest(language, "initialize", initParams)
+	if err != nil {
 		return err
 	}
 
+	m.mu.RLock()
+	lsp, exists := m.lspServers[language]
+	m.mu.RUnlock()
+	if exists {
+		lsp.setCapabilities(response)
+	}
+
 	if err := m.SendNotification(language, "initialized", map[string]interface{}{}); err != nil {
 		return err
 	}
@@ -112,6 +153,19 @@ func (m *MultiLSPManager) SendRequest(language, method string, params interface{
 	return lsp.SendRequest(method, params)
 }
 
+// SendRequestTimeout is SendRequest, giving up once timeout has passed
+func (m *MultiLSPManager) SendRequestTimeout(language, method string, params interface{}, timeout time.Duration) (json.RawMessage, error) {
+	m.mu.RLock()
+	lsp, exists := m.lspServers[language]
+	m.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("no LSP server configured for language: %s", language)
+	}
+
+	return lsp.SendRequestTimeout(method, params, timeout)
+}
+
 // SendNotification sends a notification to a specific language's LSP server
 func (m *MultiLSPManager) SendNotification(language, method string, params interface{}) error {
 	m.mu.RLock()
@@ -136,6 +190,16 @@ func (m *MultiLSPManager) RouteRequest(method string, params interface{}) (json.
 	return m.SendRequest(language, method, params)
 }
 
+// RouteRequestTimeout is RouteRequest, giving up once timeout has passed
+func (m *MultiLSPManager) RouteRequestTimeout(method string, params interface{}, timeout time.Duration) (json.RawMessage, error) {
+	language, err := m.extractLanguageFromParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.SendRequestTimeout(language, method, params, timeout)
+}
+
 // RouteNotification routes a notification based on the textDocument URI in params
 func (m *MultiLSPManager) RouteNotification(method string, params interface{}) error {
 	language, err := m.extractLanguageFromParams(params)
@@ -190,11 +254,32 @@ func detectLanguageForLSP(path string) string {
 	return ""
 }
 
+// snapshotServers returns a copy of the language -> server map, so callers
+// can talk to servers without holding the lock
+func (m *MultiLSPManager) snapshotServers() map[string]*LSPManager {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	servers := make(map[string]*LSPManager, len(m.lspServers))
+	for language, lsp := range m.lspServers {
+		servers[language] = lsp
+	}
+	return servers
+}
+
 // GetNotificationChan returns the merged notification channel
 func (m *MultiLSPManager) GetNotificationChan() <-chan json.RawMessage {
 	return m.notificationChan
 }
 
+// ForwardLSPNotifications delivers the notifications of every LSP server
+// to the connections they concern
+func ForwardLSPNotifications(lspManager *MultiLSPManager, store *DocumentStore) {
+	for notification := range lspManager.GetNotificationChan() {
+		store.PublishLSPNotification(notification)
+	}
+}
+
 // IsRunning checks if an LSP server is running for a specific language
 func (m *MultiLSPManager) IsRunning(language string) bool {
 	m.mu.RLock()
@@ -232,3 +317,68 @@ func (m *MultiLSPManager) GetConfiguredLanguages() []string {
 	}
 	return languages
 }
+
+// SetFormatOnSave turns formatting before save on or off for a language.
+// opts are the FormattingOptions sent with each request.
+func (m *MultiLSPManager) SetFormatOnSave(language string, enabled bool, opts FormattingOptions) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if enabled {
+		m.formatOnSave[language] = opts
+	} else {
+		delete(m.formatOnSave, language)
+	}
+}
+
+// FormatOnSave reports whether the file at path is formatted before it is
+// saved, and with which options. That needs a running server advertising
+// document formatting.
+func (m *MultiLSPManager) FormatOnSave(path string) (FormattingOptions, bool) {
+	language := detectLanguageForLSP(path)
+
+	m.mu.RLock()
+	opts, enabled := m.formatOnSave[language]
+	lsp, exists := m.lspServers[language]
+	m.mu.RUnlock()
+
+	if !enabled || !exists {
+		return FormattingOptions{}, false
+	}
+	return opts, lsp.Capabilities().FormattingProvider()
+}
+
+// SetCodeActionsOnSave sets the code action kinds, such as
+// "source.organizeImports", applied in order before a file of language is
+// saved. An empty list turns them off.
+func (m *MultiLSPManager) SetCodeActionsOnSave(language string, kinds []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(kinds) > 0 {
+		m.actionsOnSave[language] = kinds
+	} else {
+		delete(m.actionsOnSave, language)
+	}
+}
+
+// CodeActionsOnSave returns the code action kinds to apply before the file
+// at path is saved, and whether the server resolves actions lazily. Nothing
+// is returned unless a running server offers code actions.
+func (m *MultiLSPManager) CodeActionsOnSave(path string) ([]string, bool) {
+	language := detectLanguageForLSP(path)
+
+	m.mu.RLock()
+	kinds := m.actionsOnSave[language]
+	lsp, exists := m.lspServers[language]
+	m.mu.RUnlock()
+
+	if len(kinds) == 0 || !exists {
+		return nil, false
+	}
+	supported, resolve := lsp.Capabilities().CodeActions()
+	if !supported {
+		return nil, false
+	}
+	return kinds, resolve
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Units a client can count text offsets in. Buffers are UTF-8 Go strings,
+// while CodeMirror and the LSP count UTF-16 code units.
+const (
+	OffsetUnitUTF16 = "utf16"
+	OffsetUnitUTF8  = "utf8"
+	OffsetUnitRune  = "rune"
+)
+
+// DefaultOffsetUnit is assumed when a message does not name its unit, since
+// that is what browsers count in
+const DefaultOffsetUnit = OffsetUnitUTF16
+
+// OffsetError reports an offset that does not fall on a character boundary
+// of the buffer, or lies outside it
+type OffsetError struct {
+	Offset int
+	Unit   string
+	Reason string
+}
+
+func (e *OffsetError) Error() string {
+	return fmt.Sprintf("invalid %s offset %d: %s", e.Unit, e.Offset, e.Reason)
+}
+
+// ByteOffset converts an offset counted in unit to a byte offset in content.
+// Offsets inside a UTF-8 sequence or between the halves of a UTF-16
+// surrogate pair are rejected rather than rounded.
+func ByteOffset(content string, offset int, unit string) (int, error) {
+	if offset < 0 {
+		return 0, &OffsetError{offset, unit, "negative"}
+	}
+
+	switch unit {
+	case OffsetUnitUTF8:
+		if offset > len(content) {
+			return 0, &OffsetError{offset, unit, "past the end of the document"}
+		}
+		if offset < len(content) && !utf8.RuneStart(content[offset]) {
+			return 0, &OffsetError{offset, unit, "inside a multi-byte character"}
+		}
+		return offset, nil
+
+	case OffsetUnitUTF16, OffsetUnitRune:
+		count := 0
+		for i, r := range content {
+			if count == offset {
+				return i, nil
+			}
+			width := runeWidth(r, unit)
+			if count+width > offset {
+				return 0, &OffsetError{offset, unit, "inside a surrogate pair"}
+			}
+			count += width
+		}
+		if count == offset {
+			return len(content), nil
+		}
+		return 0, &OffsetError{offset, unit, "past the end of the document"}
+	}
+
+	return 0, fmt.Errorf("unknown offset unit: %q", unit)
+}
+
+// OffsetInUnit converts a byte offset in content, which must fall on a
+// character boundary, to an offset counted in unit
+func OffsetInUnit(content string, byteOffset int, unit string) int {
+	if unit == OffsetUnitUTF8 {
+		return byteOffset
+	}
+
+	count := 0
+	for _, r := range content[:byteOffset] {
+		count += runeWidth(r, unit)
+	}
+	return count
+}
+
+// runeWidth is how many units of unit a character takes
+func runeWidth(r rune, unit string) int {
+	if unit == OffsetUnitUTF16 && r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestByteOffset(t *testing.T) {
+	// "a😀b": the emoji is 4 UTF-8 bytes, 2 UTF-16 code units and 1 rune
+	const doc = "a😀b"
+
+	tests := []struct {
+		name    string
+		content string
+		offset  int
+		unit    string
+		want    int
+		reason  string // set when an *OffsetError is expected
+	}{
+		{"utf16 start", doc, 0, OffsetUnitUTF16, 0, ""},
+		{"utf16 before emoji", doc, 1, OffsetUnitUTF16, 1, ""},
+		{"utf16 inside surrogate pair", doc, 2, OffsetUnitUTF16, 0, "inside a surrogate pair"},
+		{"utf16 after emoji", doc, 3, OffsetUnitUTF16, 5, ""},
+		{"utf16 end", doc, 4, OffsetUnitUTF16, 6, ""},
+		{"utf16 past end", doc, 5, OffsetUnitUTF16, 0, "past the end of the document"},
+		{"utf16 negative", doc, -1, OffsetUnitUTF16, 0, "negative"},
+
+		{"rune after emoji", doc, 2, OffsetUnitRune, 5, ""},
+		{"rune end", doc, 3, OffsetUnitRune, 6, ""},
+		{"rune past end", doc, 4, OffsetUnitRune, 0, "past the end of the document"},
+
+		{"utf8 inside emoji", doc, 2, OffsetUnitUTF8, 0, "inside a multi-byte character"},
+		{"utf8 after emoji", doc, 5, OffsetUnitUTF8, 5, ""},
+		{"utf8 end", doc, 6, OffsetUnitUTF8, 6, ""},
+		{"utf8 past end", doc, 7, OffsetUnitUTF8, 0, "past the end of the document"},
+
+		{"emoji only, inside pair", "😀", 1, OffsetUnitUTF16, 0, "inside a surrogate pair"},
+		{"emoji only, end", "😀", 2, OffsetUnitUTF16, 4, ""},
+		{"empty end", "", 0, OffsetUnitUTF16, 0, ""},
+		{"empty past end", "", 1, OffsetUnitUTF16, 0, "past the end of the document"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths := map[string]func() (int, error){
+				"string": func() (int, error) { return ByteOffset(tt.content, tt.offset, tt.unit) },
+				"rope":   func() (int, error) { return NewRope(tt.content).ByteOffset(tt.offset, tt.unit) },
+			}
+			for path, byteOffset := range paths {
+				got, err := byteOffset()
+				if tt.reason != "" {
+					var oe *OffsetError
+					if !errors.As(err, &oe) {
+						t.Fatalf("%s: got %d, %v; want OffsetError %q", path, got, err, tt.reason)
+					}
+					if oe.Offset != tt.offset || oe.Unit != tt.unit || oe.Reason != tt.reason {
+						t.Errorf("%s: got %+v; want offset %d, unit %s, reason %q", path, *oe, tt.offset, tt.unit, tt.reason)
+					}
+					continue
+				}
+				if err != nil || got != tt.want {
+					t.Errorf("%s: got %d, %v; want %d", path, got, err, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestByteOffsetUnknownUnit(t *testing.T) {
+	if _, err := ByteOffset("abc", 1, "bytes"); err == nil {
+		t.Error("string: want an error for an unknown unit")
+	}
+	if _, err := NewRope("abc").ByteOffset(1, "bytes"); err == nil {
+		t.Error("rope: want an error for an unknown unit")
+	}
+}
+
+func TestOffsetInUnit(t *testing.T) {
+	const doc = "a😀b"
+
+	tests := []struct {
+		byteOffset        int
+		utf16, utf8, rune int
+	}{
+		{0, 0, 0, 0},
+		{1, 1, 1, 1},
+		{5, 3, 5, 2},
+		{6, 4, 6, 3},
+	}
+
+	for _, tt := range tests {
+		want := map[string]int{OffsetUnitUTF16: tt.utf16, OffsetUnitUTF8: tt.utf8, OffsetUnitRune: tt.rune}
+		for unit, w := range want {
+			if got := OffsetInUnit(doc, tt.byteOffset, unit); got != w {
+				t.Errorf("string: byte %d in %s = %d; want %d", tt.byteOffset, unit, got, w)
+			}
+			if got := NewRope(doc).OffsetInUnit(tt.byteOffset, unit); got != w {
+				t.Errorf("rope: byte %d in %s = %d; want %d", tt.byteOffset, unit, got, w)
+			}
+		}
+	}
+}
+
+// TestRopeOffsetsAcrossLeaves checks every offset of a document long enough
+// to span many leaves, with emoji straddling the chunk boundaries, against
+// the string path
+func TestRopeOffsetsAcrossLeaves(t *testing.T) {
+	content := strings.Repeat("ab😀\n", 700)
+	rope := NewRope(content)
+	// Edits leave small leaves behind, cut at other places
+	for _, runes := range []int{1, 600, 1200, 1800} {
+		at, err := ByteOffset(content, runes, OffsetUnitRune)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rope = rope.Replace(at, at, "é")
+		content = content[:at] + "é" + content[at:]
+	}
+	if rope.String() != content {
+		t.Fatal("rope and string differ after the edits")
+	}
+
+	for _, unit := range []string{OffsetUnitUTF16, OffsetUnitUTF8, OffsetUnitRune} {
+		end := OffsetInUnit(content, len(content), unit)
+		for offset := 0; offset <= end+1; offset++ {
+			want, wantErr := ByteOffset(content, offset, unit)
+			got, err := rope.ByteOffset(offset, unit)
+			if got != want || (err == nil) != (wantErr == nil) {
+				t.Fatalf("%s offset %d: rope %d, %v; string %d, %v", unit, offset, got, err, want, wantErr)
+			}
+			if err == nil && rope.OffsetInUnit(got, unit) != offset {
+				t.Fatalf("%s offset %d: round trip gave %d", unit, offset, rope.OffsetInUnit(got, unit))
+			}
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// ReplacePreviewPayload is a search, with the text each match is replaced
+// by. In regex mode Replacement may refer to capture groups as $1 or ${name}.
+type ReplacePreviewPayload struct {
+	SearchPayload
+	Replacement string `json:"replacement"`
+}
+
+// ReplaceEdit is one replacement; OldText is the text it replaces
+type ReplaceEdit struct {
+	Range   Range  `json:"range"`
+	NewText string `json:"newText"`
+	OldText string `json:"oldText"`
+}
+
+// ReplaceFilePreview lists the replacements in one file. Checksum is the
+// ContentChecksum of the text they were computed against, so applying them
+// can tell if the file changed in between.
+type ReplaceFilePreview struct {
+	Path     string        `json:"path"`
+	URI      string        `json:"uri"`
+	Checksum string        `json:"checksum"`
+	Edits    []ReplaceEdit `json:"edits"`
+}
+
+// ReplaceApplyPayload carries the previewed edits the user kept, per file
+type ReplaceApplyPayload struct {
+	ID    int                `json:"id"`
+	Files []ReplaceApplyFile `json:"files"`
+}
+
+type ReplaceApplyFile struct {
+	Path     string     `json:"path"`
+	Checksum string     `json:"checksum"`
+	Edits    []TextEdit `json:"edits"`
+}
+
+// replaceText computes the replacement of up to limit matches in content.
+// Matches whose replacement leaves them unchanged are skipped.
+func (q *searchQuery) replaceText(content, replacement string, expand bool, limit int) []ReplaceEdit {
+	var edits []ReplaceEdit
+	var text *Rope // built lazily, only for files with matches
+
+	for _, m := range q.re.FindAllStringSubmatchIndex(content, -1) {
+		if len(edits) == limit {
+			break
+		}
+		newText := replacement
+		if expand {
+			newText = string(q.re.ExpandString(nil, replacement, content, m))
+		}
+		oldText := content[m[0]:m[1]]
+		if newText == oldText {
+			continue
+		}
+
+		if text == nil {
+			text = NewRope(content)
+		}
+		edits = append(edits, ReplaceEdit{
+			Range:   Range{Start: text.PositionAt(m[0]), End: text.PositionAt(m[1])},
+			NewText: newText,
+			OldText: oldText,
+		})
+	}
+	return edits
+}
+
+// runReplacePreview computes the replacements across the workspace and
+// sends them in one replace_preview_result
+func (s *session) runReplacePreview(ctx context.Context, payload ReplacePreviewPayload, q *searchQuery) {
+	var files []ReplaceFilePreview
+	total := 0
+	truncated := false
+
+	err := s.walkSearch(ctx, q, func(path, content string) bool {
+		edits := q.replaceText(content, payload.Replacement, payload.Regex, q.maxMatches-total)
+		if len(edits) > 0 {
+			total += len(edits)
+			files = append(files, ReplaceFilePreview{
+				Path:     path,
+				URI:      pathToURI(path),
+				Checksum: ContentChecksum(content),
+				Edits:    edits,
+			})
+		}
+		if total >= q.maxMatches {
+			truncated = true
+			return false
+		}
+		return true
+	})
+
+	result := map[string]interface{}{
+		"id":        payload.ID,
+		"files":     files,
+		"edits":     total,
+		"truncated": truncated,
+		"cancelled": ctx.Err() != nil,
+	}
+	if err != nil && ctx.Err() == nil {
+		result["error"] = err.Error()
+	}
+	s.send("replace_preview_result", result)
+}
+
+func (s *session) handleReplacePreview(raw json.RawMessage) {
+	var payload ReplacePreviewPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid replace_preview payload")
+		return
+	}
+
+	q, err := compileSearch(payload.SearchPayload)
+	if err != nil {
+		s.send("replace_preview_result", map[string]interface{}{
+			"id":    payload.ID,
+			"error": "Invalid search: " + err.Error(),
+		})
+		return
+	}
+
+	s.startSearch(payload.ID, func(ctx context.Context) {
+		s.runReplacePreview(ctx, payload, q)
+	})
+}
+
+// pendingReplace is one file of a replace_apply, checked and ready to write
+type pendingReplace struct {
+	path, uri     string
+	checksum      string
+	edits         []TextEdit
+	open          bool
+	dirty         bool // the open buffer already had unsaved edits
+	before, after string
+	format        TextFormat
+	stamp         DiskStamp // of a closed file when it was read
+}
+
+// handleReplaceApply writes previewed replacements. Nothing is changed
+// unless every file still has the text the preview saw. Closed files are
+// rewritten on disk, and restored if a later write fails; the LSP servers
+// watching them are told once all are written. Open buffers are edited
+// through the store and, if they had no unsaved edits, saved.
+func (s *session) handleReplaceApply(raw json.RawMessage) {
+	var payload ReplaceApplyPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid replace_apply payload")
+		return
+	}
+
+	pending, err := s.prepareReplace(payload.Files)
+	if err != nil {
+		s.sendError("Replace failed: " + err.Error())
+		return
+	}
+
+	var onDisk []*pendingReplace
+	var buffers []BufferEdits
+	var open []*pendingReplace
+	for _, p := range pending {
+		if p.open {
+			open = append(open, p)
+			buffers = append(buffers, BufferEdits{URI: p.uri, Checksum: p.checksum, Edits: p.edits})
+			continue
+		}
+		// The file may have changed since prepareReplace read it
+		if current, _, err := ReadDiskStamp(p.path); err != nil || !current.Same(p.stamp) {
+			if err == nil {
+				err = ErrDiskConflict
+			}
+			rollbackReplace(onDisk)
+			s.sendError(fmt.Sprintf("Replace failed: %s: %v", p.path, err))
+			return
+		}
+		if err := s.localHistory.Record(p.path, p.before, p.format, snapshotBeforeReplace); err != nil {
+			log.Printf("Warning: Failed to snapshot %s before replacing: %v", p.path, err)
+		}
+		if err := writeReplace(p.path, p.after, p.format); err != nil {
+			rollbackReplace(onDisk)
+			s.sendError(fmt.Sprintf("Replace failed: %s: %v", p.path, err))
+			return
+		}
+		onDisk = append(onDisk, p)
+	}
+
+	snapshots, err := s.store.ApplyBufferEdits(buffers)
+	if err != nil {
+		rollbackReplace(onDisk)
+		s.sendError("Replace failed: " + err.Error())
+		return
+	}
+
+	var saved, unsaved []string
+	var events []FileEvent
+	for _, p := range onDisk {
+		saved = append(saved, p.path)
+		events = append(events, FileEvent{Path: p.path, Type: FileChanged})
+	}
+	if len(events) > 0 {
+		s.lspManager.NotifyFileEvents(events)
+	}
+	for i, p := range open {
+		if p.dirty {
+			unsaved = append(unsaved, p.path)
+			continue
+		}
+		snapshot := snapshots[i]
+		if err := s.writeFile(p.path, p.uri, snapshot.Content, snapshot.Version, snapshot.Format, nil); err != nil {
+			log.Printf("Failed to save %s after replacing: %v", p.path, err)
+			unsaved = append(unsaved, p.path)
+			continue
+		}
+		saved = append(saved, p.path)
+	}
+
+	s.send("replace_applied", map[string]interface{}{
+		"id":      payload.ID,
+		"saved":   saved,
+		"unsaved": unsaved,
+	})
+}
+
+// prepareReplace resolves every file of a replace_apply and computes its new
+// text, failing if any file changed since the preview
+func (s *session) prepareReplace(files []ReplaceApplyFile) ([]*pendingReplace, error) {
+	var pending []*pendingReplace
+	seen := make(map[string]bool)
+
+	for _, f := range files {
+		path, err := s.workspace.Resolve(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		if seen[path] {
+			return nil, fmt.Errorf("%s is listed twice", path)
+		}
+		seen[path] = true
+
+		p := &pendingReplace{
+			path:     path,
+			uri:      pathToURI(path),
+			checksum: f.Checksum,
+			edits:    f.Edits,
+		}
+		if snapshot, open := s.store.Snapshot(p.uri); open {
+			p.open = true
+			p.dirty = snapshot.Dirty
+			p.before = snapshot.Content
+			p.format = snapshot.Format
+		} else {
+			stamp, content, format, err := ReadDiskText(path)
+			if err != nil {
+				return nil, err
+			}
+			if stamp.Missing {
+				return nil, fmt.Errorf("%s no longer exists", path)
+			}
+			p.before = content
+			p.format = format
+			p.stamp = stamp
+		}
+
+		if ContentChecksum(p.before) != f.Checksum {
+			return nil, fmt.Errorf("%s changed since the preview", path)
+		}
+		if p.after, err = ApplyTextEdits(p.before, f.Edits); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		pending = append(pending, p)
+	}
+	return pending, nil
+}
+
+func writeReplace(path, content string, format TextFormat) error {
+	data, err := EncodeText(content, format)
+	if err != nil {
+		return err
+	}
+	return WriteFile(path, string(data))
+}
+
+// rollbackReplace puts back the original text of files already rewritten
+func rollbackReplace(written []*pendingReplace) {
+	for _, p := range written {
+		if err := writeReplace(p.path, p.before, p.format); err != nil {
+			log.Printf("Failed to restore %s after a failed replace: %v", p.path, err)
+		}
+	}
+}
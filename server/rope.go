@@ -0,0 +1,423 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ropeChunkSize is the largest leaf a rope builds. Small leaves left behind
+// by edits are merged back up to this size.
+const ropeChunkSize = 1024
+
+// Rope is an immutable text buffer: a height-balanced tree of UTF-8 chunks,
+// each node caching the byte, UTF-16, rune and newline counts below it.
+// Edits are O(log n) and return a new Rope sharing all untouched nodes with
+// the old one, so holding on to an old version is a free snapshot.
+// Offsets are bytes and must fall on character boundaries.
+type Rope struct {
+	root *ropeNode
+}
+
+type ropeNode struct {
+	left, right *ropeNode
+	leaf        string // text of a leaf; branches have none
+	height      int    // 0 for leaves
+
+	bytes, utf16, runes, newlines int
+}
+
+// NewRope builds a rope holding text
+func NewRope(text string) *Rope {
+	return &Rope{root: buildRope(text)}
+}
+
+// Len returns the length of the text in bytes
+func (r *Rope) Len() int {
+	if r.root == nil {
+		return 0
+	}
+	return r.root.bytes
+}
+
+// LineCount returns the number of lines; text without a newline is one line
+func (r *Rope) LineCount() int {
+	if r.root == nil {
+		return 1
+	}
+	return r.root.newlines + 1
+}
+
+// String returns the whole text
+func (r *Rope) String() string {
+	var sb strings.Builder
+	sb.Grow(r.Len())
+	r.walk(0, func(chunk string) bool {
+		sb.WriteString(chunk)
+		return true
+	})
+	return sb.String()
+}
+
+// Slice returns the text between two byte offsets
+func (r *Rope) Slice(from, to int) string {
+	var sb strings.Builder
+	sb.Grow(to - from)
+	pos := from
+	r.walk(from, func(chunk string) bool {
+		if pos+len(chunk) >= to {
+			sb.WriteString(chunk[:to-pos])
+			return false
+		}
+		sb.WriteString(chunk)
+		pos += len(chunk)
+		return true
+	})
+	return sb.String()
+}
+
+// Replace returns a rope with the bytes between from and to replaced by text
+func (r *Rope) Replace(from, to int, text string) *Rope {
+	left, rest := splitRope(r.root, from)
+	_, right := splitRope(rest, to-from)
+	return &Rope{root: joinRope(joinRope(left, buildRope(text)), right)}
+}
+
+// ByteOffset converts an offset counted in unit to a byte offset, with the
+// same rules as the package-level ByteOffset
+func (r *Rope) ByteOffset(offset int, unit string) (int, error) {
+	if offset < 0 {
+		return 0, &OffsetError{offset, unit, "negative"}
+	}
+
+	switch unit {
+	case OffsetUnitUTF8:
+		if offset > r.Len() {
+			return 0, &OffsetError{offset, unit, "past the end of the document"}
+		}
+		if offset < r.Len() && !utf8.RuneStart(r.byteAt(offset)) {
+			return 0, &OffsetError{offset, unit, "inside a multi-byte character"}
+		}
+		return offset, nil
+	case OffsetUnitUTF16, OffsetUnitRune:
+	default:
+		return 0, fmt.Errorf("unknown offset unit: %q", unit)
+	}
+
+	n := r.root
+	base, remaining := 0, offset
+	for n != nil && n.left != nil {
+		if count := n.left.count(unit); remaining < count {
+			n = n.left
+		} else {
+			base += n.left.bytes
+			remaining -= count
+			n = n.right
+		}
+	}
+
+	leaf := ""
+	if n != nil {
+		leaf = n.leaf
+	}
+	at, err := ByteOffset(leaf, remaining, unit)
+	if err != nil {
+		// Report the offset the caller passed, not the one within the leaf
+		reason := "past the end of the document"
+		if oe, ok := err.(*OffsetError); ok {
+			reason = oe.Reason
+		}
+		return 0, &OffsetError{offset, unit, reason}
+	}
+	return base + at, nil
+}
+
+// OffsetInUnit converts a byte offset to an offset counted in unit
+func (r *Rope) OffsetInUnit(byteOffset int, unit string) int {
+	if unit == OffsetUnitUTF8 {
+		return byteOffset
+	}
+
+	count := 0
+	n := r.root
+	for n != nil && n.left != nil {
+		if byteOffset < n.left.bytes {
+			n = n.left
+		} else {
+			count += n.left.count(unit)
+			byteOffset -= n.left.bytes
+			n = n.right
+		}
+	}
+	if n == nil {
+		return count
+	}
+	return count + OffsetInUnit(n.leaf, byteOffset, unit)
+}
+
+// LineStart returns the byte offset where a zero-based line starts, or the
+// end of the text for lines past the last one
+func (r *Rope) LineStart(line int) int {
+	if line <= 0 {
+		return 0
+	}
+	if line > r.LineCount()-1 {
+		return r.Len()
+	}
+
+	// Find the line-th newline; the line starts just after it
+	offset := 0
+	n := r.root
+	for n.left != nil {
+		if line <= n.left.newlines {
+			n = n.left
+		} else {
+			line -= n.left.newlines
+			offset += n.left.bytes
+			n = n.right
+		}
+	}
+	for i := 0; i < len(n.leaf); i++ {
+		if n.leaf[i] == '\n' {
+			line--
+			if line == 0 {
+				return offset + i + 1
+			}
+		}
+	}
+	return r.Len()
+}
+
+// LineAt returns the zero-based line a byte offset is on
+func (r *Rope) LineAt(byteOffset int) int {
+	line := 0
+	n := r.root
+	for n != nil && n.left != nil {
+		if byteOffset < n.left.bytes {
+			n = n.left
+		} else {
+			line += n.left.newlines
+			byteOffset -= n.left.bytes
+			n = n.right
+		}
+	}
+	if n == nil {
+		return line
+	}
+	return line + strings.Count(n.leaf[:byteOffset], "\n")
+}
+
+// PositionAt converts a byte offset to an LSP position
+func (r *Rope) PositionAt(byteOffset int) Position {
+	line := r.LineAt(byteOffset)
+	start := r.LineStart(line)
+	return Position{
+		Line:      line,
+		Character: r.OffsetInUnit(byteOffset, OffsetUnitUTF16) - r.OffsetInUnit(start, OffsetUnitUTF16),
+	}
+}
+
+// OffsetForPosition converts an LSP position to a byte offset. Positions
+// past the end of a line or of the document are clamped, as the LSP
+// specification asks.
+func (r *Rope) OffsetForPosition(pos Position) int {
+	if pos.Line > r.LineCount()-1 {
+		return r.Len()
+	}
+	offset := r.LineStart(pos.Line)
+
+	units := 0
+	r.walk(offset, func(chunk string) bool {
+		for i, c := range chunk {
+			if c == '\n' || units >= pos.Character {
+				offset += i
+				return false
+			}
+			units += runeWidth(c, OffsetUnitUTF16)
+		}
+		offset += len(chunk)
+		return true
+	})
+	return offset
+}
+
+// walk calls fn with the text from byte offset from onwards, one chunk at a
+// time, until fn returns false
+func (r *Rope) walk(from int, fn func(chunk string) bool) {
+	walkRope(r.root, from, fn)
+}
+
+func walkRope(n *ropeNode, from int, fn func(chunk string) bool) bool {
+	if n == nil || from >= n.bytes {
+		return true
+	}
+	if n.left == nil {
+		return fn(n.leaf[from:])
+	}
+	if from < n.left.bytes {
+		if !walkRope(n.left, from, fn) {
+			return false
+		}
+		return walkRope(n.right, 0, fn)
+	}
+	return walkRope(n.right, from-n.left.bytes, fn)
+}
+
+// byteAt returns the byte at an offset inside the text
+func (r *Rope) byteAt(offset int) byte {
+	var b byte
+	r.walk(offset, func(chunk string) bool {
+		b = chunk[0]
+		return false
+	})
+	return b
+}
+
+func (n *ropeNode) count(unit string) int {
+	switch unit {
+	case OffsetUnitUTF16:
+		return n.utf16
+	case OffsetUnitRune:
+		return n.runes
+	}
+	return n.bytes
+}
+
+func newRopeLeaf(text string) *ropeNode {
+	n := &ropeNode{leaf: text, bytes: len(text)}
+	for _, c := range text {
+		n.runes++
+		n.utf16 += runeWidth(c, OffsetUnitUTF16)
+		if c == '\n' {
+			n.newlines++
+		}
+	}
+	return n
+}
+
+func newRopeBranch(left, right *ropeNode) *ropeNode {
+	height := left.height
+	if right.height > height {
+		height = right.height
+	}
+	return &ropeNode{
+		left:     left,
+		right:    right,
+		height:   height + 1,
+		bytes:    left.bytes + right.bytes,
+		utf16:    left.utf16 + right.utf16,
+		runes:    left.runes + right.runes,
+		newlines: left.newlines + right.newlines,
+	}
+}
+
+// buildRope makes a balanced tree of chunks cut at character boundaries
+func buildRope(text string) *ropeNode {
+	if text == "" {
+		return nil
+	}
+
+	var leaves []*ropeNode
+	for len(text) > ropeChunkSize {
+		cut := ropeChunkSize
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			// A run of continuation bytes longer than a chunk is not UTF-8
+			// anyway; cut it anywhere
+			cut = ropeChunkSize
+		}
+		leaves = append(leaves, newRopeLeaf(text[:cut]))
+		text = text[cut:]
+	}
+	leaves = append(leaves, newRopeLeaf(text))
+	return buildBalanced(leaves)
+}
+
+func buildBalanced(leaves []*ropeNode) *ropeNode {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	mid := len(leaves) / 2
+	return newRopeBranch(buildBalanced(leaves[:mid]), buildBalanced(leaves[mid:]))
+}
+
+// splitRope cuts a tree at a byte offset
+func splitRope(n *ropeNode, at int) (*ropeNode, *ropeNode) {
+	if n == nil {
+		return nil, nil
+	}
+	if at <= 0 {
+		return nil, n
+	}
+	if at >= n.bytes {
+		return n, nil
+	}
+	if n.left == nil {
+		return newRopeLeaf(n.leaf[:at]), newRopeLeaf(n.leaf[at:])
+	}
+
+	switch {
+	case at < n.left.bytes:
+		left, right := splitRope(n.left, at)
+		return left, joinRope(right, n.right)
+	case at == n.left.bytes:
+		return n.left, n.right
+	default:
+		left, right := splitRope(n.right, at-n.left.bytes)
+		return joinRope(n.left, left), right
+	}
+}
+
+// joinRope concatenates two trees, keeping them height-balanced in
+// O(height difference) and merging small neighbouring leaves
+func joinRope(left, right *ropeNode) *ropeNode {
+	if left == nil {
+		return right
+	}
+	if right == nil {
+		return left
+	}
+	if left.left == nil && right.left == nil && left.bytes+right.bytes <= ropeChunkSize {
+		return newRopeLeaf(left.leaf + right.leaf)
+	}
+
+	switch {
+	case left.height > right.height+1:
+		return rebalanceRope(newRopeBranch(left.left, joinRope(left.right, right)))
+	case right.height > left.height+1:
+		return rebalanceRope(newRopeBranch(joinRope(left, right.left), right.right))
+	}
+	return newRopeBranch(left, right)
+}
+
+// rebalanceRope restores the height balance of a branch whose children
+// differ in height by at most two
+func rebalanceRope(n *ropeNode) *ropeNode {
+	switch {
+	case n.left.height > n.right.height+1:
+		l := n.left
+		if l.left.height < l.right.height {
+			l = rotateRopeLeft(l)
+		}
+		return rotateRopeRight(newRopeBranch(l, n.right))
+	case n.right.height > n.left.height+1:
+		r := n.right
+		if r.right.height < r.left.height {
+			r = rotateRopeRight(r)
+		}
+		return rotateRopeLeft(newRopeBranch(n.left, r))
+	}
+	return n
+}
+
+func rotateRopeLeft(n *ropeNode) *ropeNode {
+	r := n.right
+	return newRopeBranch(newRopeBranch(n.left, r.left), r.right)
+}
+
+func rotateRopeRight(n *ropeNode) *ropeNode {
+	l := n.left
+	return newRopeBranch(l.left, newRopeBranch(l.right, n.right))
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// applyDeltaString edits a flat string, as buffers did before the rope:
+// every keystroke scans the text up to the edit and copies all of it
+func applyDeltaString(content string, fromPos, toPos int, unit, insert string) (string, error) {
+	from, err := ByteOffset(content, fromPos, unit)
+	if err != nil {
+		return "", err
+	}
+	to, err := ByteOffset(content, toPos, unit)
+	if err != nil {
+		return "", err
+	}
+	return content[:from] + insert + content[to:], nil
+}
+
+// stringPosition is the reference for Rope.PositionAt: it scans content from
+// the start
+func stringPosition(content string, byteOffset int) Position {
+	before := content[:byteOffset]
+	start := strings.LastIndexByte(before, '\n') + 1
+	return Position{
+		Line:      strings.Count(before, "\n"),
+		Character: OffsetInUnit(before[start:], len(before)-start, OffsetUnitUTF16),
+	}
+}
+
+// stringOffsetForPosition is the reference for Rope.OffsetForPosition,
+// clamping to the end of the line and of the document
+func stringOffsetForPosition(content string, pos Position) int {
+	lines := strings.SplitAfter(content, "\n")
+	if pos.Line >= len(lines) {
+		return len(content)
+	}
+	offset := 0
+	for _, line := range lines[:pos.Line] {
+		offset += len(line)
+	}
+	line := strings.TrimSuffix(lines[pos.Line], "\n")
+	units := 0
+	for i, c := range line {
+		if units >= pos.Character {
+			return offset + i
+		}
+		units += runeWidth(c, OffsetUnitUTF16)
+	}
+	return offset + len(line)
+}
+
+// ropeTestDocuments span several leaves, with multibyte characters across the
+// chunk boundaries and lines of every length
+func ropeTestDocuments() map[string]string {
+	var varied strings.Builder
+	for i := 0; i < 400; i++ {
+		varied.WriteString(strings.Repeat("é😀x", i%13))
+		varied.WriteByte('\n')
+	}
+	return map[string]string{
+		"empty":             "",
+		"one line":          "héllo 😀",
+		"trailing newline":  "a\nb\n",
+		"only newlines":     strings.Repeat("\n", 3000),
+		"varied lines":      varied.String(),
+		"long line":         strings.Repeat("ab😀é", 2000) + "\nend",
+		"newline per chunk": strings.Repeat(strings.Repeat("é", 511)+"\n", 8),
+	}
+}
+
+// editedRope builds the rope for content through edits, so it has leaves of
+// other sizes than a freshly built one
+func editedRope(content string) *Rope {
+	rope := NewRope("")
+	for len(content) > 0 {
+		n := 700
+		if n > len(content) {
+			n = len(content)
+		}
+		for n < len(content) && !utf8.RuneStart(content[n]) {
+			n++
+		}
+		rope = rope.Replace(rope.Len(), rope.Len(), content[:n])
+		content = content[n:]
+	}
+	return rope
+}
+
+func TestRopeLines(t *testing.T) {
+	for name, content := range ropeTestDocuments() {
+		t.Run(name, func(t *testing.T) {
+			for kind, rope := range map[string]*Rope{"built": NewRope(content), "edited": editedRope(content)} {
+				if rope.String() != content {
+					t.Fatalf("%s: rope holds other text", kind)
+				}
+				lines := strings.Split(content, "\n")
+				if got := rope.LineCount(); got != len(lines) {
+					t.Errorf("%s: LineCount = %d; want %d", kind, got, len(lines))
+				}
+
+				start := 0
+				for line, text := range lines {
+					if got := rope.LineStart(line); got != start {
+						t.Fatalf("%s: LineStart(%d) = %d; want %d", kind, line, got, start)
+					}
+					start += len(text) + 1
+				}
+				if got := rope.LineStart(len(lines)); got != len(content) {
+					t.Errorf("%s: LineStart past the last line = %d; want %d", kind, got, len(content))
+				}
+				if got := rope.LineStart(-1); got != 0 {
+					t.Errorf("%s: LineStart(-1) = %d; want 0", kind, got)
+				}
+
+				for offset := 0; offset <= len(content); offset++ {
+					if offset < len(content) && !utf8.RuneStart(content[offset]) {
+						continue
+					}
+					want := stringPosition(content, offset)
+					if got := rope.LineAt(offset); got != want.Line {
+						t.Fatalf("%s: LineAt(%d) = %d; want %d", kind, offset, got, want.Line)
+					}
+					if got := rope.PositionAt(offset); got != want {
+						t.Fatalf("%s: PositionAt(%d) = %+v; want %+v", kind, offset, got, want)
+					}
+					if got := rope.OffsetForPosition(want); got != offset {
+						t.Fatalf("%s: OffsetForPosition(%+v) = %d; want %d", kind, want, got, offset)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRopeOffsetForPositionClamps(t *testing.T) {
+	for name, content := range ropeTestDocuments() {
+		rope := editedRope(content)
+		lines := rope.LineCount()
+		for _, pos := range []Position{
+			{Line: 0, Character: 1 << 20},
+			{Line: lines / 2, Character: 1 << 20},
+			{Line: lines - 1, Character: 1 << 20},
+			{Line: lines, Character: 0},
+			{Line: lines + 5, Character: 3},
+		} {
+			want := stringOffsetForPosition(content, pos)
+			if got := rope.OffsetForPosition(pos); got != want {
+				t.Errorf("%s: OffsetForPosition(%+v) = %d; want %d", name, pos, got, want)
+			}
+		}
+	}
+}
+
+func TestNewRopeInvalidUTF8(t *testing.T) {
+	tests := map[string]string{
+		"continuation bytes": strings.Repeat("\x80", ropeChunkSize*3+5),
+		"after text":         "abc" + strings.Repeat("\xbf", ropeChunkSize*2),
+		"truncated emoji":    strings.Repeat("\xf0\x9f\x98", ropeChunkSize),
+	}
+	for name, content := range tests {
+		if got := NewRope(content).String(); got != content {
+			t.Errorf("%s: rope holds other text", name)
+		}
+	}
+}
+
+// benchmarkDocuments are typed into at their middle, as an editor would
+var benchmarkDocuments = []struct {
+	name    string
+	content string
+}{
+	{"Small", strings.Repeat("func main() { fmt.Println(\"héllo 😀\") }\n", 100)},    // about 4 KB
+	{"Large", strings.Repeat("func main() { fmt.Println(\"héllo 😀\") }\n", 100000)}, // about 4 MB
+}
+
+func BenchmarkApplyDeltaString(b *testing.B) {
+	for _, doc := range benchmarkDocuments {
+		b.Run(doc.name, func(b *testing.B) {
+			content := doc.content
+			at := OffsetInUnit(content, middleLine(content), OffsetUnitUTF16)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				next, err := applyDeltaString(content, at, at, OffsetUnitUTF16, "x")
+				if err != nil {
+					b.Fatal(err)
+				}
+				content = next
+				at++
+			}
+		})
+	}
+}
+
+func BenchmarkApplyDeltaRope(b *testing.B) {
+	for _, doc := range benchmarkDocuments {
+		b.Run(doc.name, func(b *testing.B) {
+			text := NewRope(doc.content)
+			at := text.OffsetInUnit(middleLine(doc.content), OffsetUnitUTF16)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				from, to, err := resolveDelta(text, at, at, OffsetUnitUTF16)
+				if err != nil {
+					b.Fatal(err)
+				}
+				text = text.Replace(from, to, "x")
+				at++
+			}
+		})
+	}
+}
+
+// middleLine returns the byte offset of the line in the middle of content
+func middleLine(content string) int {
+	return strings.LastIndexByte(content[:len(content)/2], '\n') + 1
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// Save modes
+const (
+	saveModeContent = "content"
+	saveModeBuffer  = "buffer"
+)
+
+// handleSave checks a save request and queues it with the store. Code
+// actions and formatting wait on the LSP, so the save runs in the
+// background rather than holding up the connection's other messages, after
+// any earlier save of the same document.
+func (s *session) handleSave(raw json.RawMessage) {
+	var payload SavePayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid save payload")
+		return
+	}
+
+	path, err := s.workspace.Resolve(payload.Path)
+	if err != nil {
+		s.sendError("Failed to save file: " + err.Error())
+		return
+	}
+	uri := pathToURI(path)
+
+	switch payload.Mode {
+	case "", saveModeContent:
+	case saveModeBuffer:
+		// The client proves it has the same text now, before edits it sends
+		// after the save request are applied
+		snapshot, ok := s.store.Snapshot(uri)
+		if !ok {
+			s.sendError("Failed to save file: " + ErrDocumentNotOpen.Error())
+			return
+		}
+		if ContentChecksum(snapshot.Content) != payload.Checksum {
+			log.Printf("Save of %s refused: client checksum %s does not match buffer", path, payload.Checksum)
+			s.sendError("Save refused: editor and server buffers differ; resynchronizing")
+			s.send("document_resync", snapshot)
+			return
+		}
+	default:
+		s.sendError("Unknown save mode: " + payload.Mode)
+		return
+	}
+
+	s.store.QueueSave(uri, func() {
+		s.save(path, uri, payload)
+	})
+}
+
+// save runs a save request checked by handleSave
+func (s *session) save(path, uri string, payload SavePayload) {
+	content := payload.Content
+	version := 0
+	format := DefaultTextFormat
+
+	if payload.Mode == saveModeBuffer {
+		// Write what the server holds, so the LSP and the file on disk
+		// cannot disagree. That includes edits that arrived after the save
+		// request; file_saved reports the version written.
+		snapshot, ok := s.store.Snapshot(uri)
+		if !ok {
+			s.sendError("Failed to save file: " + ErrDocumentNotOpen.Error())
+			return
+		}
+		content = snapshot.Content
+		version = snapshot.Version
+		format = snapshot.Format
+	} else {
+		// Keep the format of an open document, or of the file being replaced
+		if snapshot, ok := s.store.Snapshot(uri); ok {
+			format = snapshot.Format
+		} else if stamp, _, diskFormat, err := ReadDiskText(path); err == nil && !stamp.Missing {
+			format = diskFormat
+		}
+	}
+
+	// Refuse to clobber changes made on disk since the file was read, unless
+	// the client has seen them and chose to overwrite (or merged them)
+	if !payload.Force {
+		if known, ok := s.store.DiskStamp(uri); ok {
+			current, diskContent, _, err := ReadDiskText(path)
+			if err != nil {
+				s.sendError("Failed to save file: " + err.Error())
+				return
+			}
+			if !current.Same(known) {
+				s.send("save_conflict", map[string]interface{}{
+					"path":        path,
+					"uri":         uri,
+					"content":     content,
+					"diskContent": diskContent,
+					"diskDeleted": current.Missing,
+					"disk":        current,
+				})
+				return
+			}
+		}
+	}
+
+	// Run code actions, formatting and the EditorConfig rules on the text
+	// about to be written. If it is the open buffer they edit that, so the
+	// edits reach the clients and the LSP as well as the file.
+	config := LoadEditorConfig(path)
+	if snapshot, open := s.store.Snapshot(uri); open && snapshot.Content == content {
+		if !payload.NoFormat {
+			snapshot = s.beforeSave(path, snapshot, config)
+		}
+		snapshot = s.applyEditorConfig(snapshot, config)
+		content, version, format = snapshot.Content, snapshot.Version, snapshot.Format
+	} else {
+		if normalized, err := ApplyTextEdits(content, config.NormalizeEdits(content)); err == nil {
+			content = normalized
+		}
+		format = config.TextFormat(format)
+	}
+
+	if err := s.writeFile(path, uri, content, version, format, s); err != nil {
+		s.sendError("Failed to save file: " + err.Error())
+		return
+	}
+
+	s.send("file_saved", map[string]interface{}{
+		"success": true,
+		"path":    path,
+		"uri":     uri,
+		"version": version,
+	})
+}
+
+// beforeSave applies the code actions on save and then the formatting
+// configured for path to its open buffer, and returns the buffer afterwards.
+// The EditorConfig indentation settings override the formatting options.
+func (s *session) beforeSave(path string, snapshot DocumentSnapshot, config EditorConfig) DocumentSnapshot {
+	if kinds, resolve := s.lspManager.CodeActionsOnSave(path); len(kinds) > 0 {
+		if touched := s.runCodeActionsOnSave(snapshot.URI, kinds, resolve); touched > 0 {
+			if current, open := s.store.Snapshot(snapshot.URI); open {
+				snapshot = current
+			}
+		}
+	}
+
+	if opts, ok := s.lspManager.FormatOnSave(path); ok {
+		formatted, err := s.formatBuffer(snapshot, config.FormattingOptions(opts))
+		if err != nil {
+			log.Printf("Warning: Saving %s unformatted: %v", path, err)
+		}
+		snapshot = formatted
+	}
+	return snapshot
+}
+
+// applyEditorConfig makes an open buffer follow the EditorConfig rules for
+// whitespace, line endings and charset, and returns it afterwards
+func (s *session) applyEditorConfig(snapshot DocumentSnapshot, config EditorConfig) DocumentSnapshot {
+	if edits := config.NormalizeEdits(snapshot.Content); len(edits) > 0 {
+		normalized, err := s.store.ApplyBufferEdits([]BufferEdits{{
+			URI:      snapshot.URI,
+			Checksum: ContentChecksum(snapshot.Content),
+			Edits:    edits,
+		}})
+		if err != nil {
+			log.Printf("Warning: Failed to apply .editorconfig to %s: %v", snapshot.Path, err)
+		} else {
+			snapshot = normalized[0]
+		}
+	}
+
+	if format := config.TextFormat(snapshot.Format); format != snapshot.Format {
+		if err := s.store.SetFormat(snapshot.URI, format); err != nil {
+			log.Printf("Warning: Failed to apply .editorconfig to %s: %v", snapshot.Path, err)
+		} else {
+			snapshot.Format = format
+		}
+	}
+	return snapshot
+}
+
+// writeFile encodes content in format and writes it to path, then records
+// the save with the store, the local history and the LSP. A non-zero version
+// is the buffer version content was taken from, as for MarkSaved; origin is
+// not sent DocumentSaved.
+func (s *session) writeFile(path, uri, content string, version int, format TextFormat, origin DocumentSubscriber) error {
+	data, err := EncodeText(content, format)
+	if err != nil {
+		return err
+	}
+	if err := WriteFile(path, string(data)); err != nil {
+		return err
+	}
+
+	stamp, err := StampWritten(path, string(data))
+	if err != nil {
+		log.Printf("Warning: Failed to stat saved file %s: %v", path, err)
+	}
+	s.store.MarkSaved(uri, content, version, stamp, origin)
+	if err := s.localHistory.Record(path, content, format, snapshotSave); err != nil {
+		log.Printf("Warning: Failed to snapshot saved file %s: %v", path, err)
+	}
+
+	// Notify LSP about save
+	if err := s.lspManager.RouteNotification("textDocument/didSave", map[string]interface{}{
+		"textDocument": map[string]interface{}{
+			"uri": uri,
+		},
+	}); err != nil {
+		log.Printf("Warning: Failed to notify LSP about save: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,398 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// searchBatchFiles and searchBatchDelay bound how long results are held
+	// back before a search_result batch is sent
+	searchBatchFiles = 50
+	searchBatchDelay = 100 * time.Millisecond
+	// defaultSearchMaxMatches stops a search early unless the client asks
+	// for more
+	defaultSearchMaxMatches = 10000
+	// maxSearchContext caps the context lines sent around each match
+	maxSearchContext = 10
+	// maxSearchLineLength truncates the text of very long matching lines
+	maxSearchLineLength = 1000
+)
+
+type SearchPayload struct {
+	ID            int      `json:"id"` // chosen by the client; echoed in results and used to cancel
+	Query         string   `json:"query"`
+	Regex         bool     `json:"regex"` // RE2 syntax; otherwise Query is plain text
+	CaseSensitive bool     `json:"caseSensitive"`
+	WholeWord     bool     `json:"wholeWord"`
+	Include       []string `json:"include"` // .gitignore-style globs; empty means every file
+	Exclude       []string `json:"exclude"`
+	Context       int      `json:"context"` // lines of context around each match
+	MaxMatches    int      `json:"maxMatches"`
+}
+
+type SearchCancelPayload struct {
+	ID int `json:"id"`
+}
+
+// SearchMatch is one line containing matches. Ranges are [start, end)
+// columns in UTF-16 code units within the full line, even when Text is
+// truncated.
+type SearchMatch struct {
+	Line   int      `json:"line"` // zero-based
+	Text   string   `json:"text"`
+	Ranges [][2]int `json:"ranges"`
+	Before []string `json:"before,omitempty"`
+	After  []string `json:"after,omitempty"`
+}
+
+// SearchFileResult holds the matches found in one file
+type SearchFileResult struct {
+	Path    string        `json:"path"`
+	URI     string        `json:"uri"`
+	Matches []SearchMatch `json:"matches"`
+}
+
+// searchRun is a search running in the background for a connection
+type searchRun struct {
+	cancel context.CancelFunc
+}
+
+// searchQuery is a compiled search request
+type searchQuery struct {
+	re         *regexp.Regexp
+	include    []ignoreRule
+	exclude    []ignoreRule
+	context    int
+	maxMatches int
+}
+
+// compileSearch validates a search request
+func compileSearch(payload SearchPayload) (*searchQuery, error) {
+	if payload.Query == "" {
+		return nil, errors.New("empty query")
+	}
+
+	pattern := payload.Query
+	if !payload.Regex {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if payload.WholeWord {
+		pattern = `\b(?:` + pattern + `)\b`
+	}
+	if !payload.CaseSensitive {
+		pattern = "(?i)" + pattern
+	}
+	// ^ and $ match at line boundaries, as in grep
+	pattern = "(?m)" + pattern
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &searchQuery{
+		re:         re,
+		context:    payload.Context,
+		maxMatches: payload.MaxMatches,
+	}
+	if q.context < 0 {
+		q.context = 0
+	} else if q.context > maxSearchContext {
+		q.context = maxSearchContext
+	}
+	if q.maxMatches <= 0 {
+		q.maxMatches = defaultSearchMaxMatches
+	}
+	for _, glob := range payload.Include {
+		if rule, ok := parseIgnoreRule(glob); ok {
+			q.include = append(q.include, rule)
+		}
+	}
+	for _, glob := range payload.Exclude {
+		if rule, ok := parseIgnoreRule(glob); ok {
+			q.exclude = append(q.exclude, rule)
+		}
+	}
+	return q, nil
+}
+
+// wanted applies the include and exclude globs to a path relative to the
+// workspace root
+func (q *searchQuery) wanted(rel string, isDir bool) bool {
+	excluded := false
+	if matchRules(q.exclude, rel, isDir, &excluded) && excluded {
+		return false
+	}
+	if isDir || len(q.include) == 0 {
+		return true
+	}
+	included := false
+	matchRules(q.include, rel, false, &included)
+	return included
+}
+
+// searchText finds the matching lines of content, up to limit of them
+func (q *searchQuery) searchText(content string, limit int) []SearchMatch {
+	var matches []SearchMatch
+	var lines []string // split lazily, only for files with matches
+	lineNo, lineStart := 0, 0
+
+	for _, loc := range q.re.FindAllStringIndex(content, -1) {
+		if loc[0] == loc[1] {
+			continue
+		}
+		if lines == nil {
+			lines = strings.Split(content, "\n")
+		}
+
+		// Matches come in order, so the line is found by walking forward
+		for lineStart+len(lines[lineNo]) < loc[0] {
+			lineStart += len(lines[lineNo]) + 1
+			lineNo++
+		}
+		line := lines[lineNo]
+		// A pattern such as \s+ can still run over the end of the line
+		end := loc[1] - lineStart
+		if end > len(line) {
+			end = len(line)
+		}
+		r := [2]int{
+			OffsetInUnit(line, loc[0]-lineStart, OffsetUnitUTF16),
+			OffsetInUnit(line, end, OffsetUnitUTF16),
+		}
+
+		if n := len(matches); n > 0 && matches[n-1].Line == lineNo {
+			matches[n-1].Ranges = append(matches[n-1].Ranges, r)
+			continue
+		}
+		if len(matches) == limit {
+			break
+		}
+		matches = append(matches, SearchMatch{
+			Line:   lineNo,
+			Text:   truncateLine(line),
+			Ranges: [][2]int{r},
+			Before: contextLines(lines, lineNo-q.context, lineNo),
+			After:  contextLines(lines, lineNo+1, lineNo+1+q.context),
+		})
+	}
+	return matches
+}
+
+func contextLines(lines []string, from, to int) []string {
+	if from < 0 {
+		from = 0
+	}
+	if to > len(lines) {
+		to = len(lines)
+	}
+	var out []string
+	for _, line := range lines[from:to] {
+		out = append(out, truncateLine(line))
+	}
+	return out
+}
+
+func truncateLine(line string) string {
+	if len(line) <= maxSearchLineLength {
+		return line
+	}
+	cut := maxSearchLineLength
+	for cut > 0 && !utf8.RuneStart(line[cut]) {
+		cut--
+	}
+	return line[:cut]
+}
+
+// searchFile returns the text to search for a file: the open buffer if
+// there is one, so unsaved edits are found, or else the decoded file on
+// disk. Binary and oversized files yield false.
+func (s *session) searchFile(path string, size int64) (string, bool) {
+	if snapshot, open := s.store.Snapshot(pathToURI(path)); open {
+		return snapshot.Content, true
+	}
+	if s.store.maxFileSize > 0 && size > s.store.maxFileSize {
+		return "", false
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	sample := data
+	if len(sample) > sniffLength {
+		sample = sample[:sniffLength]
+	}
+	if looksBinary(sample) {
+		return "", false
+	}
+	content, _ := DecodeText(data)
+	return content, true
+}
+
+// walkSearch calls visit with the text of every file the query covers,
+// until visit returns false or ctx is cancelled
+func (s *session) walkSearch(ctx context.Context, q *searchQuery, visit func(path, content string) bool) error {
+	root := s.workspace.Root()
+	ignore := s.workspace.Ignore()
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil || path == root {
+			// Unreadable entries are skipped rather than failing the search
+			return nil
+		}
+
+		rel := filepath.ToSlash(strings.TrimPrefix(path, root+string(filepath.Separator)))
+		if d.IsDir() {
+			if ignore.Ignored(path, true) || !q.wanted(rel, true) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Symlinks are not followed, so the search stays inside the workspace
+		if !d.Type().IsRegular() || ignore.Ignored(path, false) || !q.wanted(rel, false) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		content, ok := s.searchFile(path, info.Size())
+		if !ok {
+			return nil
+		}
+		if !visit(path, content) {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+}
+
+// runSearch streams search_result batches until the search is done or ctx
+// is cancelled, then sends search_done
+func (s *session) runSearch(ctx context.Context, id int, q *searchQuery) {
+	var batch []SearchFileResult
+	lastFlush := time.Now()
+	flush := func() {
+		if len(batch) > 0 {
+			s.send("search_result", map[string]interface{}{
+				"id":      id,
+				"results": batch,
+			})
+			batch = nil
+		}
+		lastFlush = time.Now()
+	}
+
+	files, total := 0, 0
+	truncated := false
+	err := s.walkSearch(ctx, q, func(path, content string) bool {
+		matches := q.searchText(content, q.maxMatches-total)
+		if len(matches) > 0 {
+			files++
+			total += len(matches)
+			batch = append(batch, SearchFileResult{
+				Path:    path,
+				URI:     pathToURI(path),
+				Matches: matches,
+			})
+		}
+		if len(batch) >= searchBatchFiles || time.Since(lastFlush) >= searchBatchDelay {
+			flush()
+		}
+		if total >= q.maxMatches {
+			truncated = true
+			return false
+		}
+		return true
+	})
+	flush()
+
+	done := map[string]interface{}{
+		"id":        id,
+		"files":     files,
+		"matches":   total,
+		"truncated": truncated,
+		"cancelled": ctx.Err() != nil,
+	}
+	if err != nil && ctx.Err() == nil {
+		done["error"] = err.Error()
+	}
+	s.send("search_done", done)
+}
+
+func (s *session) handleSearch(raw json.RawMessage) {
+	var payload SearchPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid search payload")
+		return
+	}
+
+	q, err := compileSearch(payload)
+	if err != nil {
+		s.send("search_done", map[string]interface{}{
+			"id":    payload.ID,
+			"error": "Invalid search: " + err.Error(),
+		})
+		return
+	}
+
+	s.startSearch(payload.ID, func(ctx context.Context) {
+		s.runSearch(ctx, payload.ID, q)
+	})
+}
+
+// startSearch runs a search in the background under a client-chosen ID, so
+// search_cancel can stop it
+func (s *session) startSearch(id int, run func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	current := &searchRun{cancel: cancel}
+	s.mu.Lock()
+	// Reusing an ID replaces the search still running under it
+	if previous, running := s.searches[id]; running {
+		previous.cancel()
+	}
+	s.searches[id] = current
+	s.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		run(ctx)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// Only forget the search if a newer one did not take over its ID
+		if s.searches[id] == current {
+			delete(s.searches, id)
+		}
+	}()
+}
+
+func (s *session) handleSearchCancel(raw json.RawMessage) {
+	var payload SearchCancelPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid search_cancel payload")
+		return
+	}
+
+	s.mu.Lock()
+	run, running := s.searches[payload.ID]
+	delete(s.searches, payload.ID)
+	s.mu.Unlock()
+
+	if running {
+		run.cancel()
+	}
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSearchText(t *testing.T) {
+	const content = "Foo bar\nfoobar food\n\nx 😀 foo\nlast Foo"
+
+	tests := []struct {
+		name    string
+		payload SearchPayload
+		limit   int
+		want    []SearchMatch
+	}{
+		{
+			name:    "plain, ignoring case",
+			payload: SearchPayload{Query: "foo"},
+			want: []SearchMatch{
+				{Line: 0, Text: "Foo bar", Ranges: [][2]int{{0, 3}}},
+				{Line: 1, Text: "foobar food", Ranges: [][2]int{{0, 3}, {7, 10}}},
+				{Line: 3, Text: "x 😀 foo", Ranges: [][2]int{{5, 8}}},
+				{Line: 4, Text: "last Foo", Ranges: [][2]int{{5, 8}}},
+			},
+		},
+		{
+			name:    "case sensitive",
+			payload: SearchPayload{Query: "Foo", CaseSensitive: true},
+			want: []SearchMatch{
+				{Line: 0, Text: "Foo bar", Ranges: [][2]int{{0, 3}}},
+				{Line: 4, Text: "last Foo", Ranges: [][2]int{{5, 8}}},
+			},
+		},
+		{
+			name:    "whole word",
+			payload: SearchPayload{Query: "foo", WholeWord: true, CaseSensitive: true},
+			want:    []SearchMatch{{Line: 3, Text: "x 😀 foo", Ranges: [][2]int{{5, 8}}}},
+		},
+		{
+			name:    "plain text is not a pattern",
+			payload: SearchPayload{Query: "o."},
+			want:    nil,
+		},
+		{
+			name:    "regex anchored at line starts",
+			payload: SearchPayload{Query: `^f\w+`, Regex: true, CaseSensitive: true},
+			want:    []SearchMatch{{Line: 1, Text: "foobar food", Ranges: [][2]int{{0, 6}}}},
+		},
+		{
+			name:    "match running over the line end",
+			payload: SearchPayload{Query: `bar\s+`, Regex: true},
+			want: []SearchMatch{
+				{Line: 0, Text: "Foo bar", Ranges: [][2]int{{4, 7}}},
+				{Line: 1, Text: "foobar food", Ranges: [][2]int{{3, 7}}},
+			},
+		},
+		{
+			name:    "context lines",
+			payload: SearchPayload{Query: "last", Context: 2},
+			want: []SearchMatch{
+				{Line: 4, Text: "last Foo", Ranges: [][2]int{{0, 4}}, Before: []string{"", "x 😀 foo"}},
+			},
+		},
+		{
+			name:    "limit counts lines",
+			payload: SearchPayload{Query: "foo"},
+			limit:   2,
+			want: []SearchMatch{
+				{Line: 0, Text: "Foo bar", Ranges: [][2]int{{0, 3}}},
+				{Line: 1, Text: "foobar food", Ranges: [][2]int{{0, 3}, {7, 10}}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := compileSearch(tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			limit := tt.limit
+			if limit == 0 {
+				limit = q.maxMatches
+			}
+			if got := q.searchText(content, limit); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileSearchErrors(t *testing.T) {
+	for _, payload := range []SearchPayload{
+		{Query: ""},
+		{Query: "(", Regex: true},
+	} {
+		if _, err := compileSearch(payload); err == nil {
+			t.Errorf("%+v: want an error", payload)
+		}
+	}
+}
+
+func TestSearchWanted(t *testing.T) {
+	q, err := compileSearch(SearchPayload{
+		Query:   "x",
+		Include: []string{"*.go", "docs/**"},
+		Exclude: []string{"vendor/", "*_test.go"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"main.go", false, true},
+		{"pkg/a.go", false, true},
+		{"pkg/a_test.go", false, false},
+		{"README.md", false, false},
+		{"docs/guide/intro.md", false, true},
+		{"vendor", true, false},
+		{"pkg/vendor", true, false},
+		{"pkg", true, true},
+	}
+	for _, tt := range tests {
+		if got := q.wanted(tt.rel, tt.isDir); got != tt.want {
+			t.Errorf("wanted(%q, dir %v) = %v; want %v", tt.rel, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestReplaceText(t *testing.T) {
+	tests := []struct {
+		name        string
+		payload     SearchPayload
+		content     string
+		replacement string
+		limit       int
+		want        []ReplaceEdit
+	}{
+		{
+			name:        "plain",
+			payload:     SearchPayload{Query: "cat"},
+			content:     "cat\na cat",
+			replacement: "dog",
+			want: []ReplaceEdit{
+				{Range: Range{Start: Position{0, 0}, End: Position{0, 3}}, NewText: "dog", OldText: "cat"},
+				{Range: Range{Start: Position{1, 2}, End: Position{1, 5}}, NewText: "dog", OldText: "cat"},
+			},
+		},
+		{
+			name:        "dollar signs are literal in plain mode",
+			payload:     SearchPayload{Query: "price"},
+			content:     "price",
+			replacement: "$1",
+			want: []ReplaceEdit{
+				{Range: Range{Start: Position{0, 0}, End: Position{0, 5}}, NewText: "$1", OldText: "price"},
+			},
+		},
+		{
+			name:        "capture groups",
+			payload:     SearchPayload{Query: `(\w+)@(?P<host>\w+)`, Regex: true},
+			content:     "😀 me@home",
+			replacement: "${host}:$1",
+			want: []ReplaceEdit{
+				{Range: Range{Start: Position{0, 3}, End: Position{0, 10}}, NewText: "home:me", OldText: "me@home"},
+			},
+		},
+		{
+			name:        "unchanged matches skipped",
+			payload:     SearchPayload{Query: "a+", Regex: true},
+			content:     "a aa",
+			replacement: "a",
+			want: []ReplaceEdit{
+				{Range: Range{Start: Position{0, 2}, End: Position{0, 4}}, NewText: "a", OldText: "aa"},
+			},
+		},
+		{
+			name:        "limit",
+			payload:     SearchPayload{Query: "x"},
+			content:     "x x x",
+			replacement: "y",
+			limit:       1,
+			want: []ReplaceEdit{
+				{Range: Range{Start: Position{0, 0}, End: Position{0, 1}}, NewText: "y", OldText: "x"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := compileSearch(tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			limit := tt.limit
+			if limit == 0 {
+				limit = q.maxMatches
+			}
+			got := q.replaceText(tt.content, tt.replacement, tt.payload.Regex, limit)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareReplace(t *testing.T) {
+	st, root := newTestStore(t, &recordingSubscriber{}, "open.txt")
+	closed := filepath.Join(root, "closed.txt")
+	if err := os.WriteFile(closed, []byte("cat\r\ncat\r\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	workspace, err := NewWorkspace(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &session{workspace: workspace, store: st}
+
+	q, err := compileSearch(SearchPayload{Query: "cat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, content, _, err := ReadDiskText(closed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var edits []TextEdit
+	for _, edit := range q.replaceText(content, "dog", false, q.maxMatches) {
+		edits = append(edits, TextEdit{Range: edit.Range, NewText: edit.NewText})
+	}
+	file := ReplaceApplyFile{Path: closed, Checksum: ContentChecksum(content), Edits: edits}
+
+	pending, err := s.prepareReplace([]ReplaceApplyFile{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := pending[0]; p.open || p.after != "dog\ndog\n" || p.format.LineEnding != LineEndingCRLF {
+		t.Errorf("got %+v", p)
+	}
+
+	stale := file
+	stale.Checksum = ContentChecksum("something else")
+	open := ReplaceApplyFile{Path: filepath.Join(root, "open.txt"), Checksum: ContentChecksum("open.txt")}
+	failures := map[string][]ReplaceApplyFile{
+		"changed since the preview": {stale},
+		"listed twice":              {file, file},
+		"outside the workspace":     {{Path: filepath.Join(filepath.Dir(root), "x.txt")}},
+		"no longer exists":          {{Path: filepath.Join(root, "gone.txt")}},
+	}
+	for name, files := range failures {
+		if _, err := s.prepareReplace(files); err == nil {
+			t.Errorf("%s: want an error", name)
+		} else if !strings.Contains(err.Error(), filepath.Base(files[0].Path)) && name != "outside the workspace" {
+			t.Errorf("%s: error %q does not name the file", name, err)
+		}
+	}
+
+	pending, err = s.prepareReplace([]ReplaceApplyFile{open})
+	if err != nil || !pending[0].open {
+		t.Errorf("open buffer: got %+v, %v", pending, err)
+	}
+}
@@ -0,0 +1,957 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrVersionMismatch is returned when an edit is based on a stale document version
+var ErrVersionMismatch = errors.New("document version mismatch")
+
+// ErrDocumentNotOpen is returned for operations on a document nobody has opened
+var ErrDocumentNotOpen = errors.New("document is not open")
+
+// ErrContentChanged is returned for edits computed against text that has
+// changed since
+var ErrContentChanged = errors.New("content changed since the edits were computed")
+
+// ContentChange replaces the text between FromPos and ToPos with Insert
+type ContentChange struct {
+	FromPos int    `json:"fromPos"`
+	ToPos   int    `json:"toPos"`
+	Insert  string `json:"insert"`
+}
+
+// DocumentChange describes one transaction applied to a shared document.
+// Every change's positions refer to the document before the transaction and
+// are counted in Unit, always UTF-16 code units as the browser counts them.
+type DocumentChange struct {
+	URI     string          `json:"uri"`
+	Version int             `json:"version"`
+	Unit    string          `json:"unit"`
+	Changes []ContentChange `json:"changes"`
+	Dirty   bool            `json:"dirty"`
+}
+
+// newDocumentChange describes byte edits made to base, converting their
+// positions for the client
+func newDocumentChange(doc *Document, base *Rope, edits []byteEdit) DocumentChange {
+	changes := make([]ContentChange, len(edits))
+	for i, edit := range edits {
+		// edits run from the end backwards; clients get them in document order
+		changes[len(edits)-1-i] = ContentChange{
+			FromPos: base.OffsetInUnit(edit.from, OffsetUnitUTF16),
+			ToPos:   base.OffsetInUnit(edit.to, OffsetUnitUTF16),
+			Insert:  edit.text,
+		}
+	}
+	return DocumentChange{
+		URI:     doc.URI,
+		Version: doc.Version,
+		Unit:    OffsetUnitUTF16,
+		Changes: changes,
+		Dirty:   doc.Dirty,
+	}
+}
+
+// DocumentSnapshot is a copy of a document's state at one version
+type DocumentSnapshot struct {
+	URI     string     `json:"uri"`
+	Path    string     `json:"path"`
+	Version int        `json:"version"`
+	Content string     `json:"content"`
+	Dirty   bool       `json:"dirty"`
+	Format  TextFormat `json:"format"`
+}
+
+// DiskChange reports a file that changed on disk outside the editor
+type DiskChange struct {
+	URI      string `json:"uri"`
+	Path     string `json:"path"`
+	Change   string `json:"change"`   // "created", "changed" or "deleted"
+	Open     bool   `json:"open"`     // whether the file has an open buffer
+	Reloaded bool   `json:"reloaded"` // whether the open buffer was replaced with the disk content
+	Version  int    `json:"version,omitempty"`
+}
+
+// DocumentSubscriber receives updates for documents it has opened, and disk
+// changes and LSP notifications for the whole workspace once attached.
+// Callbacks run after the store lock is released, one at a time and in the
+// order the changes were made. They may read from the store but must not
+// change it.
+type DocumentSubscriber interface {
+	DocumentChanged(change DocumentChange)
+	DocumentSaved(uri string, version int)
+	DocumentRenamed(oldURI string, doc DocumentSnapshot)
+	DocumentFormatChanged(uri string, format TextFormat, dirty bool)
+	FileChangedOnDisk(change DiskChange)
+	LSPNotification(notification json.RawMessage)
+}
+
+type storeEntry struct {
+	doc         *Document
+	subscribers map[DocumentSubscriber]struct{}
+}
+
+// DocumentStore owns the buffers of all open documents, shared by every
+// WebSocket connection, and keeps the LSP servers in sync with them
+type DocumentStore struct {
+	lspManager  *MultiLSPManager
+	maxFileSize int64 // larger files are refused; 0 means no limit
+	mu          sync.Mutex
+	entries     map[string]*storeEntry // keyed by URI
+	histories   map[string]*History    // keyed by URI; kept after documents close
+	closed      []string               // URIs of closed documents with a history, least recently closed first
+	clients     map[DocumentSubscriber]struct{}
+	snapshots   *LocalHistory            // nil disables snapshots before reloads
+	saves       map[string]chan struct{} // keyed by URI; closed once the latest queued save is done
+
+	// Notifications to subscribers and the LSP are queued while the lock is
+	// held and delivered once it is released; see post and unlock
+	outbox     []func()
+	posted     int
+	delivered  int
+	delivering bool       // whether some goroutine is draining the outbox
+	drained    *sync.Cond // signalled as queued notifications go out
+}
+
+// NewDocumentStore creates an empty document store. Files above maxFileSize
+// bytes cannot be opened as buffers; 0 means no limit.
+func NewDocumentStore(lspManager *MultiLSPManager, maxFileSize int64) *DocumentStore {
+	st := &DocumentStore{
+		lspManager:  lspManager,
+		maxFileSize: maxFileSize,
+		entries:     make(map[string]*storeEntry),
+		histories:   make(map[string]*History),
+		clients:     make(map[DocumentSubscriber]struct{}),
+		saves:       make(map[string]chan struct{}),
+	}
+	st.drained = sync.NewCond(&st.mu)
+	return st
+}
+
+// post queues a notification to be delivered once the store lock is
+// released (must be called with lock held)
+func (st *DocumentStore) post(fn func()) {
+	st.outbox = append(st.outbox, fn)
+	st.posted++
+}
+
+// unlock releases the store lock, then delivers the queued notifications
+// and returns once every notification posted so far has gone out. Only one
+// goroutine delivers at a time, draining the outbox in order, so the LSP and
+// the clients see changes in the order they were made even though a slow
+// connection no longer holds up the store.
+func (st *DocumentStore) unlock() {
+	target := st.posted
+	for st.delivering && st.delivered < target {
+		st.drained.Wait()
+	}
+	if st.delivered >= target {
+		st.mu.Unlock()
+		return
+	}
+
+	st.delivering = true
+	for len(st.outbox) > 0 {
+		batch := st.outbox
+		st.outbox = nil
+		st.mu.Unlock()
+		for _, fn := range batch {
+			fn()
+		}
+		st.mu.Lock()
+		st.delivered += len(batch)
+		st.drained.Broadcast()
+	}
+	st.delivering = false
+	st.mu.Unlock()
+}
+
+// notifySubscribers posts fn for every subscriber of a document except
+// origin (must be called with lock held)
+func (st *DocumentStore) notifySubscribers(entry *storeEntry, origin DocumentSubscriber, fn func(DocumentSubscriber)) {
+	for sub := range entry.subscribers {
+		if sub != origin {
+			sub := sub
+			st.post(func() { fn(sub) })
+		}
+	}
+}
+
+// notifyClients posts fn for every attached connection (must be called with
+// lock held)
+func (st *DocumentStore) notifyClients(fn func(DocumentSubscriber)) {
+	for client := range st.clients {
+		client := client
+		st.post(func() { fn(client) })
+	}
+}
+
+// SetLocalHistory makes the store snapshot buffers into h before replacing
+// them with the file on disk
+func (st *DocumentStore) SetLocalHistory(h *LocalHistory) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.snapshots = h
+}
+
+// Attach registers a connection for workspace-wide disk change events
+func (st *DocumentStore) Attach(sub DocumentSubscriber) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.clients[sub] = struct{}{}
+}
+
+// Detach removes a connection registered with Attach
+func (st *DocumentStore) Detach(sub DocumentSubscriber) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.clients, sub)
+}
+
+// Open subscribes sub to the document at path, loading it from disk if no
+// other connection has it open yet. Binary files fail with ErrBinaryFile and
+// oversized ones with a *FileTooLargeError.
+func (st *DocumentStore) Open(path string, sub DocumentSubscriber) (DocumentSnapshot, error) {
+	st.mu.Lock()
+	defer st.unlock()
+
+	uri := pathToURI(path)
+	entry, exists := st.entries[uri]
+	if !exists {
+		if err := CheckEditable(path, st.maxFileSize); err != nil {
+			return DocumentSnapshot{}, err
+		}
+		stamp, content, format, err := ReadDiskText(path)
+		if err != nil {
+			return DocumentSnapshot{}, err
+		}
+		if stamp.Missing {
+			return DocumentSnapshot{}, errors.New("file does not exist")
+		}
+		entry = &storeEntry{
+			doc:         NewDocument(path, content),
+			subscribers: make(map[DocumentSubscriber]struct{}),
+		}
+		entry.doc.Disk = stamp
+		entry.doc.Format = format
+		st.entries[uri] = entry
+
+		// Pick up the history from an earlier session unless the file
+		// changed in between, in which case its edits no longer apply
+		st.reviveHistory(uri)
+		h := st.history(uri)
+		if h.tip != nil && h.tip.String() == content {
+			entry.doc.Text = h.tip
+		} else {
+			h.reset(entry.doc.Text)
+		}
+		entry.doc.markClean()
+	}
+	entry.subscribers[sub] = struct{}{}
+
+	st.ensureLSPOpen(entry.doc)
+	return entry.snapshot(), nil
+}
+
+// Close unsubscribes sub from a document. Clean documents are dropped once
+// the last subscriber leaves; dirty ones are kept so unsaved edits survive a
+// page reload.
+func (st *DocumentStore) Close(uri string, sub DocumentSubscriber) {
+	st.mu.Lock()
+	defer st.unlock()
+
+	entry, exists := st.entries[uri]
+	if !exists {
+		return
+	}
+	delete(entry.subscribers, sub)
+
+	if len(entry.subscribers) == 0 && !entry.doc.Dirty {
+		st.closeLSP(entry.doc)
+		delete(st.entries, uri)
+		st.retireHistory(uri)
+	}
+}
+
+// Snapshot returns the current state of an open document
+func (st *DocumentStore) Snapshot(uri string) (DocumentSnapshot, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	entry, exists := st.entries[uri]
+	if !exists {
+		return DocumentSnapshot{}, false
+	}
+	return entry.snapshot(), true
+}
+
+// QueueSave runs save in the background once every save of the document
+// queued before it is done, so saves of one document run one at a time and
+// in order, whichever connection asked for them
+func (st *DocumentStore) QueueSave(uri string, save func()) {
+	st.mu.Lock()
+	previous := st.saves[uri]
+	done := make(chan struct{})
+	st.saves[uri] = done
+	st.mu.Unlock()
+
+	go func() {
+		defer func() {
+			st.mu.Lock()
+			if st.saves[uri] == done {
+				delete(st.saves, uri)
+			}
+			st.mu.Unlock()
+			close(done)
+		}()
+
+		if previous != nil {
+			<-previous
+		}
+		save()
+	}()
+}
+
+// ApplyDelta edits a document and broadcasts the change to every subscriber
+// except origin. A non-zero baseVersion must match the current version, and
+// positions are counted in unit.
+func (st *DocumentStore) ApplyDelta(uri string, baseVersion, fromPos, toPos int, unit, insert string, origin DocumentSubscriber) (int, error) {
+	return st.ApplyDeltaBatch(uri, baseVersion, unit, []ContentChange{{
+		FromPos: fromPos,
+		ToPos:   toPos,
+		Insert:  insert,
+	}}, origin)
+}
+
+// ApplyDeltaBatch applies several changes, all positioned against the same
+// base version, as one transaction: a single new version, a single broadcast
+// and a single didChange. If any change is invalid nothing is applied.
+func (st *DocumentStore) ApplyDeltaBatch(uri string, baseVersion int, unit string, changes []ContentChange, origin DocumentSubscriber) (int, error) {
+	st.mu.Lock()
+	defer st.unlock()
+
+	entry, exists := st.entries[uri]
+	if !exists {
+		return 0, ErrDocumentNotOpen
+	}
+	doc := entry.doc
+
+	if baseVersion != 0 && baseVersion != doc.Version {
+		return doc.Version, ErrVersionMismatch
+	}
+
+	edits, err := resolveDeltaBatch(doc.Text, changes, unit)
+	if err != nil {
+		return doc.Version, err
+	}
+	if len(edits) == 0 {
+		return doc.Version, nil
+	}
+
+	st.applyEdits(entry, edits, origin)
+	return doc.Version, nil
+}
+
+// DiskStamp returns the on-disk state recorded when the document was last
+// read or saved
+func (st *DocumentStore) DiskStamp(uri string) (DiskStamp, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	entry, exists := st.entries[uri]
+	if !exists {
+		return DiskStamp{}, false
+	}
+	return entry.doc.Disk, true
+}
+
+// ApplyTextEdits applies LSP text edits to an open document as one
+// transaction, broadcast to every subscriber. It reports false if the
+// document is not open, leaving the caller to edit the file on disk.
+func (st *DocumentStore) ApplyTextEdits(uri string, edits []TextEdit) (bool, error) {
+	st.mu.Lock()
+	defer st.unlock()
+
+	entry, exists := st.entries[uri]
+	if !exists {
+		return false, nil
+	}
+	doc := entry.doc
+
+	resolved, err := resolveTextEdits(doc.Text, edits)
+	if err != nil {
+		return true, err
+	}
+	if len(resolved) == 0 {
+		return true, nil
+	}
+
+	st.applyEdits(entry, resolved, nil)
+	return true, nil
+}
+
+// BufferEdits are text edits to an open document, computed against its text
+// when that had the ContentChecksum Checksum
+type BufferEdits struct {
+	URI      string
+	Checksum string
+	Edits    []TextEdit
+}
+
+// ApplyBufferEdits edits several open documents as one step: unless every
+// document is open, still has the text its edits were computed against and
+// accepts them, nothing is applied. Each document gets one new version,
+// broadcast to every subscriber. It returns the documents after the edits.
+func (st *DocumentStore) ApplyBufferEdits(changes []BufferEdits) ([]DocumentSnapshot, error) {
+	st.mu.Lock()
+	defer st.unlock()
+
+	entries := make([]*storeEntry, len(changes))
+	resolved := make([][]byteEdit, len(changes))
+	for i, change := range changes {
+		entry, exists := st.entries[change.URI]
+		if !exists {
+			return nil, ErrDocumentNotOpen
+		}
+		if ContentChecksum(entry.doc.Text.String()) != change.Checksum {
+			return nil, ErrContentChanged
+		}
+		edits, err := resolveTextEdits(entry.doc.Text, change.Edits)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = entry
+		resolved[i] = edits
+	}
+
+	snapshots := make([]DocumentSnapshot, len(changes))
+	for i, entry := range entries {
+		if len(resolved[i]) > 0 {
+			st.applyEdits(entry, resolved[i], nil)
+		}
+		snapshots[i] = entry.snapshot()
+	}
+	return snapshots, nil
+}
+
+// Rename re-keys every open document at or below oldPath after a file or
+// directory was moved, and reopens them in the LSP under their new URI
+func (st *DocumentStore) Rename(oldPath, newPath string) {
+	st.mu.Lock()
+	defer st.unlock()
+
+	prefix := oldPath + string(filepath.Separator)
+	moved := make(map[string]string) // old URI -> new path
+	for uri, entry := range st.entries {
+		switch path := entry.doc.Path; {
+		case path == oldPath:
+			moved[uri] = newPath
+		case strings.HasPrefix(path, prefix):
+			moved[uri] = filepath.Join(newPath, strings.TrimPrefix(path, prefix))
+		}
+	}
+
+	for uri, path := range moved {
+		entry := st.entries[uri]
+		doc := entry.doc
+
+		st.closeLSP(doc)
+		delete(st.entries, uri)
+
+		// A document open at the target was overwritten; its buffer is all
+		// that is left of that file
+		if displaced, exists := st.entries[pathToURI(path)]; exists {
+			st.displace(displaced)
+		}
+
+		doc.Path = path
+		doc.URI = pathToURI(path)
+		doc.LanguageID = detectLanguage(path)
+		st.entries[doc.URI] = entry
+		st.histories[doc.URI] = st.history(uri)
+		delete(st.histories, uri)
+		st.ensureLSPOpen(doc)
+
+		oldURI, snapshot := uri, entry.snapshot()
+		st.notifySubscribers(entry, nil, func(sub DocumentSubscriber) {
+			sub.DocumentRenamed(oldURI, snapshot)
+		})
+	}
+}
+
+// HasOpen reports whether a document at or below path is open
+func (st *DocumentStore) HasOpen(path string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	prefix := path + string(filepath.Separator)
+	for _, entry := range st.entries {
+		if entry.doc.Path == path || strings.HasPrefix(entry.doc.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// displace drops a document whose URI another document is taking over,
+// closing it in the LSP and telling its subscribers the file is gone
+// (must be called with lock held)
+func (st *DocumentStore) displace(entry *storeEntry) {
+	doc := entry.doc
+	st.closeLSP(doc)
+	delete(st.entries, doc.URI)
+	delete(st.histories, doc.URI)
+
+	change := DiskChange{
+		URI:     doc.URI,
+		Path:    doc.Path,
+		Change:  FileDeleted.String(),
+		Open:    true,
+		Version: doc.Version,
+	}
+	st.notifySubscribers(entry, nil, func(sub DocumentSubscriber) {
+		sub.FileChangedOnDisk(change)
+	})
+}
+
+// MarkDeleted marks every open document at or below path dirty after the
+// file or directory was deleted, since the buffers are now the only copy of
+// the content, and tells the clients. The undo histories kept for closed
+// documents there are dropped. The watcher reports the deletion too, but
+// only after its debounce.
+func (st *DocumentStore) MarkDeleted(path string) {
+	st.mu.Lock()
+	defer st.unlock()
+
+	st.forgetHistories(path)
+	prefix := path + string(filepath.Separator)
+	for uri, entry := range st.entries {
+		doc := entry.doc
+		if doc.Path != path && !strings.HasPrefix(doc.Path, prefix) {
+			continue
+		}
+		doc.Dirty = true
+		doc.saved = nil
+
+		change := DiskChange{
+			URI:     uri,
+			Path:    doc.Path,
+			Change:  FileDeleted.String(),
+			Open:    true,
+			Version: doc.Version,
+		}
+		st.notifyClients(func(client DocumentSubscriber) {
+			client.FileChangedOnDisk(change)
+		})
+	}
+}
+
+// MarkSaved records that content was written to disk for a document.
+// A non-zero version means the content was taken from the buffer at that
+// version; if the buffer has moved on since, it stays dirty. Otherwise the
+// content came from the client and, if it differs, replaces the buffer for
+// all subscribers.
+func (st *DocumentStore) MarkSaved(uri, content string, version int, stamp DiskStamp, origin DocumentSubscriber) {
+	st.mu.Lock()
+	defer st.unlock()
+
+	entry, exists := st.entries[uri]
+	if !exists {
+		return
+	}
+	doc := entry.doc
+	doc.Disk = stamp
+
+	if version != 0 && version != doc.Version {
+		return
+	}
+	doc.Dirty = false
+	if content != doc.Text.String() {
+		st.replaceContent(entry, content, origin)
+	}
+
+	saved := doc.Version
+	doc.markClean()
+	st.notifySubscribers(entry, origin, func(sub DocumentSubscriber) {
+		sub.DocumentSaved(uri, saved)
+	})
+
+	// Saves run in the background, so the last subscriber may have closed
+	// the document while it was still dirty
+	if len(entry.subscribers) == 0 {
+		st.closeLSP(doc)
+		delete(st.entries, uri)
+		st.retireHistory(uri)
+	}
+}
+
+// HandleFileEvents reconciles open buffers with changes made on disk. Clean
+// buffers are reloaded; dirty ones are left alone and the clients are told.
+func (st *DocumentStore) HandleFileEvents(events []FileEvent) {
+	st.mu.Lock()
+	defer st.unlock()
+
+	for _, ev := range events {
+		uri := pathToURI(ev.Path)
+		change := DiskChange{
+			URI:    uri,
+			Path:   ev.Path,
+			Change: ev.Type.String(),
+		}
+
+		if entry, exists := st.entries[uri]; exists {
+			change.Open = true
+			doc := entry.doc
+
+			if ev.Type == FileDeleted {
+				// The buffer is now the only copy of the content
+				doc.Dirty = true
+				doc.saved = nil
+			} else {
+				stamp, content, format, err := ReadDiskText(ev.Path)
+				if err != nil || stamp.Missing {
+					continue
+				}
+				if content == doc.Text.String() && format == doc.Format {
+					// Typically our own save coming back through the watcher
+					doc.Disk = stamp
+					doc.markClean()
+					continue
+				}
+				if !doc.Dirty {
+					if content != doc.Text.String() {
+						st.snapshotBeforeReload(doc)
+						st.replaceContent(entry, content, nil)
+					}
+					doc.Disk = stamp
+					st.setFormat(entry, format)
+					doc.markClean()
+					change.Reloaded = true
+				}
+			}
+			change.Version = doc.Version
+		} else if ev.Type == FileDeleted {
+			st.forgetHistories(ev.Path)
+		}
+
+		st.notifyClients(func(client DocumentSubscriber) {
+			client.FileChangedOnDisk(change)
+		})
+	}
+}
+
+// PublishLSPNotification delivers a notification from an LSP server to the
+// connections it concerns: those with the document open if it names one in
+// params.uri, as publishDiagnostics does, and every connection otherwise
+func (st *DocumentStore) PublishLSPNotification(notification json.RawMessage) {
+	var msg struct {
+		Params struct {
+			URI string `json:"uri"`
+		} `json:"params"`
+	}
+	if err := json.Unmarshal(notification, &msg); err != nil {
+		log.Printf("Failed to unmarshal notification: %v", err)
+		return
+	}
+
+	st.mu.Lock()
+	defer st.unlock()
+
+	deliver := func(sub DocumentSubscriber) {
+		sub.LSPNotification(notification)
+	}
+	if msg.Params.URI == "" {
+		st.notifyClients(deliver)
+		return
+	}
+	// Servers may percent-encode the URIs they produce
+	if entry, exists := st.entries[pathToURI(uriToPath(msg.Params.URI))]; exists {
+		st.notifySubscribers(entry, nil, deliver)
+	}
+}
+
+// Reload replaces a document's buffer with the file on disk, discarding
+// unsaved edits
+func (st *DocumentStore) Reload(uri string) error {
+	return st.ReloadAs(uri, "")
+}
+
+// ReloadAs is Reload with the file decoded as encoding instead of the
+// detected one; an empty encoding means detect
+func (st *DocumentStore) ReloadAs(uri, encoding string) error {
+	st.mu.Lock()
+	defer st.unlock()
+
+	entry, exists := st.entries[uri]
+	if !exists {
+		return ErrDocumentNotOpen
+	}
+	doc := entry.doc
+
+	stamp, raw, err := ReadDiskStamp(doc.Path)
+	if err != nil {
+		return err
+	}
+	if stamp.Missing {
+		return errors.New("file does not exist")
+	}
+
+	content, format := DecodeText([]byte(raw))
+	if encoding != "" {
+		if content, format, err = DecodeTextAs([]byte(raw), encoding); err != nil {
+			return err
+		}
+	}
+
+	changed := content != doc.Text.String()
+	if changed {
+		st.snapshotBeforeReload(doc)
+	}
+	doc.Dirty = false
+	if changed {
+		st.replaceContent(entry, content, nil)
+	}
+	doc.Disk = stamp
+	st.setFormat(entry, format)
+	doc.markClean()
+
+	version := doc.Version
+	st.notifySubscribers(entry, nil, func(sub DocumentSubscriber) {
+		sub.DocumentSaved(uri, version)
+	})
+	return nil
+}
+
+// Restore replaces a document's buffer with earlier content, such as a swap
+// file or a local history snapshot. The buffer becomes dirty, and the change
+// is broadcast to every subscriber and can be undone.
+func (st *DocumentStore) Restore(uri, content string, format TextFormat) error {
+	st.mu.Lock()
+	defer st.unlock()
+
+	entry, exists := st.entries[uri]
+	if !exists {
+		return ErrDocumentNotOpen
+	}
+
+	doc := entry.doc
+	if content != doc.Text.String() {
+		doc.Dirty = true
+		st.replaceContent(entry, content, nil)
+	}
+	if format.Validate() == nil && format != doc.Format {
+		doc.Dirty = true
+		st.setFormat(entry, format)
+	}
+	return nil
+}
+
+// snapshotBeforeReload keeps the buffer in the local history before the
+// file on disk replaces it. The snapshot is written once the lock is
+// released (must be called with lock held).
+func (st *DocumentStore) snapshotBeforeReload(doc *Document) {
+	if st.snapshots == nil {
+		return
+	}
+	history, path, text, format := st.snapshots, doc.Path, doc.Text, doc.Format
+	st.post(func() {
+		if err := history.Record(path, text.String(), format, snapshotBeforeReload); err != nil {
+			log.Printf("Failed to snapshot %s before reloading it: %v", path, err)
+		}
+	})
+}
+
+// SetFormat changes the encoding and line endings a document is saved with.
+// The buffer becomes dirty, since saving it now changes the file.
+func (st *DocumentStore) SetFormat(uri string, format TextFormat) error {
+	st.mu.Lock()
+	defer st.unlock()
+
+	entry, exists := st.entries[uri]
+	if !exists {
+		return ErrDocumentNotOpen
+	}
+	doc := entry.doc
+
+	if format == doc.Format {
+		return nil
+	}
+	// Refuse up front rather than at the next save
+	if _, err := EncodeText(doc.Text.String(), format); err != nil {
+		return err
+	}
+
+	doc.Dirty = true
+	st.setFormat(entry, format)
+	return nil
+}
+
+// setFormat records a document's format and tells its subscribers if it
+// changed (must be called with lock held)
+func (st *DocumentStore) setFormat(entry *storeEntry, format TextFormat) {
+	doc := entry.doc
+	if format == doc.Format {
+		return
+	}
+	doc.Format = format
+	uri, dirty := doc.URI, doc.Dirty
+	st.notifySubscribers(entry, nil, func(sub DocumentSubscriber) {
+		sub.DocumentFormatChanged(uri, format, dirty)
+	})
+}
+
+// applyEdits applies byte edits ordered by orderByteEdits as one new
+// version, and sends it to the LSP and every subscriber except origin
+// (must be called with lock held)
+func (st *DocumentStore) applyEdits(entry *storeEntry, edits []byteEdit, origin DocumentSubscriber) {
+	doc := entry.doc
+	base := doc.Text
+	doc.Text = applyByteEdits(base, edits)
+	doc.Version++
+	doc.Dirty = true
+
+	st.history(doc.URI).record(base, doc.Text, edits, origin, origin != nil && len(edits) == 1)
+	st.notifyChange(doc, base, edits)
+	st.broadcast(entry, newDocumentChange(doc, base, edits), origin)
+}
+
+// replaceContent swaps the whole buffer and sends it to the LSP and every
+// subscriber except origin. The dirty flag is left to the caller
+// (must be called with lock held).
+func (st *DocumentStore) replaceContent(entry *storeEntry, content string, origin DocumentSubscriber) {
+	doc := entry.doc
+	base := doc.Text
+	edits := []byteEdit{{from: 0, to: base.Len(), text: content}}
+	doc.Text = NewRope(content)
+	doc.Version++
+	st.history(doc.URI).record(base, doc.Text, edits, origin, false)
+	st.notifyChange(doc, base, edits)
+	st.broadcast(entry, newDocumentChange(doc, base, edits), origin)
+}
+
+// ReopenLSP re-sends textDocument/didOpen for every document handled by
+// language, after its server was (re)started
+func (st *DocumentStore) ReopenLSP(language string) {
+	st.mu.Lock()
+	defer st.unlock()
+
+	for _, entry := range st.entries {
+		if detectLanguageForLSP(entry.doc.Path) == language {
+			entry.doc.LSPOpen = false
+			st.ensureLSPOpen(entry.doc)
+		}
+	}
+}
+
+// ensureLSPOpen sends textDocument/didOpen for a document the LSP has not seen
+// yet, e.g. because the file was opened before the LSP was configured
+// (must be called with lock held)
+func (st *DocumentStore) ensureLSPOpen(doc *Document) {
+	if doc.LSPOpen || !st.lspManager.IsRunning(detectLanguageForLSP(doc.Path)) {
+		return
+	}
+	doc.LSPOpen = true
+
+	uri, languageID, version, text := doc.URI, doc.LanguageID, doc.Version, doc.Text
+	st.post(func() {
+		if err := st.lspManager.RouteNotification("textDocument/didOpen", map[string]interface{}{
+			"textDocument": map[string]interface{}{
+				"uri":        uri,
+				"languageId": languageID,
+				"version":    version,
+				"text":       text.String(),
+			},
+		}); err != nil {
+			log.Printf("Warning: Failed to notify LSP about opened file: %v", err)
+		}
+	})
+}
+
+// notifyChange sends textDocument/didChange for edits that turned base into
+// the document's current text, as ranges or as the full text depending on
+// what the server asked for (must be called with lock held)
+func (st *DocumentStore) notifyChange(doc *Document, base *Rope, edits []byteEdit) {
+	if !doc.LSPOpen {
+		st.ensureLSPOpen(doc)
+		return
+	}
+
+	uri, path, version, text := doc.URI, doc.Path, doc.Version, doc.Text
+	st.post(func() {
+		var changes []interface{}
+		switch st.lspManager.TextDocumentSyncKind(path) {
+		case TextDocumentSyncNone:
+			return
+		case TextDocumentSyncIncremental:
+			// edits run from the end of the document backwards, so each
+			// range is still valid after the changes before it are applied,
+			// which is how the server processes them
+			for _, edit := range edits {
+				changes = append(changes, map[string]interface{}{
+					"range": Range{Start: base.PositionAt(edit.from), End: base.PositionAt(edit.to)},
+					"text":  edit.text,
+				})
+			}
+		default:
+			changes = []interface{}{
+				map[string]interface{}{
+					"text": text.String(),
+				},
+			}
+		}
+
+		if err := st.lspManager.RouteNotification("textDocument/didChange", map[string]interface{}{
+			"textDocument": map[string]interface{}{
+				"uri":     uri,
+				"version": version,
+			},
+			"contentChanges": changes,
+		}); err != nil {
+			log.Printf("Warning: Failed to notify LSP about change: %v", err)
+		}
+	})
+}
+
+// closeLSP sends textDocument/didClose (must be called with lock held)
+func (st *DocumentStore) closeLSP(doc *Document) {
+	if !doc.LSPOpen {
+		return
+	}
+	doc.LSPOpen = false
+
+	uri := doc.URI
+	st.post(func() {
+		if err := st.lspManager.RouteNotification("textDocument/didClose", map[string]interface{}{
+			"textDocument": map[string]interface{}{
+				"uri": uri,
+			},
+		}); err != nil {
+			log.Printf("Warning: Failed to notify LSP about closed file: %v", err)
+		}
+	})
+}
+
+func (e *storeEntry) snapshot() DocumentSnapshot {
+	return DocumentSnapshot{
+		URI:     e.doc.URI,
+		Path:    e.doc.Path,
+		Version: e.doc.Version,
+		Content: e.doc.Text.String(),
+		Dirty:   e.doc.Dirty,
+		Format:  e.doc.Format,
+	}
+}
+
+// broadcast sends a change to every subscriber of a document except origin
+// (must be called with lock held)
+func (st *DocumentStore) broadcast(entry *storeEntry, change DocumentChange, origin DocumentSubscriber) {
+	st.notifySubscribers(entry, origin, func(sub DocumentSubscriber) {
+		sub.DocumentChanged(change)
+	})
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// recordingSubscriber keeps the disk changes and renames it is told about
+type recordingSubscriber struct {
+	mu      sync.Mutex
+	disk    []DiskChange
+	renamed []string // new URIs
+}
+
+func (r *recordingSubscriber) DocumentChanged(change DocumentChange)                           {}
+func (r *recordingSubscriber) DocumentSaved(uri string, version int)                           {}
+func (r *recordingSubscriber) DocumentFormatChanged(uri string, format TextFormat, dirty bool) {}
+func (r *recordingSubscriber) LSPNotification(notification json.RawMessage)                    {}
+
+func (r *recordingSubscriber) DocumentRenamed(oldURI string, doc DocumentSnapshot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.renamed = append(r.renamed, doc.URI)
+}
+
+func (r *recordingSubscriber) FileChangedOnDisk(change DiskChange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.disk = append(r.disk, change)
+}
+
+// newTestStore opens the given files, each with content equal to its name,
+// and returns the store and the directory holding them
+func newTestStore(t *testing.T, sub DocumentSubscriber, names ...string) (*DocumentStore, string) {
+	t.Helper()
+	dir := t.TempDir()
+	st := NewDocumentStore(NewMultiLSPManager(), 0)
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := st.Open(path, sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return st, dir
+}
+
+func TestDocumentStoreHasOpen(t *testing.T) {
+	st, dir := newTestStore(t, &recordingSubscriber{}, "a.txt", filepath.Join("pkg", "b.txt"))
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"a.txt", true},
+		{"pkg", true},
+		{filepath.Join("pkg", "b.txt"), true},
+		{"b.txt", false},
+		{"pk", false},
+		{"a.txt.bak", false},
+	}
+	for _, tt := range tests {
+		if got := st.HasOpen(filepath.Join(dir, tt.path)); got != tt.want {
+			t.Errorf("HasOpen(%s) = %v; want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestDocumentStoreRenameOntoOpenDocument(t *testing.T) {
+	moving, target := &recordingSubscriber{}, &recordingSubscriber{}
+	st, dir := newTestStore(t, moving, "a.txt")
+	to := filepath.Join(dir, "b.txt")
+	if err := os.WriteFile(to, []byte("b"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Open(to, target); err != nil {
+		t.Fatal(err)
+	}
+
+	st.Rename(filepath.Join(dir, "a.txt"), to)
+
+	snapshot, ok := st.Snapshot(pathToURI(to))
+	if !ok || snapshot.Content != "a.txt" {
+		t.Errorf("target holds %q, %v; want the renamed buffer", snapshot.Content, ok)
+	}
+	if len(moving.renamed) != 1 || moving.renamed[0] != pathToURI(to) {
+		t.Errorf("renamed subscriber got %v", moving.renamed)
+	}
+	if len(target.disk) != 1 || target.disk[0].Change != FileDeleted.String() || target.disk[0].URI != pathToURI(to) {
+		t.Errorf("displaced subscriber got %+v; want the target reported deleted", target.disk)
+	}
+	if st.HasOpen(filepath.Join(dir, "a.txt")) {
+		t.Error("the old path is still open")
+	}
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// swapContextLines is how many unchanged lines surround each change in the
+// diff offered with a recovery
+const swapContextLines = 3
+
+// DefaultStateDir returns where per-user editor state is kept:
+// $XDG_STATE_HOME/simpletor, or ~/.local/state/simpletor
+func DefaultStateDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "simpletor")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "state", "simpletor")
+	}
+	return filepath.Join(os.TempDir(), "simpletor-state")
+}
+
+// PrepareStateDir creates the state directory if needed and returns its
+// absolute path with symlinks resolved, so it can be checked against the
+// workspace root
+func PrepareStateDir(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(abs, 0700); err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// SwapFile holds the unsaved content of a buffer, so it survives a crash of
+// the server or the browser
+type SwapFile struct {
+	Path     string     `json:"path"`
+	Version  int        `json:"version"`
+	SavedAt  time.Time  `json:"savedAt"`
+	DiskHash string     `json:"diskHash"` // hash of the file the edits started from
+	Content  string     `json:"content"`
+	Format   TextFormat `json:"format"`
+}
+
+// SwapStore keeps one swap file per path in a directory outside the
+// workspace, named after a hash of the path
+type SwapStore struct {
+	dir string
+}
+
+// NewSwapStore stores swap files below stateDir
+func NewSwapStore(stateDir string) (*SwapStore, error) {
+	dir := filepath.Join(stateDir, "swap")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &SwapStore{dir: dir}, nil
+}
+
+func (s *SwapStore) file(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:16])+".swp")
+}
+
+// Write replaces the swap file of swap.Path
+func (s *SwapStore) Write(swap SwapFile) error {
+	data, err := json.Marshal(swap)
+	if err != nil {
+		return err
+	}
+	return WriteFile(s.file(swap.Path), string(data))
+}
+
+// Read returns the swap file of path, or nil if there is none
+func (s *SwapStore) Read(path string) (*SwapFile, error) {
+	data, err := os.ReadFile(s.file(path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var swap SwapFile
+	if err := json.Unmarshal(data, &swap); err != nil {
+		return nil, err
+	}
+	// Guard against a hash collision, however unlikely
+	if swap.Path != path {
+		return nil, nil
+	}
+	return &swap, nil
+}
+
+// Remove deletes the swap file of path, if any
+func (s *SwapStore) Remove(path string) error {
+	err := os.Remove(s.file(path))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// SwapWriter periodically writes a swap file for every dirty buffer in a
+// document store, and removes them once the buffers are saved or reverted
+type SwapWriter struct {
+	store     *DocumentStore
+	swaps     *SwapStore
+	written   map[string]int // path -> version its swap file holds
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSwapWriter starts writing swap files every interval
+func NewSwapWriter(store *DocumentStore, swaps *SwapStore, interval time.Duration) *SwapWriter {
+	w := &SwapWriter{
+		store:   store,
+		swaps:   swaps,
+		written: make(map[string]int),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go w.run(interval)
+	return w
+}
+
+// Close writes the latest dirty buffers one last time and stops the writer.
+// Swap files are kept, so unsaved edits survive a restart.
+func (w *SwapWriter) Close() {
+	w.closeOnce.Do(func() {
+		close(w.stop)
+		<-w.done
+	})
+}
+
+func (w *SwapWriter) run(interval time.Duration) {
+	defer close(w.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.flush()
+		case <-w.stop:
+			w.flush()
+			return
+		}
+	}
+}
+
+// flush writes swap files for buffers edited since the last flush and
+// removes those of buffers that are no longer dirty
+func (w *SwapWriter) flush() {
+	dirty := w.store.dirtyBuffers()
+
+	for _, buf := range dirty {
+		if version, ok := w.written[buf.path]; ok && version == buf.version {
+			continue
+		}
+		err := w.swaps.Write(SwapFile{
+			Path:     buf.path,
+			Version:  buf.version,
+			SavedAt:  time.Now(),
+			DiskHash: buf.disk.Hash,
+			Content:  buf.text.String(),
+			Format:   buf.format,
+		})
+		if err != nil {
+			log.Printf("Failed to write swap file for %s: %v", buf.path, err)
+			continue
+		}
+		w.written[buf.path] = buf.version
+	}
+
+	for path := range w.written {
+		if _, stillDirty := dirty[path]; stillDirty {
+			continue
+		}
+		if err := w.swaps.Remove(path); err != nil {
+			log.Printf("Failed to remove swap file for %s: %v", path, err)
+			continue
+		}
+		delete(w.written, path)
+	}
+}
+
+// dirtyBuffer is the state of a dirty document at one version. The rope is
+// immutable, so it can be read after the store lock is released.
+type dirtyBuffer struct {
+	path    string
+	version int
+	text    *Rope
+	format  TextFormat
+	disk    DiskStamp
+}
+
+// dirtyBuffers returns every open document with unsaved changes, by path
+func (st *DocumentStore) dirtyBuffers() map[string]dirtyBuffer {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	dirty := make(map[string]dirtyBuffer)
+	for _, entry := range st.entries {
+		doc := entry.doc
+		if !doc.Dirty {
+			continue
+		}
+		dirty[doc.Path] = dirtyBuffer{
+			path:    doc.Path,
+			version: doc.Version,
+			text:    doc.Text,
+			format:  doc.Format,
+			disk:    doc.Disk,
+		}
+	}
+	return dirty
+}
+
+type RecoverFilePayload struct {
+	URI    string `json:"uri"`
+	Action string `json:"action"` // "restore" or "discard"
+}
+
+// offerRecovery tells the client about a swap file left behind for a
+// document it just opened with no unsaved edits. Swap files that match the
+// disk or are older than it are removed instead.
+func (s *session) offerRecovery(snapshot DocumentSnapshot) {
+	if s.swaps == nil || snapshot.Dirty {
+		return
+	}
+
+	swap, err := s.swaps.Read(snapshot.Path)
+	if err != nil {
+		log.Printf("Failed to read swap file for %s: %v", snapshot.Path, err)
+		return
+	}
+	if swap == nil {
+		return
+	}
+
+	disk, _ := s.store.DiskStamp(snapshot.URI)
+	switch {
+	case swap.Content == snapshot.Content:
+		s.swaps.Remove(snapshot.Path)
+		return
+	case !swap.SavedAt.After(disk.ModTime):
+		log.Printf("Removing swap file for %s: the file changed on disk after it was written", snapshot.Path)
+		s.swaps.Remove(snapshot.Path)
+		return
+	}
+
+	hunks := DiffLines(snapshot.Content, swap.Content, swapContextLines)
+	s.send("recovery_available", map[string]interface{}{
+		"uri":         snapshot.URI,
+		"path":        snapshot.Path,
+		"swapTime":    swap.SavedAt,
+		"diskTime":    disk.ModTime,
+		"diskChanged": swap.DiskHash != disk.Hash,
+		"hunks":       hunks,
+		"diff":        UnifiedDiff(snapshot.Path, snapshot.Path+" (recovered)", hunks),
+	})
+}
+
+func (s *session) handleRecoverFile(raw json.RawMessage) {
+	var payload RecoverFilePayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid recover_file payload")
+		return
+	}
+	if s.swaps == nil {
+		s.sendError("Swap files are disabled")
+		return
+	}
+
+	snapshot, ok := s.store.Snapshot(payload.URI)
+	if !ok {
+		s.sendError("Failed to recover file: " + ErrDocumentNotOpen.Error())
+		return
+	}
+
+	switch payload.Action {
+	case "restore":
+		swap, err := s.swaps.Read(snapshot.Path)
+		if err == nil && swap == nil {
+			err = errors.New("no swap file")
+		}
+		if err == nil {
+			// The swap file stays until the recovered buffer is saved
+			err = s.store.Restore(payload.URI, swap.Content, swap.Format)
+		}
+		if err != nil {
+			s.sendError("Failed to recover file: " + err.Error())
+			return
+		}
+	case "discard":
+		if err := s.swaps.Remove(snapshot.Path); err != nil {
+			s.sendError("Failed to discard swap file: " + err.Error())
+			return
+		}
+	default:
+		s.sendError("Unknown recovery action: " + payload.Action)
+		return
+	}
+
+	s.send("recovery_done", map[string]interface{}{
+		"uri":    payload.URI,
+		"action": payload.Action,
+	})
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSwapStore(t *testing.T) {
+	swaps, err := NewSwapStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "a.txt")
+
+	if swap, err := swaps.Read(path); swap != nil || err != nil {
+		t.Fatalf("before any write: got %+v, %v", swap, err)
+	}
+
+	want := SwapFile{Path: path, Version: 3, DiskHash: "abc", Content: "unsaved é\n", Format: DefaultTextFormat}
+	if err := swaps.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := swaps.Read(path)
+	if err != nil || got == nil || got.Content != want.Content || got.Version != want.Version || got.Format != want.Format {
+		t.Fatalf("got %+v, %v; want %+v", got, err, want)
+	}
+
+	// A swap file that names another path is not this one's
+	other := want
+	other.Path = path + ".other"
+	if err := WriteFile(swaps.file(path), `{"path":"`+other.Path+`"}`); err != nil {
+		t.Fatal(err)
+	}
+	if swap, err := swaps.Read(path); swap != nil || err != nil {
+		t.Errorf("swap file of another path: got %+v, %v", swap, err)
+	}
+
+	if err := swaps.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := swaps.Remove(path); err != nil {
+		t.Errorf("removing a missing swap file: %v", err)
+	}
+	if _, err := os.Stat(swaps.file(path)); !os.IsNotExist(err) {
+		t.Errorf("swap file still there: %v", err)
+	}
+}
+
+func TestSwapWriterFlush(t *testing.T) {
+	st, dir := newTestStore(t, &recordingSubscriber{}, "a.txt")
+	path := filepath.Join(dir, "a.txt")
+	uri := pathToURI(path)
+	swaps, err := NewSwapStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flushed by hand rather than on a timer
+	w := &SwapWriter{store: st, swaps: swaps, written: make(map[string]int)}
+
+	w.flush()
+	if swap, _ := swaps.Read(path); swap != nil {
+		t.Fatal("swap file written for a clean buffer")
+	}
+
+	version, err := st.ApplyDelta(uri, 0, 0, 0, OffsetUnitUTF16, "edited ", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.flush()
+	swap, err := swaps.Read(path)
+	if err != nil || swap == nil || swap.Content != "edited a.txt" || swap.Version != version {
+		t.Fatalf("after an edit: got %+v, %v", swap, err)
+	}
+
+	// An unchanged buffer is not written again
+	if err := swaps.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	w.flush()
+	if swap, _ := swaps.Read(path); swap != nil {
+		t.Error("swap file rewritten for an unchanged version")
+	}
+
+	snapshot, _ := st.Snapshot(uri)
+	stamp, err := StampWritten(path, snapshot.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.MarkSaved(uri, snapshot.Content, snapshot.Version, stamp, nil)
+	if err := swaps.Write(*swap); err != nil {
+		t.Fatal(err)
+	}
+	w.flush()
+	if swap, _ := swaps.Read(path); swap != nil {
+		t.Error("swap file kept after the buffer was saved")
+	}
+}
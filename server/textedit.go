@@ -0,0 +1,95 @@
+package server
+
+import (
+	"errors"
+	"sort"
+)
+
+// Position is an LSP position; Character counts UTF-16 code units
+type Position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+// Range is an LSP range
+type Range struct {
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+}
+
+// TextEdit is an LSP text edit
+type TextEdit struct {
+	Range   Range  `json:"range"`
+	NewText string `json:"newText"`
+}
+
+// byteEdit is a TextEdit resolved to byte offsets in a specific content
+type byteEdit struct {
+	from, to int
+	text     string
+}
+
+// resolveTextEdits converts edits to byte offsets, ordered from the end of
+// the document to the start so they can be applied one after another.
+// Overlapping edits are rejected.
+func resolveTextEdits(text *Rope, edits []TextEdit) ([]byteEdit, error) {
+	resolved := make([]byteEdit, len(edits))
+	for i, edit := range edits {
+		from := text.OffsetForPosition(edit.Range.Start)
+		to := text.OffsetForPosition(edit.Range.End)
+		if from > to {
+			return nil, errors.New("text edit range ends before it starts")
+		}
+		resolved[i] = byteEdit{from: from, to: to, text: edit.NewText}
+	}
+	return orderByteEdits(resolved)
+}
+
+// orderByteEdits sorts edits whose offsets all refer to the same content
+// from the end of the document to the start, rejecting overlaps
+func orderByteEdits(resolved []byteEdit) ([]byteEdit, error) {
+	// Inserts at the same position keep their array order, so among equal
+	// starts the later edit must be applied first
+	order := make([]int, len(resolved))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		ea, eb := resolved[order[a]], resolved[order[b]]
+		if ea.from != eb.from {
+			return ea.from > eb.from
+		}
+		return order[a] > order[b]
+	})
+
+	sorted := make([]byteEdit, len(resolved))
+	for i, idx := range order {
+		sorted[i] = resolved[idx]
+	}
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].to > sorted[i-1].from {
+			return nil, errors.New("overlapping text edits")
+		}
+	}
+
+	return sorted, nil
+}
+
+// ApplyTextEdits applies LSP text edits to content
+func ApplyTextEdits(content string, edits []TextEdit) (string, error) {
+	text := NewRope(content)
+	resolved, err := resolveTextEdits(text, edits)
+	if err != nil {
+		return "", err
+	}
+	return applyByteEdits(text, resolved).String(), nil
+}
+
+// applyByteEdits applies edits ordered by orderByteEdits; going from the end
+// backwards keeps the earlier offsets valid
+func applyByteEdits(text *Rope, edits []byteEdit) *Rope {
+	for _, edit := range edits {
+		text = text.Replace(edit.from, edit.to, edit.text)
+	}
+	return text
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOrderByteEdits(t *testing.T) {
+	tests := []struct {
+		name    string
+		edits   []byteEdit
+		want    []byteEdit
+		wantErr bool
+	}{
+		{
+			name:  "sorted from the end",
+			edits: []byteEdit{{0, 1, "a"}, {4, 5, "b"}, {2, 3, "c"}},
+			want:  []byteEdit{{4, 5, "b"}, {2, 3, "c"}, {0, 1, "a"}},
+		},
+		{
+			name:  "inserts at one position keep their order",
+			edits: []byteEdit{{3, 3, "1"}, {3, 3, "2"}, {3, 3, "3"}},
+			want:  []byteEdit{{3, 3, "3"}, {3, 3, "2"}, {3, 3, "1"}},
+		},
+		{
+			name:  "insert where a replacement starts",
+			edits: []byteEdit{{2, 2, "x"}, {2, 4, "y"}},
+			want:  []byteEdit{{2, 4, "y"}, {2, 2, "x"}},
+		},
+		{
+			name:  "adjacent ranges",
+			edits: []byteEdit{{0, 2, "a"}, {2, 4, "b"}},
+			want:  []byteEdit{{2, 4, "b"}, {0, 2, "a"}},
+		},
+		{
+			name:  "empty",
+			edits: []byteEdit{},
+			want:  []byteEdit{},
+		},
+		{
+			name:    "overlapping ranges",
+			edits:   []byteEdit{{0, 3, "a"}, {2, 4, "b"}},
+			wantErr: true,
+		},
+		{
+			name:    "insert inside a range",
+			edits:   []byteEdit{{1, 5, "a"}, {3, 3, "b"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := orderByteEdits(tt.edits)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v; want an error", got)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, %v; want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyTextEdits(t *testing.T) {
+	edit := func(startLine, startChar, endLine, endChar int, text string) TextEdit {
+		return TextEdit{
+			Range:   Range{Start: Position{startLine, startChar}, End: Position{endLine, endChar}},
+			NewText: text,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		edits   []TextEdit
+		want    string
+		wantErr bool
+	}{
+		{"replace a word", "hello world\n", []TextEdit{edit(0, 6, 0, 11, "there")}, "hello there\n", false},
+		{"edits in any order", "ab\ncd\n", []TextEdit{edit(1, 0, 1, 1, "C"), edit(0, 0, 0, 1, "A")}, "Ab\nCd\n", false},
+		{"inserts at one position in array order", "x", []TextEdit{edit(0, 0, 0, 0, "1"), edit(0, 0, 0, 0, "2")}, "12x", false},
+		{"utf-16 positions after an emoji", "😀ab", []TextEdit{edit(0, 2, 0, 3, "A")}, "😀Ab", false},
+		{"join lines", "a\nb\n", []TextEdit{edit(0, 1, 1, 0, " ")}, "a b\n", false},
+		{"position past the end of a line is clamped", "ab\ncd", []TextEdit{edit(0, 99, 0, 99, "!")}, "ab!\ncd", false},
+		{"position past the end of the document", "ab", []TextEdit{edit(5, 0, 5, 0, "!")}, "ab!", false},
+		{"range ending before its start", "abc", []TextEdit{edit(0, 2, 0, 1, "x")}, "", true},
+		{"overlapping edits", "abc", []TextEdit{edit(0, 0, 0, 2, "x"), edit(0, 1, 0, 3, "y")}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ApplyTextEdits(tt.content, tt.edits)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("got %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// FileChangeType matches the LSP FileChangeType enumeration
+type FileChangeType int
+
+const (
+	FileCreated FileChangeType = 1
+	FileChanged FileChangeType = 2
+	FileDeleted FileChangeType = 3
+)
+
+func (t FileChangeType) String() string {
+	switch t {
+	case FileCreated:
+		return "created"
+	case FileDeleted:
+		return "deleted"
+	default:
+		return "changed"
+	}
+}
+
+// FileEvent is a single change observed on disk
+type FileEvent struct {
+	Path string
+	Type FileChangeType
+}
+
+// watcherBackend produces raw file events for a workspace
+type watcherBackend interface {
+	run(emit func(FileEvent))
+	close()
+}
+
+const (
+	// watchDebounce is how long the event stream must be quiet before a
+	// batch is delivered
+	watchDebounce = 100 * time.Millisecond
+	// watchMaxLatency is the longest a batch waits after its first event, so
+	// a file written continuously does not hold back every other change
+	watchMaxLatency = time.Second
+)
+
+// Watcher reports changes below the workspace root in debounced batches.
+// It uses inotify where available and falls back to polling.
+type Watcher struct {
+	workspace *Workspace
+	backend   watcherBackend
+	raw       chan FileEvent
+	events    chan []FileEvent
+	closeOnce sync.Once
+}
+
+// NewWatcher starts watching the workspace. pollInterval is used when the
+// platform watcher is unavailable.
+func NewWatcher(workspace *Workspace, pollInterval time.Duration) *Watcher {
+	backend, err := newPlatformWatcher(workspace)
+	if err != nil {
+		log.Printf("Native file watching unavailable (%v), polling every %s", err, pollInterval)
+		backend = newPollWatcher(workspace, pollInterval)
+	}
+
+	w := &Watcher{
+		workspace: workspace,
+		backend:   backend,
+		raw:       make(chan FileEvent, 1024),
+		events:    make(chan []FileEvent, 16),
+	}
+
+	go func() {
+		backend.run(func(ev FileEvent) {
+			w.raw <- ev
+		})
+		close(w.raw)
+	}()
+	go w.debounce()
+
+	return w
+}
+
+// Events returns the channel of event batches; it is closed when the watcher stops
+func (w *Watcher) Events() <-chan []FileEvent {
+	return w.events
+}
+
+// Close stops the watcher
+func (w *Watcher) Close() {
+	w.closeOnce.Do(func() {
+		w.backend.close()
+	})
+}
+
+// debounce coalesces raw events per path and delivers them as one batch once
+// the stream has been quiet for watchDebounce, or watchMaxLatency after the
+// batch began. A batch the consumer has no room for is kept and merged into
+// the next one rather than dropped.
+func (w *Watcher) debounce() {
+	pending := make(map[string]FileChangeType)
+	first := make(map[string]FileChangeType) // each path's first event in the batch
+	var order []string
+	var deadline time.Time // when the current batch must go out
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	reset := func(wait time.Duration) {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+	}
+	schedule := func() {
+		if deadline.IsZero() {
+			deadline = time.Now().Add(watchMaxLatency)
+		}
+		wait := watchDebounce
+		if left := time.Until(deadline); left < wait {
+			wait = left
+		}
+		reset(wait)
+	}
+
+	for {
+		select {
+		case ev, ok := <-w.raw:
+			if !ok {
+				close(w.events)
+				return
+			}
+			// Drop stale .gitignore rules before they decide on this event
+			w.workspace.Ignore().Invalidate(ev)
+			if w.workspace.Ignore().Ignored(ev.Path, false) {
+				continue
+			}
+			initial, seen := first[ev.Path]
+			if !seen {
+				first[ev.Path] = ev.Type
+				order = append(order, ev.Path)
+				pending[ev.Path] = ev.Type
+				schedule()
+				continue
+			}
+
+			switch {
+			case ev.Type == FileDeleted && initial == FileCreated:
+				// Short-lived files, such as the temporary file of an atomic
+				// save, did not exist before the batch and are not worth
+				// reporting
+				delete(pending, ev.Path)
+				delete(first, ev.Path)
+				for i, path := range order {
+					if path == ev.Path {
+						order = append(order[:i], order[i+1:]...)
+						break
+					}
+				}
+				continue
+			case ev.Type == FileDeleted:
+				pending[ev.Path] = FileDeleted
+			case initial == FileCreated:
+				// A file created and then written within one batch is still new
+				pending[ev.Path] = FileCreated
+			default:
+				// The file existed before the batch and exists after it, even
+				// if it was deleted and recreated in between
+				pending[ev.Path] = FileChanged
+			}
+			schedule()
+
+		case <-timer.C:
+			if len(order) == 0 {
+				continue
+			}
+			batch := make([]FileEvent, 0, len(order))
+			for _, path := range order {
+				batch = append(batch, FileEvent{Path: path, Type: pending[path]})
+			}
+
+			select {
+			case w.events <- batch:
+				pending = make(map[string]FileChangeType)
+				first = make(map[string]FileChangeType)
+				order = nil
+				deadline = time.Time{}
+			default:
+				// Keep the events; later ones coalesce with them as usual
+				log.Printf("File event channel full, holding %d events for the next batch", len(batch))
+				deadline = time.Now().Add(watchDebounce)
+				reset(watchDebounce)
+			}
+		}
+	}
+}
+
+// ForwardFileEvents delivers watcher batches to the document store, the file
+// index and the LSP servers that registered for file events
+func ForwardFileEvents(w *Watcher, store *DocumentStore, index *FileIndex, lspManager *MultiLSPManager) {
+	for batch := range w.Events() {
+		store.HandleFileEvents(batch)
+		index.Update(batch)
+		lspManager.NotifyFileEvents(batch)
+	}
+}
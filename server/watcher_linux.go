@@ -0,0 +1,145 @@
+package server
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF
+
+// inotifyWatcher watches every non-ignored directory of the workspace with inotify
+type inotifyWatcher struct {
+	workspace *Workspace
+	file      *os.File
+	fd        int
+	mu        sync.Mutex
+	watches   map[int]string // watch descriptor -> directory
+}
+
+func newPlatformWatcher(workspace *Workspace) (watcherBackend, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &inotifyWatcher{
+		workspace: workspace,
+		// A non-blocking fd wrapped in os.File uses the runtime poller, so
+		// Close unblocks a pending Read
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		fd:      fd,
+		watches: make(map[int]string),
+	}
+
+	if err := w.addTree(workspace.Root(), nil); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// addTree adds watches for dir and every non-ignored directory below it.
+// When emit is non-nil, files found are reported as created; this covers
+// directories that appear (or are moved in) after watching started.
+func (w *inotifyWatcher) addTree(dir string, emit func(FileEvent)) error {
+	ignore := w.workspace.Ignore()
+
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != w.workspace.Root() && ignore.Ignored(path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if emit != nil && path != dir {
+			emit(FileEvent{Path: path, Type: FileCreated})
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, path, inotifyMask)
+		if err != nil {
+			// Running out of watches is fatal only for the root
+			if path == w.workspace.Root() {
+				return err
+			}
+			log.Printf("Warning: cannot watch %s: %v", path, err)
+			return filepath.SkipDir
+		}
+
+		w.mu.Lock()
+		w.watches[wd] = path
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) run(emit func(FileEvent)) {
+	buf := make([]byte, 64*1024)
+
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= n {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + int(raw.Len)
+			offset = nameEnd
+
+			if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				log.Printf("Warning: inotify queue overflow, some file events were lost")
+				continue
+			}
+
+			w.mu.Lock()
+			dir, ok := w.watches[int(raw.Wd)]
+			if raw.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.watches, int(raw.Wd))
+			}
+			w.mu.Unlock()
+			if !ok || raw.Len == 0 {
+				continue
+			}
+
+			name := string(buf[nameStart:nameEnd])
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			path := filepath.Join(dir, name)
+			isDir := raw.Mask&syscall.IN_ISDIR != 0
+
+			switch {
+			case raw.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+				emit(FileEvent{Path: path, Type: FileCreated})
+				if isDir {
+					w.addTree(path, emit)
+				}
+			case raw.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+				emit(FileEvent{Path: path, Type: FileDeleted})
+			case raw.Mask&(syscall.IN_MODIFY|syscall.IN_CLOSE_WRITE) != 0:
+				if !isDir {
+					emit(FileEvent{Path: path, Type: FileChanged})
+				}
+			}
+		}
+	}
+}
+
+func (w *inotifyWatcher) close() {
+	w.file.Close()
+}
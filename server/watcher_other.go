@@ -0,0 +1,9 @@
+//go:build !linux
+
+package server
+
+import "errors"
+
+func newPlatformWatcher(workspace *Workspace) (watcherBackend, error) {
+	return nil, errors.New("no native file watcher on this platform")
+}
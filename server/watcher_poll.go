@@ -0,0 +1,94 @@
+package server
+
+import (
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+type pollState struct {
+	modTime time.Time
+	size    int64
+	isDir   bool
+}
+
+// pollWatcher detects changes by rescanning the workspace periodically
+type pollWatcher struct {
+	workspace *Workspace
+	interval  time.Duration
+	done      chan struct{}
+}
+
+func newPollWatcher(workspace *Workspace, interval time.Duration) *pollWatcher {
+	return &pollWatcher{
+		workspace: workspace,
+		interval:  interval,
+		done:      make(chan struct{}),
+	}
+}
+
+func (p *pollWatcher) run(emit func(FileEvent)) {
+	prev := p.scan()
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		cur := p.scan()
+		for path, st := range cur {
+			old, existed := prev[path]
+			switch {
+			case !existed:
+				emit(FileEvent{Path: path, Type: FileCreated})
+			case !st.isDir && (!st.modTime.Equal(old.modTime) || st.size != old.size):
+				emit(FileEvent{Path: path, Type: FileChanged})
+			}
+		}
+		for path := range prev {
+			if _, exists := cur[path]; !exists {
+				emit(FileEvent{Path: path, Type: FileDeleted})
+			}
+		}
+		prev = cur
+	}
+}
+
+func (p *pollWatcher) close() {
+	close(p.done)
+}
+
+// scan records the state of every non-ignored path in the workspace
+func (p *pollWatcher) scan() map[string]pollState {
+	states := make(map[string]pollState)
+	root := p.workspace.Root()
+	ignore := p.workspace.Ignore()
+
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != root && ignore.Ignored(path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		states[path] = pollState{
+			modTime: info.ModTime(),
+			size:    info.Size(),
+			isDir:   d.IsDir(),
+		}
+		return nil
+	})
+
+	return states
+}
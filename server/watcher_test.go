@@ -0,0 +1,138 @@
+package server
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestWatcher runs debounce on raw events fed by the test, without a
+// backend
+func newTestWatcher(t *testing.T, buffered int) (*Watcher, string) {
+	t.Helper()
+	root := t.TempDir()
+	workspace, err := NewWorkspace(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Watcher{
+		workspace: workspace,
+		raw:       make(chan FileEvent, 1024),
+		events:    make(chan []FileEvent, buffered),
+	}
+	go w.debounce()
+	t.Cleanup(func() { close(w.raw) })
+	return w, root
+}
+
+func receiveBatch(t *testing.T, w *Watcher, within time.Duration) []FileEvent {
+	t.Helper()
+	select {
+	case batch := <-w.Events():
+		return batch
+	case <-time.After(within):
+		t.Fatalf("no batch within %s", within)
+		return nil
+	}
+}
+
+func TestWatcherCoalescesEvents(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []FileChangeType
+		want   []FileChangeType // nil when the path is not reported
+	}{
+		{"single change", []FileChangeType{FileChanged}, []FileChangeType{FileChanged}},
+		{"repeated changes", []FileChangeType{FileChanged, FileChanged}, []FileChangeType{FileChanged}},
+		{"created then written", []FileChangeType{FileCreated, FileChanged}, []FileChangeType{FileCreated}},
+		{"created then deleted", []FileChangeType{FileCreated, FileChanged, FileDeleted}, nil},
+		{"deleted then recreated", []FileChangeType{FileDeleted, FileCreated}, []FileChangeType{FileChanged}},
+		{"deleted, recreated, deleted", []FileChangeType{FileDeleted, FileCreated, FileDeleted}, []FileChangeType{FileDeleted}},
+		{"changed then deleted", []FileChangeType{FileChanged, FileDeleted}, []FileChangeType{FileDeleted}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, root := newTestWatcher(t, 1)
+			path := filepath.Join(root, "a.txt")
+			marker := filepath.Join(root, "marker.txt")
+			for _, typ := range tt.events {
+				w.raw <- FileEvent{Path: path, Type: typ}
+			}
+			// The marker keeps the batch non-empty when the path is dropped
+			w.raw <- FileEvent{Path: marker, Type: FileChanged}
+
+			var got []FileChangeType
+			for _, ev := range receiveBatch(t, w, time.Second) {
+				if ev.Path == path {
+					got = append(got, ev.Type)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatcherMaxLatency(t *testing.T) {
+	w, root := newTestWatcher(t, 1)
+	busy := filepath.Join(root, "busy.log")
+	other := filepath.Join(root, "other.txt")
+
+	w.raw <- FileEvent{Path: other, Type: FileChanged}
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+	go func() {
+		defer close(stopped)
+		// Written more often than watchDebounce, for longer than watchMaxLatency
+		ticker := time.NewTicker(watchDebounce / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.raw <- FileEvent{Path: busy, Type: FileChanged}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	batch := receiveBatch(t, w, watchMaxLatency+watchDebounce*5)
+	found := false
+	for _, ev := range batch {
+		found = found || ev.Path == other
+	}
+	if !found {
+		t.Errorf("batch %v does not report %s", batch, other)
+	}
+}
+
+func TestWatcherHoldsBatchWhenConsumerIsBusy(t *testing.T) {
+	w, root := newTestWatcher(t, 1)
+	a := filepath.Join(root, "a.txt")
+	b := filepath.Join(root, "b.txt")
+	c := filepath.Join(root, "c.txt")
+
+	w.raw <- FileEvent{Path: a, Type: FileChanged}
+	first := receiveBatch(t, w, time.Second)
+
+	// Fill the channel, then report a deletion the consumer has no room for
+	w.events <- nil
+	w.raw <- FileEvent{Path: b, Type: FileDeleted}
+	time.Sleep(watchDebounce * 3)
+	w.raw <- FileEvent{Path: c, Type: FileCreated}
+
+	if batch := receiveBatch(t, w, time.Second); batch != nil {
+		t.Fatalf("got %v; want the filler", batch)
+	}
+	got := receiveBatch(t, w, time.Second)
+	want := []FileEvent{{Path: b, Type: FileDeleted}, {Path: c, Type: FileCreated}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("first batch %v, then %v; want %v", first, got, want)
+	}
+}
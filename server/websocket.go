@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"sync"
 
@@ -16,23 +17,78 @@ type Message struct {
 
 type OpenFilePayload struct {
 	Path string `json:"path"`
+	Mode string `json:"mode"` // "hex" to view the file as a hex dump instead of editing it
+}
+
+type CloseFilePayload struct {
+	URI string `json:"uri"`
+}
+
+type ListDirPayload struct {
+	Path           string `json:"path"`
+	IncludeIgnored bool   `json:"includeIgnored"`
+}
+
+type StatPayload struct {
+	Path string `json:"path"`
 }
 
 type ConfigureLSPPayload struct {
-	Language            string `json:"language"`
-	ServerPath          string `json:"serverPath"`
-	CompileCommandsDir  string `json:"compileCommandsDir"`
+	Language           string             `json:"language"`
+	ServerPath         string             `json:"serverPath"`
+	CompileCommandsDir string             `json:"compileCommandsDir"`
+	FormatOnSave       bool               `json:"formatOnSave"`
+	Formatting         *FormattingOptions `json:"formatting"`        // defaults to DefaultFormattingOptions
+	CodeActionsOnSave  []string           `json:"codeActionsOnSave"` // kinds such as "source.organizeImports", in order
 }
 
 type DeltaPayload struct {
+	URI     string `json:"uri"`
+	Version int    `json:"version"` // version the edit is based on; 0 skips the check
 	FromPos int    `json:"fromPos"`
 	ToPos   int    `json:"toPos"`
+	Unit    string `json:"unit"` // "utf16" (the default), "utf8" or "rune"
 	Insert  string `json:"insert"`
 }
 
+// DeltaBatchPayload carries every change of one editor transaction. All
+// positions refer to the document at Version, as in a CodeMirror ChangeSet.
+type DeltaBatchPayload struct {
+	URI     string          `json:"uri"`
+	Version int             `json:"version"`
+	Unit    string          `json:"unit"`
+	Changes []ContentChange `json:"changes"`
+}
+
 type SavePayload struct {
-	Path    string `json:"path"`
-	Content string `json:"content"`
+	Path     string `json:"path"`
+	Mode     string `json:"mode"`     // "buffer" writes the server buffer; default writes Content
+	Content  string `json:"content"`  // only used without buffer mode
+	Checksum string `json:"checksum"` // buffer mode: ContentChecksum of the client's copy
+	Force    bool   `json:"force"`    // overwrite even if the file changed on disk
+	NoFormat bool   `json:"noFormat"` // skip code actions and formatting on save
+}
+
+// OpenedDocument is sent in file_opened: the document along with the
+// EditorConfig properties that apply to it
+type OpenedDocument struct {
+	DocumentSnapshot
+	EditorConfig EditorConfig `json:"editorConfig"`
+}
+
+type ReloadFilePayload struct {
+	URI string `json:"uri"`
+}
+
+// SetFileFormatPayload changes how a document is saved. Empty fields keep
+// their current value. With Reopen set, the file is instead read again from
+// disk decoded as Encoding, discarding unsaved edits.
+type SetFileFormatPayload struct {
+	URI        string `json:"uri"`
+	Encoding   string `json:"encoding"`
+	LineEnding string `json:"lineEnding"`
+	BOM        *bool  `json:"bom"`
+	Reopen     bool   `json:"reopen"`
 }
 
 type LSPRequestPayload struct {
@@ -41,34 +97,59 @@ type LSPRequestPayload struct {
 	Params json.RawMessage `json:"params"`
 }
 
-// HandleWebSocket handles WebSocket connections
-func HandleWebSocket(c *websocket.Conn) {
-	lspManager := c.Locals("lspManager").(*MultiLSPManager)
+// session holds the state of a single WebSocket connection
+type session struct {
+	conn         *websocket.Conn
+	lspManager   *MultiLSPManager
+	workspace    *Workspace
+	store        *DocumentStore
+	swaps        *SwapStore    // nil when swap files are disabled
+	localHistory *LocalHistory // nil when local history is disabled
+	fileIndex    *FileIndex
+
+	mu       sync.Mutex
+	docs     map[string]struct{} // URIs this connection has open in the store
+	searches map[int]*searchRun  // running searches by client-chosen ID
+
+	// queued is closed once the latest job passed to queue is done; only
+	// the read loop touches it
+	queued chan struct{}
+
+	writeMu sync.Mutex
+}
+
+// send writes a message to the client; safe for concurrent use
+func (s *session) send(msgType string, payload interface{}) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteJSON(map[string]interface{}{
+		"type":    msgType,
+		"payload": payload,
+	})
+}
 
-	var currentFile string
-	var currentContent string
-	var mu sync.Mutex
+func (s *session) sendError(message string) {
+	s.send("error", map[string]string{
+		"message": message,
+	})
+}
 
-	// Send LSP notifications to client
-	go func() {
-		notifChan := lspManager.GetNotificationChan()
-		for notification := range notifChan {
-			// Unmarshal the notification so it gets sent as an object, not raw bytes
-			var notifObj interface{}
-			if err := json.Unmarshal(notification, &notifObj); err != nil {
-				log.Printf("Failed to unmarshal notification: %v", err)
-				continue
-			}
-
-			response := map[string]interface{}{
-				"type":    "lsp_notification",
-				"payload": notifObj,
-			}
-			if err := c.WriteJSON(response); err != nil {
-				return
-			}
-		}
-	}()
+// HandleWebSocket handles WebSocket connections
+func HandleWebSocket(c *websocket.Conn) {
+	s := &session{
+		conn:         c,
+		lspManager:   c.Locals("lspManager").(*MultiLSPManager),
+		workspace:    c.Locals("workspace").(*Workspace),
+		store:        c.Locals("documentStore").(*DocumentStore),
+		swaps:        c.Locals("swapStore").(*SwapStore),
+		localHistory: c.Locals("localHistory").(*LocalHistory),
+		fileIndex:    c.Locals("fileIndex").(*FileIndex),
+		docs:         make(map[string]struct{}),
+		searches:     make(map[int]*searchRun),
+	}
+	s.store.Attach(s)
+	defer s.store.Detach(s)
+	defer s.closeAll()
 
 	for {
 		var msg Message
@@ -81,207 +162,461 @@ func HandleWebSocket(c *websocket.Conn) {
 
 		switch msg.Type {
 		case "open_file":
-			var payload OpenFilePayload
-			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-				log.Printf("ERROR: Invalid open_file payload: %v", err)
-				sendError(c, "Invalid open_file payload")
-				continue
-			}
-
-			log.Printf("DEBUG: Opening file: %s", payload.Path)
-			content, err := ReadFile(payload.Path)
-			if err != nil {
-				log.Printf("ERROR: Failed to read file %s: %v", payload.Path, err)
-				sendError(c, "Failed to read file: "+err.Error())
-				continue
-			}
-
-			log.Printf("DEBUG: File read successfully, length: %d bytes", len(content))
-			mu.Lock()
-			currentFile = payload.Path
-			currentContent = content
-			mu.Unlock()
-
-			response := map[string]interface{}{
-				"type": "file_opened",
-				"payload": map[string]string{
-					"path":    payload.Path,
-					"content": content,
-				},
-			}
-			log.Printf("DEBUG: Sending file_opened response")
-			c.WriteJSON(response)
-			log.Printf("DEBUG: file_opened response sent")
-
-			// Notify LSP about opened file
-			if err := lspManager.RouteNotification("textDocument/didOpen", map[string]interface{}{
-				"textDocument": map[string]interface{}{
-					"uri":        "file://" + payload.Path,
-					"languageId": detectLanguage(payload.Path),
-					"version":    1,
-					"text":       content,
-				},
-			}); err != nil {
-				log.Printf("Warning: Failed to notify LSP about opened file: %v", err)
-			}
-
+			s.handleOpenFile(msg.Payload)
+		case "close_file":
+			s.handleCloseFile(msg.Payload)
+		case "list_dir":
+			s.handleListDir(msg.Payload)
+		case "stat":
+			s.handleStat(msg.Payload)
+		case "create_file":
+			s.handleCreateFile(msg.Payload)
+		case "create_dir":
+			s.handleCreateDir(msg.Payload)
+		case "rename_path":
+			s.handleRenamePath(msg.Payload)
+		case "delete_path":
+			s.handleDeletePath(msg.Payload)
 		case "configure_lsp":
-			var payload ConfigureLSPPayload
-			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-				sendError(c, "Invalid configure_lsp payload")
-				continue
-			}
-
-			language := payload.Language
-			if language == "" {
-				sendError(c, "Language is required")
-				continue
-			}
-
-			serverPath := payload.ServerPath
-			if serverPath == "" {
-				// Set default server paths
-				if language == "cpp" {
-					serverPath = "clangd"
-				} else if language == "python" {
-					serverPath = "pylsp"
-				} else {
-					sendError(c, "Unknown language: "+language)
-					continue
-				}
-			}
-
-			// Start the LSP server
-			if err := lspManager.StartLSP(language, serverPath, payload.CompileCommandsDir); err != nil {
-				sendError(c, "Failed to start LSP: "+err.Error())
-				continue
-			}
-
-			// Initialize LSP
-			rootDir := payload.CompileCommandsDir
-			if rootDir == "" {
-				rootDir = "/"
-			}
-			if err := lspManager.InitializeLSP(language, rootDir); err != nil {
-				sendError(c, "Failed to initialize LSP: "+err.Error())
-				continue
-			}
-
-			response := map[string]interface{}{
-				"type": "lsp_configured",
-				"payload": map[string]interface{}{
-					"success":  true,
-					"language": language,
-				},
-			}
-			c.WriteJSON(response)
-
+			s.handleConfigureLSP(msg.Payload)
 		case "delta":
-			var payload DeltaPayload
-			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-				sendError(c, "Invalid delta payload")
-				continue
-			}
-
-			mu.Lock()
-			newContent, err := ApplyDelta(currentContent, payload.FromPos, payload.ToPos, payload.Insert)
-			if err != nil {
-				mu.Unlock()
-				sendError(c, "Failed to apply delta: "+err.Error())
-				continue
-			}
-			currentContent = newContent
-			mu.Unlock()
-
-			// Notify LSP about change
-			if err := lspManager.RouteNotification("textDocument/didChange", map[string]interface{}{
-				"textDocument": map[string]interface{}{
-					"uri":     "file://" + currentFile,
-					"version": 1,
-				},
-				"contentChanges": []interface{}{
-					map[string]interface{}{
-						"text": currentContent,
-					},
-				},
-			}); err != nil {
-				log.Printf("Warning: Failed to notify LSP about change: %v", err)
-			}
-
+			s.handleDelta(msg.Payload)
+		case "delta_batch":
+			s.handleDeltaBatch(msg.Payload)
+		case "undo":
+			s.handleUndo(msg.Payload)
+		case "redo":
+			s.handleRedo(msg.Payload)
 		case "save":
-			var payload SavePayload
-			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-				sendError(c, "Invalid save payload")
-				continue
-			}
-
-			if err := WriteFile(payload.Path, payload.Content); err != nil {
-				sendError(c, "Failed to save file: "+err.Error())
-				continue
-			}
-
-			response := map[string]interface{}{
-				"type": "file_saved",
-				"payload": map[string]bool{
-					"success": true,
-				},
-			}
-			c.WriteJSON(response)
-
-			// Notify LSP about save
-			if err := lspManager.RouteNotification("textDocument/didSave", map[string]interface{}{
-				"textDocument": map[string]interface{}{
-					"uri": "file://" + payload.Path,
-				},
-			}); err != nil {
-				log.Printf("Warning: Failed to notify LSP about save: %v", err)
-			}
-
+			s.handleSave(msg.Payload)
+		case "read_range":
+			s.handleReadRange(msg.Payload)
+		case "reload_file":
+			s.handleReloadFile(msg.Payload)
+		case "set_file_format":
+			s.handleSetFileFormat(msg.Payload)
+		case "recover_file":
+			s.handleRecoverFile(msg.Payload)
+		case "history_list":
+			s.handleHistoryList(msg.Payload)
+		case "history_get":
+			s.handleHistoryGet(msg.Payload)
+		case "history_restore":
+			s.handleHistoryRestore(msg.Payload)
+		case "find_files":
+			s.handleFindFiles(msg.Payload)
+		case "search":
+			s.handleSearch(msg.Payload)
+		case "search_cancel":
+			s.handleSearchCancel(msg.Payload)
+		case "replace_preview":
+			s.handleReplacePreview(msg.Payload)
+		case "replace_apply":
+			s.queue(s.handleReplaceApply, msg.Payload)
+		case "git_status":
+			s.queue(s.handleGitStatus, msg.Payload)
+		case "git_diff":
+			s.queue(s.handleGitDiff, msg.Payload)
+		case "git_blame":
+			s.queue(s.handleGitBlame, msg.Payload)
+		case "git_stage":
+			s.queue(s.handleGitStage, msg.Payload)
+		case "git_unstage":
+			s.queue(s.handleGitUnstage, msg.Payload)
+		case "git_commit":
+			s.queue(s.handleGitCommit, msg.Payload)
 		case "lsp_request":
-			var payload LSPRequestPayload
-			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-				sendError(c, "Invalid lsp_request payload")
-				continue
-			}
-
-			var params interface{}
-			if len(payload.Params) > 0 {
-				json.Unmarshal(payload.Params, &params)
-			}
-
-			result, err := lspManager.RouteRequest(payload.Method, params)
-			if err != nil {
-				sendError(c, "LSP request failed: "+err.Error())
-				continue
-			}
-
-			// Return response with the client's original ID
-			// Parse the LSP result to get the actual completion data
-			var lspResponse map[string]interface{}
-			json.Unmarshal(result, &lspResponse)
-
-			response := map[string]interface{}{
-				"type": "lsp_response",
-				"payload": map[string]interface{}{
-					"id":      payload.ID,  // Use client's ID
-					"jsonrpc": "2.0",
-					"result":  lspResponse["result"],  // Extract just the result, not the whole LSP response
-				},
-			}
-			c.WriteJSON(response)
-
+			s.handleLSPRequest(msg.Payload)
 		default:
-			sendError(c, "Unknown message type: "+msg.Type)
+			s.sendError("Unknown message type: " + msg.Type)
+		}
+	}
+}
+
+func (s *session) handleOpenFile(raw json.RawMessage) {
+	var payload OpenFilePayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		log.Printf("ERROR: Invalid open_file payload: %v", err)
+		s.sendError("Invalid open_file payload")
+		return
+	}
+
+	path, err := s.workspace.Resolve(payload.Path)
+	if err != nil {
+		log.Printf("ERROR: Rejected path %s: %v", payload.Path, err)
+		s.sendError("Failed to open file: " + err.Error())
+		return
+	}
+
+	if payload.Mode == previewModeHex {
+		s.sendPreview(path, previewModeHex, "")
+		return
+	}
+
+	log.Printf("DEBUG: Opening file: %s", path)
+	snapshot, err := s.store.Open(path, s)
+	var tooLarge *FileTooLargeError
+	switch {
+	case errors.Is(err, ErrBinaryFile):
+		s.sendPreview(path, previewModeHex, err.Error())
+		return
+	case errors.As(err, &tooLarge):
+		s.sendPreview(path, previewModePaged, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to read file %s: %v", path, err)
+		s.sendError("Failed to read file: " + err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	s.docs[snapshot.URI] = struct{}{}
+	s.mu.Unlock()
+
+	s.send("file_opened", OpenedDocument{
+		DocumentSnapshot: snapshot,
+		EditorConfig:     LoadEditorConfig(path),
+	})
+	s.offerRecovery(snapshot)
+}
+
+func (s *session) handleCloseFile(raw json.RawMessage) {
+	var payload CloseFilePayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid close_file payload")
+		return
+	}
+
+	s.mu.Lock()
+	_, exists := s.docs[payload.URI]
+	delete(s.docs, payload.URI)
+	s.mu.Unlock()
+
+	if exists {
+		s.store.Close(payload.URI, s)
+	}
+}
+
+// queue runs a handler that may take a while, such as one waiting on git or
+// rewriting many files, in the background so the connection's edits keep
+// flowing. Queued handlers run one at a time, in the order they arrived, so
+// a commit still sees the files staged before it.
+func (s *session) queue(handle func(json.RawMessage), raw json.RawMessage) {
+	previous := s.queued
+	done := make(chan struct{})
+	s.queued = done
+
+	go func() {
+		defer close(done)
+		if previous != nil {
+			<-previous
+		}
+		handle(raw)
+	}()
+}
+
+// closeAll releases every document when the connection goes away
+func (s *session) closeAll() {
+	s.mu.Lock()
+	docs := s.docs
+	s.docs = make(map[string]struct{})
+	for _, run := range s.searches {
+		run.cancel()
+	}
+	s.mu.Unlock()
+
+	for uri := range docs {
+		s.store.Close(uri, s)
+	}
+}
+
+// DocumentChanged forwards an edit made by another connection
+func (s *session) DocumentChanged(change DocumentChange) {
+	s.send("document_changed", change)
+}
+
+// DocumentSaved tells the client another connection saved the document
+func (s *session) DocumentSaved(uri string, version int) {
+	s.send("document_saved", map[string]interface{}{
+		"uri":     uri,
+		"version": version,
+	})
+}
+
+// DocumentRenamed moves an open document to its new URI after a rename
+func (s *session) DocumentRenamed(oldURI string, doc DocumentSnapshot) {
+	s.mu.Lock()
+	if _, exists := s.docs[oldURI]; exists {
+		delete(s.docs, oldURI)
+		s.docs[doc.URI] = struct{}{}
+	}
+	s.mu.Unlock()
+
+	s.send("document_renamed", map[string]interface{}{
+		"oldUri": oldURI,
+		"uri":    doc.URI,
+		"path":   doc.Path,
+	})
+}
+
+// DocumentFormatChanged reports a new encoding or line ending style
+func (s *session) DocumentFormatChanged(uri string, format TextFormat, dirty bool) {
+	s.send("document_format_changed", map[string]interface{}{
+		"uri":    uri,
+		"format": format,
+		"dirty":  dirty,
+	})
+}
+
+// LSPNotification forwards a notification from an LSP server
+func (s *session) LSPNotification(notification json.RawMessage) {
+	// Unmarshal the notification so it gets sent as an object, not raw bytes
+	var notifObj interface{}
+	if err := json.Unmarshal(notification, &notifObj); err != nil {
+		log.Printf("Failed to unmarshal notification: %v", err)
+		return
+	}
+	s.send("lsp_notification", notifObj)
+}
+
+// FileChangedOnDisk reports a change made outside the editor
+func (s *session) FileChangedOnDisk(change DiskChange) {
+	if change.Change == FileDeleted.String() {
+		s.send("file_deleted", change)
+		return
+	}
+	s.send("file_changed_on_disk", change)
+}
+
+func (s *session) handleListDir(raw json.RawMessage) {
+	var payload ListDirPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid list_dir payload")
+		return
+	}
+
+	path, err := s.workspace.Resolve(payload.Path)
+	if err != nil {
+		s.sendError("Failed to list directory: " + err.Error())
+		return
+	}
+
+	entries, err := ListDir(path, s.workspace.Ignore(), payload.IncludeIgnored)
+	if err != nil {
+		s.sendError("Failed to list directory: " + err.Error())
+		return
+	}
+
+	s.send("dir_listing", map[string]interface{}{
+		"path":    path,
+		"entries": entries,
+	})
+}
+
+func (s *session) handleStat(raw json.RawMessage) {
+	var payload StatPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid stat payload")
+		return
+	}
+
+	path, err := s.workspace.ResolveLink(payload.Path)
+	if err != nil {
+		s.sendError("Failed to stat path: " + err.Error())
+		return
+	}
+
+	entry, err := StatPath(path)
+	if err != nil {
+		s.sendError("Failed to stat path: " + err.Error())
+		return
+	}
+	entry.Ignored = s.workspace.Ignore().Ignored(path, entry.isDir())
+
+	s.send("stat_result", entry)
+}
+
+func (s *session) handleConfigureLSP(raw json.RawMessage) {
+	var payload ConfigureLSPPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid configure_lsp payload")
+		return
+	}
+
+	language := payload.Language
+	if language == "" {
+		s.sendError("Language is required")
+		return
+	}
+
+	serverPath := payload.ServerPath
+	if serverPath == "" {
+		// Set default server paths
+		if language == "cpp" {
+			serverPath = "clangd"
+		} else if language == "python" {
+			serverPath = "pylsp"
+		} else {
+			s.sendError("Unknown language: " + language)
+			return
+		}
+	}
+
+	// Start the LSP server
+	if err := s.lspManager.StartLSP(language, serverPath, payload.CompileCommandsDir); err != nil {
+		s.sendError("Failed to start LSP: " + err.Error())
+		return
+	}
+
+	// Initialize LSP with the workspace root so it agrees with the editor
+	if err := s.lspManager.InitializeLSP(language, s.workspace.Root()); err != nil {
+		s.sendError("Failed to initialize LSP: " + err.Error())
+		return
+	}
+
+	formatting := DefaultFormattingOptions
+	if payload.Formatting != nil {
+		formatting = *payload.Formatting
+	}
+	s.lspManager.SetFormatOnSave(language, payload.FormatOnSave, formatting)
+	s.lspManager.SetCodeActionsOnSave(language, payload.CodeActionsOnSave)
+
+	s.send("lsp_configured", map[string]interface{}{
+		"success":  true,
+		"language": language,
+	})
+
+	// A restarted server has forgotten every document; reopen the ones it handles
+	s.store.ReopenLSP(language)
+}
+
+func (s *session) handleDelta(raw json.RawMessage) {
+	var payload DeltaPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid delta payload")
+		return
+	}
+
+	unit := payload.Unit
+	if unit == "" {
+		unit = DefaultOffsetUnit
+	}
+
+	_, err := s.store.ApplyDelta(payload.URI, payload.Version, payload.FromPos, payload.ToPos, unit, payload.Insert, s)
+	s.handleDeltaError(payload.URI, err)
+}
+
+func (s *session) handleDeltaBatch(raw json.RawMessage) {
+	var payload DeltaBatchPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid delta_batch payload")
+		return
+	}
+
+	unit := payload.Unit
+	if unit == "" {
+		unit = DefaultOffsetUnit
+	}
+
+	_, err := s.store.ApplyDeltaBatch(payload.URI, payload.Version, unit, payload.Changes, s)
+	s.handleDeltaError(payload.URI, err)
+}
+
+// handleDeltaError reports a rejected delta. The client's buffer no longer
+// matches the server's either way, so it is resynchronized.
+func (s *session) handleDeltaError(uri string, err error) {
+	if err == nil {
+		return
+	}
+	if err != ErrVersionMismatch {
+		s.sendError("Failed to apply delta: " + err.Error())
+	}
+	// The client edited a stale or different buffer; replace it with the current one
+	if snapshot, ok := s.store.Snapshot(uri); ok {
+		s.send("document_resync", snapshot)
+	}
+}
+
+func (s *session) handleReloadFile(raw json.RawMessage) {
+	var payload ReloadFilePayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid reload_file payload")
+		return
+	}
+
+	// Every subscriber, including this connection, gets the new buffer
+	// through document_changed
+	if err := s.store.Reload(payload.URI); err != nil {
+		s.sendError("Failed to reload file: " + err.Error())
+	}
+}
+
+func (s *session) handleSetFileFormat(raw json.RawMessage) {
+	var payload SetFileFormatPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid set_file_format payload")
+		return
+	}
+
+	if payload.Reopen {
+		if err := s.store.ReloadAs(payload.URI, payload.Encoding); err != nil {
+			s.sendError("Failed to reopen file: " + err.Error())
 		}
+		return
+	}
+
+	snapshot, ok := s.store.Snapshot(payload.URI)
+	if !ok {
+		s.sendError("Failed to change file format: " + ErrDocumentNotOpen.Error())
+		return
+	}
+
+	format := snapshot.Format
+	if payload.Encoding != "" {
+		format.Encoding = payload.Encoding
+		// Latin-1 has no BOM; UTF-16 is unreadable without one unless asked
+		format.BOM = payload.Encoding == EncodingUTF16LE || payload.Encoding == EncodingUTF16BE
+	}
+	if payload.BOM != nil {
+		format.BOM = *payload.BOM
+	}
+	if payload.LineEnding != "" {
+		format.LineEnding = payload.LineEnding
+	}
+
+	if err := s.store.SetFormat(payload.URI, format); err != nil {
+		s.sendError("Failed to change file format: " + err.Error())
 	}
 }
 
-func sendError(c *websocket.Conn, message string) {
-	c.WriteJSON(map[string]interface{}{
-		"type": "error",
-		"payload": map[string]string{
-			"message": message,
-		},
+func (s *session) handleLSPRequest(raw json.RawMessage) {
+	var payload LSPRequestPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		s.sendError("Invalid lsp_request payload")
+		return
+	}
+
+	var params interface{}
+	if len(payload.Params) > 0 {
+		json.Unmarshal(payload.Params, &params)
+	}
+
+	result, err := s.lspManager.RouteRequest(payload.Method, params)
+	if err != nil {
+		s.sendError("LSP request failed: " + err.Error())
+		return
+	}
+
+	// Return response with the client's original ID
+	// Parse the LSP result to get the actual completion data
+	var lspResponse map[string]interface{}
+	json.Unmarshal(result, &lspResponse)
+
+	s.send("lsp_response", map[string]interface{}{
+		"id":      payload.ID,  // Use client's ID
+		"jsonrpc": "2.0",
+		"result":  lspResponse["result"],  // Extract just the result, not the whole LSP response
 	})
 }
 
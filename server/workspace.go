@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// OutsideWorkspaceError is returned when a path resolves outside the workspace root
+type OutsideWorkspaceError struct {
+	Path string
+	Root string
+}
+
+func (e *OutsideWorkspaceError) Error() string {
+	return fmt.Sprintf("path %s is outside the workspace root %s", e.Path, e.Root)
+}
+
+// Workspace confines file operations to a single root directory
+type Workspace struct {
+	root   string
+	ignore *IgnoreMatcher
+}
+
+// NewWorkspace creates a workspace rooted at dir. Paths matching the exclude
+// patterns (or any .gitignore in the tree) are hidden from listings.
+func NewWorkspace(dir string, excludes []string) (*Workspace, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve symlinks so containment checks compare real paths
+	root, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("workspace root %s is not a directory", root)
+	}
+
+	return &Workspace{
+		root:   root,
+		ignore: NewIgnoreMatcher(root, excludes),
+	}, nil
+}
+
+// Root returns the absolute workspace root
+func (w *Workspace) Root() string {
+	return w.root
+}
+
+// Ignore returns the matcher for .gitignore and exclude patterns
+func (w *Workspace) Ignore() *IgnoreMatcher {
+	return w.ignore
+}
+
+// RootURI returns the workspace root as a file:// URI
+func (w *Workspace) RootURI() string {
+	return "file://" + w.root
+}
+
+// Resolve maps a client-supplied path to an absolute path inside the workspace.
+// Relative paths are taken relative to the root. Symlinks in the existing part
+// of the path are followed, so a link pointing outside the root is rejected.
+func (w *Workspace) Resolve(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(w.root, path)
+	}
+	cleanPath := filepath.Clean(path)
+
+	// The target may not exist yet (e.g. saving a new file), so resolve the
+	// longest existing prefix and re-attach the remaining components
+	existing := cleanPath
+	var rest []string
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		rest = append([]string{filepath.Base(existing)}, rest...)
+		existing = parent
+	}
+
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	resolved = filepath.Join(append([]string{resolved}, rest...)...)
+
+	if !w.Contains(resolved) {
+		return "", &OutsideWorkspaceError{Path: path, Root: w.root}
+	}
+
+	return resolved, nil
+}
+
+// ResolveLink is like Resolve but does not follow a symlink in the final path
+// component, so the link itself can be inspected
+func (w *Workspace) ResolveLink(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(w.root, path)
+	}
+	cleanPath := filepath.Clean(path)
+
+	if resolved, err := w.Resolve(cleanPath); err == nil && resolved == w.root {
+		return resolved, nil
+	}
+
+	dir, err := w.Resolve(filepath.Dir(cleanPath))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(cleanPath)), nil
+}
+
+// Contains reports whether an already resolved absolute path lies inside the root
+func (w *Workspace) Contains(path string) bool {
+	if path == w.root {
+		return true
+	}
+	return strings.HasPrefix(path, w.root+string(filepath.Separator))
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// WorkspaceEdit is an LSP workspace edit. DocumentChanges entries are either
+// TextDocumentEdits or create/rename/delete resource operations.
+type WorkspaceEdit struct {
+	Changes         map[string][]TextEdit `json:"changes"`
+	DocumentChanges []json.RawMessage     `json:"documentChanges"`
+}
+
+// workspaceEditEntry is the union of everything documentChanges may hold
+type workspaceEditEntry struct {
+	Kind         string `json:"kind"`
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Edits   []TextEdit `json:"edits"`
+	URI     string     `json:"uri"`
+	OldURI  string     `json:"oldUri"`
+	NewURI  string     `json:"newUri"`
+	Options struct {
+		Overwrite         bool `json:"overwrite"`
+		IgnoreIfExists    bool `json:"ignoreIfExists"`
+		Recursive         bool `json:"recursive"`
+		IgnoreIfNotExists bool `json:"ignoreIfNotExists"`
+	} `json:"options"`
+}
+
+// ApplyWorkspaceEdit applies an edit produced by an LSP server. Text edits to
+// open documents go through the store, so every connection sees them and the
+// buffers stay dirty until saved; other files are rewritten on disk. Every
+// target must lie inside the workspace. It returns the number of files touched.
+func ApplyWorkspaceEdit(edit WorkspaceEdit, store *DocumentStore, workspace *Workspace) (int, error) {
+	touched := 0
+
+	// documentChanges takes precedence over changes when both are present
+	if len(edit.DocumentChanges) > 0 {
+		for _, raw := range edit.DocumentChanges {
+			var entry workspaceEditEntry
+			if err := json.Unmarshal(raw, &entry); err != nil {
+				return touched, err
+			}
+			if err := applyWorkspaceEditEntry(entry, store, workspace); err != nil {
+				return touched, err
+			}
+			touched++
+		}
+		return touched, nil
+	}
+
+	for uri, edits := range edit.Changes {
+		if err := applyTextEditsToURI(uri, edits, store, workspace); err != nil {
+			return touched, err
+		}
+		touched++
+	}
+	return touched, nil
+}
+
+func applyWorkspaceEditEntry(entry workspaceEditEntry, store *DocumentStore, workspace *Workspace) error {
+	switch entry.Kind {
+	case "":
+		return applyTextEditsToURI(entry.TextDocument.URI, entry.Edits, store, workspace)
+
+	case "create":
+		path, err := workspace.Resolve(uriToPath(entry.URI))
+		if err != nil {
+			return err
+		}
+		if path == workspace.Root() {
+			return errWorkspaceRoot
+		}
+		if _, err := os.Lstat(path); err == nil && !entry.Options.Overwrite {
+			if entry.Options.IgnoreIfExists {
+				return nil
+			}
+			return fmt.Errorf("%s already exists", path)
+		}
+		return CreateFile(path, "", true)
+
+	case "rename":
+		from, err := workspace.ResolveLink(uriToPath(entry.OldURI))
+		if err != nil {
+			return err
+		}
+		to, err := workspace.ResolveLink(uriToPath(entry.NewURI))
+		if err != nil {
+			return err
+		}
+		if from == workspace.Root() || to == workspace.Root() {
+			return errWorkspaceRoot
+		}
+		if _, err := os.Lstat(to); err == nil && !entry.Options.Overwrite && entry.Options.IgnoreIfExists {
+			return nil
+		}
+		if store.HasOpen(to) {
+			return errTargetOpen
+		}
+		if err := RenamePath(from, to, entry.Options.Overwrite); err != nil {
+			return err
+		}
+		store.Rename(from, to)
+		return nil
+
+	case "delete":
+		path, err := workspace.ResolveLink(uriToPath(entry.URI))
+		if err != nil {
+			return err
+		}
+		if path == workspace.Root() {
+			return errWorkspaceRoot
+		}
+		if _, err := os.Lstat(path); os.IsNotExist(err) && entry.Options.IgnoreIfNotExists {
+			return nil
+		}
+		if err := DeletePath(path, entry.Options.Recursive); err != nil {
+			return err
+		}
+		store.MarkDeleted(path)
+		return nil
+	}
+
+	return fmt.Errorf("unsupported workspace edit operation: %s", entry.Kind)
+}
+
+// applyTextEditsToURI edits an open buffer, or the file on disk if nobody has
+// it open. Like a save, the rewrite is refused if the file changed on disk
+// after it was read.
+func applyTextEditsToURI(uri string, edits []TextEdit, store *DocumentStore, workspace *Workspace) error {
+	path, err := workspace.Resolve(uriToPath(uri))
+	if err != nil {
+		return err
+	}
+
+	applied, err := store.ApplyTextEdits(pathToURI(path), edits)
+	if err != nil || applied {
+		return err
+	}
+
+	stamp, content, format, err := ReadDiskText(path)
+	if err != nil {
+		return err
+	}
+	if stamp.Missing {
+		return errors.New("file does not exist")
+	}
+	newContent, err := ApplyTextEdits(content, edits)
+	if err != nil {
+		return err
+	}
+	data, err := EncodeText(newContent, format)
+	if err != nil {
+		return err
+	}
+
+	current, _, err := ReadDiskStamp(path)
+	if err != nil {
+		return err
+	}
+	if !current.Same(stamp) {
+		return fmt.Errorf("%s: %w", path, ErrDiskConflict)
+	}
+	return WriteFile(path, string(data))
+}
@@ -2,20 +2,20 @@
 // Use @6 without specific versions to let esm.sh deduplicate dependencies
 import { EditorView, lineNumbers, highlightActiveLine, highlightActiveLineGutter, drawSelection, keymap } from 'https://esm.sh/@codemirror/view@6';
 import { EditorState, Prec } from 'https://esm.sh/@codemirror/state@6';
-import { defaultKeymap, history, historyKeymap, indentWithTab, insertTab } from 'https://esm.sh/@codemirror/commands@6';
-import { syntaxHighlighting, defaultHighlightStyle, bracketMatching } from 'https://esm.sh/@codemirror/language@6';
+import { defaultKeymap, indentWithTab, insertTab } from 'https://esm.sh/@codemirror/commands@6';
+import { syntaxHighlighting, defaultHighlightStyle, bracketMatching, indentUnit } from 'https://esm.sh/@codemirror/language@6';
 import { closeBrackets, autocompletion, closeBracketsKeymap, completionKeymap, startCompletion, snippetCompletion, nextSnippetField, prevSnippetField, hasNextSnippetField, hasPrevSnippetField } from 'https://esm.sh/@codemirror/autocomplete@6';
 import { highlightSelectionMatches } from 'https://esm.sh/@codemirror/search@6';
 import { python } from 'https://esm.sh/@codemirror/lang-python@6';
 import { cpp } from 'https://esm.sh/@codemirror/lang-cpp@6';
 import { linter, lintGutter } from 'https://esm.sh/@codemirror/lint@6';
 
-// Basic setup - combining extensions manually (without autocompletion - added later with LSP)
+// Basic setup - combining extensions manually (without autocompletion - added later with LSP).
+// Undo history lives on the server so it survives reloads; see requestHistoryStep
 const basicSetup = [
     lineNumbers(),
     highlightActiveLineGutter(),
     highlightActiveLine(),
-    history(),
     drawSelection(),
     syntaxHighlighting(defaultHighlightStyle),
     bracketMatching(),
@@ -24,7 +24,6 @@ const basicSetup = [
     keymap.of([
         ...closeBracketsKeymap,
         ...defaultKeymap,
-        ...historyKeymap,
         ...completionKeymap
     ])
 ];
@@ -47,6 +46,19 @@ function connectWebSocket() {
     ws.onopen = () => {
         console.log('WebSocket connected');
         showStatus('Connected to server', 'success');
+
+        // The server forgets documents when a connection drops; reopen our tabs.
+        // Read-only previews hold no server state, they only fetch pages
+        openTabs.forEach(tab => {
+            if (tab.preview) {
+                tab.preview.loading = false;
+                return;
+            }
+            ws.send(JSON.stringify({
+                type: 'open_file',
+                payload: { path: tab.path },
+            }));
+        });
     };
 
     ws.onmessage = (event) => {
@@ -70,14 +82,121 @@ function connectWebSocket() {
 function handleServerMessage(message) {
     switch (message.type) {
         case 'file_opened':
-            loadFileContent(message.payload.path, message.payload.content);
+            loadFileContent(message.payload);
             showStatus(`Opened: ${message.payload.path}`, 'success');
             break;
 
+        case 'file_preview':
+            openPreviewTab(message.payload);
+            break;
+
+        case 'range_data':
+            handleRangeData(message.payload);
+            break;
+
         case 'file_saved':
+            handleFileSaved(message.payload);
             showStatus('File saved successfully', 'success');
             break;
 
+        case 'save_conflict':
+            handleSaveConflict(message.payload);
+            break;
+
+        case 'document_changed':
+            handleDocumentChanged(message.payload);
+            break;
+
+        case 'document_resync':
+            handleDocumentResync(message.payload);
+            break;
+
+        case 'document_saved':
+            handleDocumentSaved(message.payload);
+            break;
+
+        case 'document_renamed':
+            handleDocumentRenamed(message.payload);
+            break;
+
+        case 'document_format_changed':
+            handleDocumentFormatChanged(message.payload);
+            break;
+
+        case 'undo_result':
+        case 'redo_result':
+            handleHistoryResult(message.type, message.payload);
+            break;
+
+        case 'recovery_available':
+            handleRecoveryAvailable(message.payload);
+            break;
+
+        case 'recovery_done':
+            handleRecoveryDone(message.payload);
+            break;
+
+        case 'history_list_result':
+            handleLocalHistoryList(message.payload);
+            break;
+
+        case 'history_get_result':
+            handleLocalHistorySnapshot(message.payload);
+            break;
+
+        case 'history_restore_result':
+            handleLocalHistoryRestored(message.payload);
+            break;
+
+        case 'find_files_result':
+            handleFindFilesResult(message.payload);
+            break;
+
+        case 'search_result':
+            handleSearchResult(message.payload);
+            break;
+
+        case 'search_done':
+            handleSearchDone(message.payload);
+            break;
+
+        case 'replace_preview_result':
+            handleReplacePreview(message.payload);
+            break;
+
+        case 'replace_applied':
+            handleReplaceApplied(message.payload);
+            break;
+
+        case 'git_status_result':
+            handleGitStatus(message.payload);
+            break;
+
+        case 'git_diff_result':
+            handleGitDiff(message.payload);
+            break;
+
+        case 'git_blame_result':
+            handleGitBlame(message.payload);
+            break;
+
+        case 'git_stage_result':
+        case 'git_unstage_result':
+            handleGitIndexUpdated(message.type, message.payload);
+            break;
+
+        case 'git_commit_result':
+            handleGitCommit(message.payload);
+            break;
+
+        case 'file_changed_on_disk':
+            handleFileChangedOnDisk(message.payload);
+            break;
+
+        case 'file_deleted':
+            handleFileDeleted(message.payload);
+            break;
+
         case 'lsp_configured':
             showStatus('LSP configured successfully', 'success');
             break;
@@ -169,14 +288,39 @@ function renderTabs() {
 function updateCurrentFileDisplay() {
     const display = document.getElementById('current-file');
     if (activeTabIndex >= 0 && activeTabIndex < openTabs.length) {
-        display.textContent = openTabs[activeTabIndex].path;
+        const tab = openTabs[activeTabIndex];
+        if (tab.preview) {
+            display.textContent = `${tab.path} — read-only ${tab.preview.mode} view`;
+        } else {
+            display.textContent = tab.format ? `${tab.path} — ${formatLabel(tab.format)}` : tab.path;
+        }
     } else {
         display.textContent = 'No file open';
     }
 }
 
+// Short description of a file's encoding and line endings, e.g. "UTF-8 BOM · CRLF"
+function formatLabel(format) {
+    const encoding = format.encoding.toUpperCase() + (format.bom ? ' BOM' : '');
+    return `${encoding} · ${format.lineEnding.toUpperCase()}`;
+}
+
+// Indentation from the .editorconfig settings the server resolved for a file
+function editorConfigExtensions(config = {}) {
+    const extensions = [];
+    if (config.tabWidth) {
+        extensions.push(EditorState.tabSize.of(config.tabWidth));
+    }
+    if (config.indentStyle === 'tab') {
+        extensions.push(indentUnit.of('\t'));
+    } else if (config.indentSize) {
+        extensions.push(indentUnit.of(' '.repeat(config.indentSize)));
+    }
+    return extensions;
+}
+
 // Create editor state for a tab
-function createEditorState(content, filePath) {
+function createEditorState(content, filePath, editorConfig) {
     const languageExtension = getLanguageExtension(filePath);
 
     // Get diagnostics for this file
@@ -308,6 +452,7 @@ function createEditorState(content, filePath) {
         extensions: [
             basicSetup,
             languageExtension,
+            editorConfigExtensions(editorConfig),
             updateListener,
             lintGutter(),
             lspLinter,
@@ -324,12 +469,32 @@ function createEditorState(content, filePath) {
             // Custom keybindings with high priority
             Prec.highest(keymap.of([
                 { key: 'Ctrl-l', run: startCompletion },
-                { key: 'Ctrl-Space', run: startCompletion }  // Standard autocomplete shortcut
+                { key: 'Ctrl-Space', run: startCompletion },  // Standard autocomplete shortcut
+                { key: 'Mod-z', run: () => requestHistoryStep('undo') },
+                { key: 'Mod-y', run: () => requestHistoryStep('redo') },
+                { key: 'Mod-Shift-z', run: () => requestHistoryStep('redo') }
             ]))
         ],
     });
 }
 
+// Editor state for a read-only preview, which loads more pages as it is
+// scrolled to the bottom
+function createPreviewState(mode) {
+    return EditorState.create({
+        doc: '',
+        extensions: [
+            mode === 'hex' ? [] : lineNumbers(),
+            highlightActiveLine(),
+            drawSelection(),
+            EditorState.readOnly.of(true),
+            EditorView.domEventHandlers({
+                scroll: () => { maybeLoadNextPage(); }
+            })
+        ],
+    });
+}
+
 // Initialize editor once (called on startup)
 function initializeEditor() {
     const container = document.getElementById('editor-container');
@@ -346,7 +511,7 @@ function initializeEditor() {
 // Tab Operations
 
 // Open a new tab or switch to existing one
-function openTab(path, content) {
+function openTab(path, content, editorConfig) {
     // Check if tab already exists
     const existingIndex = findTabIndex(path);
     if (existingIndex >= 0) {
@@ -356,7 +521,7 @@ function openTab(path, content) {
 
     // Create new tab
     const tab = createTab(path, content);
-    tab.editorState = createEditorState(content, path);
+    tab.editorState = createEditorState(content, path, editorConfig);
     openTabs.push(tab);
 
     // Switch to new tab
@@ -391,13 +556,6 @@ function switchToTab(index) {
     renderTabs();
     updateCurrentFileDisplay();
 
-    // Send open_file to server to update its currentFile pointer
-    if (ws && ws.readyState === WebSocket.OPEN) {
-        ws.send(JSON.stringify({
-            type: 'open_file',
-            payload: { path: tab.path },
-        }));
-    }
 }
 
 // Close a tab
@@ -416,8 +574,14 @@ function closeTab(index) {
         }
     }
 
-    // Remove tab
+    // Remove tab and release the server-side document
     openTabs.splice(index, 1);
+    if (ws && ws.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify({
+            type: 'close_file',
+            payload: { uri: 'file://' + tab.path },
+        }));
+    }
 
     // Update active index
     if (activeTabIndex === index) {
@@ -444,25 +608,629 @@ function closeTab(index) {
 
 // Send deltas to server
 function sendDeltas(update) {
+    if (!currentFilePath || activeTabIndex < 0) {
+        return;
+    }
+    const tab = openTabs[activeTabIndex];
+    const uri = 'file://' + currentFilePath;
+
+    // One transaction may touch many ranges (multi-cursor edits); they are
+    // sent together so the server applies them atomically
+    const changes = [];
     update.changes.iterChanges((fromA, toA, fromB, toB, inserted) => {
-        const delta = {
-            type: 'delta',
-            payload: {
-                fromPos: fromA,
-                toPos: toA,
-                insert: inserted.toString(),
-            },
-        };
+        changes.push({ fromPos: fromA, toPos: toA, insert: inserted.toString() });
+    });
+
+    const batch = {
+        type: 'delta_batch',
+        payload: {
+            uri: uri,
+            version: tab.version++,
+            unit: 'utf16',  // CodeMirror positions count UTF-16 code units
+            changes: changes,
+        },
+    };
+
+    if (ws && ws.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify(batch));
+    }
+}
+
+// Load file content into editor
+function loadFileContent(doc) {
+    const index = findTabIndex(doc.path);
+    if (index >= 0) {
+        // Reopened after a reconnect: the server buffer is authoritative
+        const tab = openTabs[index];
+        if (getTabDoc(tab).toString() !== doc.content) {
+            replaceTabContent(tab, doc.content);
+        }
+        tab.version = doc.version;
+        tab.isDirty = doc.dirty;
+        tab.format = doc.format;
+        switchToTab(index);
+        renderTabs();
+        return;
+    }
+
+    openTab(doc.path, doc.content, doc.editorConfig);
+    const tab = openTabs[findTabIndex(doc.path)];
+    tab.version = doc.version;
+    tab.isDirty = doc.dirty;
+    tab.format = doc.format;
+    renderTabs();
+    updateCurrentFileDisplay();
+}
+
+// Open a binary or oversized file as a read-only view filled page by page
+function openPreviewTab(payload) {
+    const index = findTabIndex(payload.path);
+    if (index >= 0) {
+        switchToTab(index);
+        return;
+    }
+
+    const tab = createTab(payload.path, '');
+    tab.preview = {
+        mode: payload.mode,
+        size: payload.size,
+        pageSize: payload.pageSize,
+        nextOffset: 0,
+        loading: false,
+        eof: payload.size === 0,
+    };
+    tab.editorState = createPreviewState(payload.mode);
+    openTabs.push(tab);
+    switchToTab(openTabs.length - 1);
+    renderTabs();
+
+    if (payload.reason) {
+        showStatus(`Read-only: ${payload.reason}`, 'info');
+    }
+    requestNextPage(tab);
+}
+
+function requestNextPage(tab) {
+    const preview = tab.preview;
+    if (preview.loading || preview.eof || !ws || ws.readyState !== WebSocket.OPEN) {
+        return;
+    }
+    preview.loading = true;
+    ws.send(JSON.stringify({
+        type: 'read_range',
+        payload: {
+            path: tab.path,
+            offset: preview.nextOffset,
+            length: preview.pageSize,
+            mode: preview.mode,
+        },
+    }));
+}
+
+// Fetch the next page once the active preview is scrolled near its end
+function maybeLoadNextPage() {
+    const tab = openTabs[activeTabIndex];
+    if (!tab || !tab.preview) {
+        return;
+    }
+    const scroller = editor.scrollDOM;
+    if (scroller.scrollTop + scroller.clientHeight >= scroller.scrollHeight - scroller.clientHeight) {
+        requestNextPage(tab);
+    }
+}
+
+// Append a page to its preview tab
+function handleRangeData(payload) {
+    const tab = openTabs.find(t => t.path === payload.path && t.preview);
+    if (!tab || payload.offset !== tab.preview.nextOffset) {
+        return;
+    }
+
+    const doc = getTabDoc(tab);
+    const changes = { from: doc.length, insert: payload.data };
+    if (openTabs[activeTabIndex] === tab) {
+        editor.dispatch({ changes });
+    } else {
+        tab.editorState = tab.editorState.update({ changes }).state;
+    }
+
+    tab.preview.nextOffset = payload.nextOffset;
+    tab.preview.size = payload.size;
+    tab.preview.eof = payload.eof;
+    tab.preview.loading = false;
+    showStatus(`Showing ${payload.nextOffset} of ${payload.size} bytes`, 'info');
+
+    // A short first page may not fill the view, so nothing would scroll
+    maybeLoadNextPage();
+}
+
+// Find the editable tab for a document URI
+function findTabByUri(uri) {
+    return openTabs.find(tab => !tab.preview && 'file://' + tab.path === uri);
+}
+
+// Current document of a tab, whether or not it is active
+function getTabDoc(tab) {
+    return openTabs[activeTabIndex] === tab ? editor.state.doc : tab.editorState.doc;
+}
+
+// Apply changes that originate from the server without echoing them back
+function applyRemoteChanges(tab, changes) {
+    if (openTabs[activeTabIndex] === tab) {
+        isApplyingRemoteChange = true;
+        try {
+            editor.dispatch({ changes });
+        } finally {
+            isApplyingRemoteChange = false;
+        }
+    } else {
+        tab.editorState = tab.editorState.update({ changes }).state;
+    }
+}
+
+function replaceTabContent(tab, content) {
+    applyRemoteChanges(tab, { from: 0, to: getTabDoc(tab).length, insert: content });
+}
+
+// Another connection edited a document we have open
+function handleDocumentChanged(change) {
+    const tab = findTabByUri(change.uri);
+    if (!tab) {
+        return;
+    }
+    applyRemoteChanges(tab, change.changes.map(c => ({ from: c.fromPos, to: c.toPos, insert: c.insert })));
+    tab.version = change.version;
+    tab.isDirty = change.dirty;
+    renderTabs();
+}
+
+// Ask the server to undo or redo the active document's last change
+function requestHistoryStep(action) {
+    if (!currentFilePath || activeTabIndex < 0 || !ws || ws.readyState !== WebSocket.OPEN) {
+        return true;
+    }
+    ws.send(JSON.stringify({
+        type: action,
+        payload: { uri: 'file://' + currentFilePath },
+    }));
+    return true;
+}
+
+// The server undid or redid a change; the edits come back for us to apply
+function handleHistoryResult(type, payload) {
+    const tab = findTabByUri(payload.uri);
+    if (!tab) {
+        return;
+    }
+    if (!payload.applied) {
+        showStatus(type === 'undo_result' ? 'Nothing to undo' : 'Nothing to redo', 'info');
+        return;
+    }
+    const change = payload.change;
+    applyRemoteChanges(tab, change.changes.map(c => ({ from: c.fromPos, to: c.toPos, insert: c.insert })));
+    tab.version = change.version;
+    tab.isDirty = change.dirty;
+    renderTabs();
+}
+
+// Our edit was based on a stale version; take the server's buffer
+function handleDocumentResync(doc) {
+    const tab = findTabByUri(doc.uri);
+    if (!tab) {
+        return;
+    }
+    replaceTabContent(tab, doc.content);
+    tab.version = doc.version;
+    tab.isDirty = doc.dirty;
+    renderTabs();
+    showStatus(`Resynchronized ${tab.filename} with the server`, 'info');
+}
+
+// A file changed outside the editor; clean buffers were already reloaded
+// through document_changed
+function handleFileChangedOnDisk(change) {
+    const tab = findTabByUri(change.uri);
+    if (!tab) {
+        return;
+    }
+    if (change.reloaded) {
+        tab.version = change.version;
+        showStatus(`Reloaded ${tab.filename} from disk`, 'info');
+    } else {
+        showStatus(`${tab.filename} changed on disk; your unsaved edits were kept`, 'error');
+    }
+}
+
+// Unsaved edits to this file survived a crash in a swap file; offer them back.
+// The restored text arrives as an ordinary document_changed.
+function handleRecoveryAvailable(payload) {
+    const name = payload.path.split('/').pop();
+    const swapTime = new Date(payload.swapTime).toLocaleString();
+    const lines = payload.diff.split('\n');
+    const diff = lines.length > 40 ? lines.slice(0, 40).join('\n') + `\n... (${lines.length - 40} more lines)` : payload.diff;
+    const warning = payload.diskChanged ? '\nThe file has also changed on disk since then.\n' : '';
+
+    const restore = confirm(`Unsaved changes to ${name} from ${swapTime} were recovered.${warning}\n${diff}\nOK: restore them\nCancel: discard them`);
+    ws.send(JSON.stringify({
+        type: 'recover_file',
+        payload: { uri: payload.uri, action: restore ? 'restore' : 'discard' },
+    }));
+}
+
+function handleRecoveryDone(payload) {
+    const tab = findTabByUri(payload.uri);
+    const name = tab ? tab.filename : payload.uri.split('/').pop();
+    if (payload.action === 'restore') {
+        showStatus(`Restored unsaved changes to ${name}`, 'success');
+    } else {
+        showStatus(`Discarded recovered changes to ${name}`, 'info');
+    }
+}
+
+function handleFileDeleted(change) {
+    const tab = findTabByUri(change.uri);
+    if (!tab) {
+        return;
+    }
+    tab.isDirty = true;
+    renderTabs();
+    showStatus(`${tab.filename} was deleted on disk`, 'error');
+}
+
+function handleFileSaved(payload) {
+    const tab = findTabByUri(payload.uri);
+    // Edits made after a buffer save was requested keep the tab dirty
+    if (tab && (!payload.version || payload.version === tab.version)) {
+        tab.isDirty = false;
+        renderTabs();
+    }
+}
+
+// Must match ContentChecksum in server/document.go
+function contentChecksum(text) {
+    const bytes = new TextEncoder().encode(text);
+    let hash = 0x811c9dc5;
+    for (let i = 0; i < bytes.length; i++) {
+        hash ^= bytes[i];
+        hash = Math.imul(hash, 0x01000193);
+    }
+    return `fnv1a32:${(hash >>> 0).toString(16).padStart(8, '0')}:${bytes.length}`;
+}
+
+// The file changed on disk since we opened it; let the user pick a side.
+// A merged result can be saved with window.resolveSaveConflict.
+function handleSaveConflict(conflict) {
+    const name = conflict.path.split('/').pop();
+    const what = conflict.diskDeleted ? 'was deleted' : 'changed';
+
+    if (confirm(`${name} ${what} on disk since it was opened.\n\nOK: overwrite it with your version\nCancel: more options`)) {
+        window.resolveSaveConflict(conflict.path, conflict.content);
+    } else if (!conflict.diskDeleted && confirm(`Reload ${name} from disk and discard your changes?`)) {
+        ws.send(JSON.stringify({
+            type: 'reload_file',
+            payload: { uri: conflict.uri },
+        }));
+    } else {
+        showStatus(`Save of ${name} cancelled`, 'error');
+    }
+}
+
+// Write content regardless of what is on disk now
+window.resolveSaveConflict = (path, content) => {
+    if (ws && ws.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify({
+            type: 'save',
+            payload: { path, content, force: true },
+        }));
+    } else {
+        showStatus('Not connected to server', 'error');
+    }
+};
+
+// A file operation moved a document we have open
+function handleDocumentRenamed(payload) {
+    const tab = findTabByUri(payload.oldUri);
+    if (!tab) {
+        return;
+    }
+    tab.path = payload.path;
+    tab.filename = payload.path.split('/').pop();
+    if (openTabs[activeTabIndex] === tab) {
+        currentFilePath = tab.path;
+    }
+    renderTabs();
+    updateCurrentFileDisplay();
+}
+
+// Another connection saved a document we have open
+function handleDocumentSaved(payload) {
+    const tab = findTabByUri(payload.uri);
+    if (!tab) {
+        return;
+    }
+    tab.isDirty = false;
+    renderTabs();
+}
+
+// The server changed a document's encoding or line endings
+function handleDocumentFormatChanged(payload) {
+    const tab = findTabByUri(payload.uri);
+    if (!tab) {
+        return;
+    }
+    tab.format = payload.format;
+    tab.isDirty = payload.dirty;
+    renderTabs();
+    updateCurrentFileDisplay();
+}
+
+// Change how the active file is saved, e.g. setFileFormat({lineEnding: 'crlf'}).
+// With reopen: true the file is read again from disk in the given encoding.
+window.setFileFormat = (changes) => {
+    if (activeTabIndex < 0 || !ws || ws.readyState !== WebSocket.OPEN) {
+        return;
+    }
+    const tab = openTabs[activeTabIndex];
+    ws.send(JSON.stringify({
+        type: 'set_file_format',
+        payload: { uri: 'file://' + tab.path, ...changes }
+    }));
+};
+
+// Browse the local history of the active file: pick a snapshot, review its
+// diff against the current text and optionally roll back to it
+window.showLocalHistory = () => {
+    if (activeTabIndex < 0 || !ws || ws.readyState !== WebSocket.OPEN) {
+        return;
+    }
+    ws.send(JSON.stringify({
+        type: 'history_list',
+        payload: { path: openTabs[activeTabIndex].path },
+    }));
+};
 
-        if (ws && ws.readyState === WebSocket.OPEN) {
-            ws.send(JSON.stringify(delta));
+function handleLocalHistoryList(payload) {
+    const name = payload.path.split('/').pop();
+    if (payload.snapshots.length === 0) {
+        showStatus(`No local history for ${name}`, 'info');
+        return;
+    }
+    const lines = payload.snapshots.map(snap =>
+        `${snap.id}: ${new Date(snap.time).toLocaleString()} (${snap.reason}) +${snap.added} -${snap.removed}`);
+    const id = prompt(`Local history of ${name}:\n${lines.join('\n')}\n\nSnapshot to view:`, payload.snapshots[0].id);
+    if (!id) {
+        return;
+    }
+    ws.send(JSON.stringify({
+        type: 'history_get',
+        payload: { path: payload.path, id: parseInt(id, 10) },
+    }));
+}
+
+function handleLocalHistorySnapshot(payload) {
+    const name = payload.path.split('/').pop();
+    const when = new Date(payload.snapshot.time).toLocaleString();
+    if (!payload.diff) {
+        showStatus(`Snapshot ${payload.snapshot.id} of ${name} matches the current text`, 'info');
+        return;
+    }
+    const lines = payload.diff.split('\n');
+    const diff = lines.length > 40 ? lines.slice(0, 40).join('\n') + `\n... (${lines.length - 40} more lines)` : payload.diff;
+    if (confirm(`${name} as of ${when} compared with now:\n\n${diff}\nRestore this snapshot?`)) {
+        ws.send(JSON.stringify({
+            type: 'history_restore',
+            payload: { path: payload.path, id: payload.snapshot.id },
+        }));
+    }
+}
+
+// An open buffer receives the restored text as a document_changed
+function handleLocalHistoryRestored(payload) {
+    const name = payload.path.split('/').pop();
+    if (payload.inBuffer) {
+        showStatus(`Restored snapshot ${payload.id} of ${name}; save to keep it`, 'success');
+    } else {
+        showStatus(`Restored snapshot ${payload.id} of ${name} on disk`, 'success');
+    }
+}
+
+// Fuzzy quick open: ask the server's file index for paths matching query
+window.findFiles = (query, limit = 20) => {
+    if (!ws || ws.readyState !== WebSocket.OPEN) {
+        return;
+    }
+    ws.send(JSON.stringify({
+        type: 'find_files',
+        payload: { query, limit },
+    }));
+};
+
+// Offer the matches as suggestions in the Open File dialog, unless the user
+// has typed on since the query was sent
+function handleFindFilesResult(payload) {
+    const input = document.getElementById('input-file-path');
+    const list = document.getElementById('file-suggestions');
+    if (!input || !list || input.value !== payload.query) {
+        return;
+    }
+    list.replaceChildren(...payload.results.map(match => {
+        const option = document.createElement('option');
+        option.value = match.relPath;
+        return option;
+    }));
+    if (payload.indexing) {
+        showStatus('Still indexing the workspace; results may be incomplete', 'info');
+    }
+}
+
+// Workspace search. Results stream in batches and collect in
+// currentSearch.results; a new search replaces the one still running.
+let currentSearch = null;
+let nextSearchId = 1;
+
+// e.g. searchWorkspace('TODO', {include: ['*.go'], wholeWord: true, context: 2})
+window.searchWorkspace = (query, options = {}) => {
+    if (!ws || ws.readyState !== WebSocket.OPEN) {
+        showStatus('Not connected to server', 'error');
+        return;
+    }
+    window.cancelSearch();
+    currentSearch = { id: nextSearchId++, query, results: [] };
+    ws.send(JSON.stringify({
+        type: 'search',
+        payload: { id: currentSearch.id, query, ...options },
+    }));
+    showStatus(`Searching for ${query}...`, 'info');
+};
+
+window.cancelSearch = () => {
+    if (currentSearch && !currentSearch.done && ws && ws.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify({
+            type: 'search_cancel',
+            payload: { id: currentSearch.id },
+        }));
+    }
+};
+
+function handleSearchResult(payload) {
+    if (!currentSearch || payload.id !== currentSearch.id) {
+        return;
+    }
+    currentSearch.results.push(...payload.results);
+    for (const file of payload.results) {
+        for (const match of file.matches) {
+            console.log(`${file.path}:${match.line + 1}: ${match.text}`);
         }
+    }
+}
+
+function handleSearchDone(payload) {
+    if (!currentSearch || payload.id !== currentSearch.id) {
+        return;
+    }
+    currentSearch.done = true;
+    if (payload.error) {
+        showStatus(payload.error, 'error');
+    } else if (payload.cancelled) {
+        showStatus(`Search cancelled after ${payload.matches} matches`, 'info');
+    } else {
+        const more = payload.truncated ? ' (stopped early)' : '';
+        showStatus(`${payload.matches} matches in ${payload.files} files${more}`, 'success');
+    }
+}
+
+// Workspace find and replace: preview the edits, confirm, then apply them.
+// In regex mode the replacement may use $1 or ${name}.
+// e.g. replaceInWorkspace('oldName', 'newName', {wholeWord: true, include: ['*.go']})
+window.replaceInWorkspace = (query, replacement, options = {}) => {
+    if (!ws || ws.readyState !== WebSocket.OPEN) {
+        showStatus('Not connected to server', 'error');
+        return;
+    }
+    window.cancelSearch();
+    currentSearch = { id: nextSearchId++, query, results: [] };
+    ws.send(JSON.stringify({
+        type: 'replace_preview',
+        payload: { id: currentSearch.id, query, replacement, ...options },
+    }));
+};
+
+function handleReplacePreview(payload) {
+    if (!currentSearch || payload.id !== currentSearch.id) {
+        return;
+    }
+    currentSearch.done = true;
+    if (payload.error) {
+        showStatus(payload.error, 'error');
+        return;
+    }
+    if (!payload.files || payload.files.length === 0) {
+        showStatus('Nothing to replace', 'info');
+        return;
+    }
+
+    const lines = [];
+    for (const file of payload.files) {
+        for (const edit of file.edits) {
+            lines.push(`${file.path}:${edit.range.start.line + 1}: ${edit.oldText} -> ${edit.newText}`);
+        }
+    }
+    const shown = lines.length > 30 ? lines.slice(0, 30).concat(`... (${lines.length - 30} more)`) : lines;
+    const more = payload.truncated ? ' (stopped early)' : '';
+    if (!confirm(`Replace ${payload.edits} matches in ${payload.files.length} files${more}?\n\n${shown.join('\n')}`)) {
+        return;
+    }
+    ws.send(JSON.stringify({
+        type: 'replace_apply',
+        payload: {
+            id: payload.id,
+            files: payload.files.map(file => ({ path: file.path, checksum: file.checksum, edits: file.edits })),
+        },
+    }));
+}
+
+function handleReplaceApplied(payload) {
+    const saved = (payload.saved || []).length;
+    const unsaved = (payload.unsaved || []).length;
+    const note = unsaved ? `; ${unsaved} open files left unsaved` : '';
+    showStatus(`Replaced in ${saved + unsaved} files${note}`, 'success');
+}
+
+// Git. Results are kept in gitState for the gutter and status views; the
+// path arguments default to the file in the active tab.
+const gitState = { status: null, hunks: {}, blame: {} };
+
+function sendGit(type, payload = {}) {
+    if (!ws || ws.readyState !== WebSocket.OPEN) {
+        showStatus('Not connected to server', 'error');
+        return;
+    }
+    ws.send(JSON.stringify({ type, payload }));
+}
+
+window.gitStatus = () => sendGit('git_status');
+window.gitDiff = (path = currentFilePath) => sendGit('git_diff', { path });
+window.gitBlame = (path = currentFilePath) => sendGit('git_blame', { path });
+window.gitStage = (paths = [currentFilePath]) => sendGit('git_stage', { paths });
+window.gitUnstage = (paths = [currentFilePath]) => sendGit('git_unstage', { paths });
+window.gitCommit = (message, amend = false) => sendGit('git_commit', { message, amend });
+
+function handleGitStatus(payload) {
+    gitState.status = payload;
+    const branch = payload.branch || 'detached HEAD';
+    const staged = payload.files.filter(file => file.staged).length;
+    showStatus(`${branch}: ${payload.files.length} changed files, ${staged} staged`, 'info');
+}
+
+function handleGitDiff(payload) {
+    gitState.hunks[payload.path] = payload.hunks;
+    for (const hunk of payload.hunks) {
+        console.log(`${payload.path}:${hunk.startLine + 1}: ${hunk.kind}`);
+    }
+}
+
+function handleGitBlame(payload) {
+    gitState.blame[payload.path] = payload;
+    payload.lines.forEach((hash, i) => {
+        const commit = payload.commits[hash];
+        const who = commit.uncommitted ? 'uncommitted' : `${hash.slice(0, 8)} ${commit.author}`;
+        console.log(`${i + 1}: ${who} ${commit.summary}`);
     });
 }
 
-// Load file content into editor
-function loadFileContent(path, content) {
-    openTab(path, content);
+function handleGitIndexUpdated(type, payload) {
+    const staging = type === 'git_stage_result';
+    const verb = staging ? 'Staged' : 'Unstaged';
+    const unsaved = staging && payload.unsaved.length ? `; ${payload.unsaved.length} files have unsaved edits that were not included` : '';
+    showStatus(`${verb} ${payload.paths.length} files${unsaved}`, unsaved ? 'info' : 'success');
+}
+
+function handleGitCommit(payload) {
+    if (payload.error) {
+        showStatus('Commit failed: ' + payload.error, 'error');
+        return;
+    }
+    showStatus(`Committed ${payload.hash.slice(0, 8)}`, 'success');
 }
 
 // Open file from UI
@@ -483,7 +1251,7 @@ window.openFileFromUI = (path) => {
 };
 
 // Configure LSP from UI
-window.configureLSPFromUI = (language, serverPath, compileCommandsDir) => {
+window.configureLSPFromUI = (language, serverPath, compileCommandsDir, formatOnSave = false, codeActionsOnSave = []) => {
     if (ws && ws.readyState === WebSocket.OPEN) {
         ws.send(JSON.stringify({
             type: 'configure_lsp',
@@ -491,6 +1259,8 @@ window.configureLSPFromUI = (language, serverPath, compileCommandsDir) => {
                 language: language,
                 serverPath: serverPath || '',
                 compileCommandsDir,
+                formatOnSave,
+                codeActionsOnSave,
             },
         }));
     } else {
@@ -505,22 +1275,24 @@ window.saveFile = () => {
         return;
     }
 
+    if (openTabs[activeTabIndex].preview) {
+        showStatus('This file is open read-only', 'error');
+        return;
+    }
+
     const content = editor.state.doc.toString();
 
     if (ws && ws.readyState === WebSocket.OPEN) {
+        // The server writes its own buffer; the checksum proves ours matches.
+        // The tab is marked clean once the server confirms with file_saved
         ws.send(JSON.stringify({
             type: 'save',
             payload: {
                 path: currentFilePath,
-                content,
+                mode: 'buffer',
+                checksum: contentChecksum(content),
             },
         }));
-
-        // Mark tab as clean
-        if (activeTabIndex >= 0 && activeTabIndex < openTabs.length) {
-            openTabs[activeTabIndex].isDirty = false;
-            renderTabs();
-        }
     } else {
         showStatus('Not connected to server', 'error');
     }